@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Power actions that can be run on a target over SSH, or through the BMC
+const (
+	actionShutdown  = "shutdown"
+	actionReboot    = "reboot"
+	actionSuspend   = "suspend"
+	actionHibernate = "hibernate"
+	actionForceOff  = "force-off" // Cuts the power without shutting down
+)
+
+// Every power action, in the order they are offered
+var powerActions = []string{actionShutdown, actionReboot, actionSuspend, actionHibernate, actionForceOff}
+
+// ActionConfig defines the remote command of a power action
+type ActionConfig struct {
+	Command string `yaml:"command" json:"command"` // Go template, may use {{.Name}}, {{.Host}}, {{.User}} and {{.MAC}} of the target
+	Sudo    bool   `yaml:"sudo" json:"sudo"`       // Run through "sudo -S", feeding auth.shutdownPassword
+}
+
+// Used when a target does not define its shutdown action. The other actions
+// are only offered when the target defines them.
+var defaultShutdownAction = ActionConfig{Command: "shutdown -h now", Sudo: true}
+
+// Action returns the definition of a power action of the target and whether
+// the target offers it. Targets using the redfish driver offer the actions
+// their BMC carries out without a command.
+func (t TargetConfig) Action(name string) (ActionConfig, bool) {
+	if action, ok := t.Actions[name]; ok {
+		return action, true
+	}
+	if _, ok := redfishResetTypes[name]; ok && t.DriverName() == driverRedfish {
+		return ActionConfig{}, true
+	}
+	if name == actionShutdown {
+		return defaultShutdownAction, true
+	}
+	return ActionConfig{}, false
+}
+
+// ActionNames returns the power actions the target offers
+func (t TargetConfig) ActionNames() []string {
+	var names []string
+	for _, name := range powerActions {
+		if _, ok := t.Action(name); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ExtraActions returns the power actions besides shutdown, shown as extra buttons
+func (t TargetConfig) ExtraActions() []string {
+	var names []string
+	for _, name := range t.ActionNames() {
+		if name != actionShutdown {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// remoteCommand renders the command run on the target for the action
+func (a ActionConfig) remoteCommand(target TargetConfig) (string, error) {
+	tmpl, err := template.New("action").Option("missingkey=error").Parse(a.Command)
+	if err != nil {
+		return "", fmt.Errorf("invalid command template %q: %v", a.Command, err)
+	}
+	var command strings.Builder
+	if err := tmpl.Execute(&command, target); err != nil {
+		return "", fmt.Errorf("invalid command template %q: %v", a.Command, err)
+	}
+	if a.Sudo {
+		return "sudo -S " + command.String(), nil
+	}
+	return command.String(), nil
+}
+
+// actionStatus is the server status shown while an action is carried out
+func actionStatus(name string) string {
+	switch name {
+	case actionReboot:
+		return "Rebooting"
+	case actionSuspend:
+		return "Suspending"
+	case actionHibernate:
+		return "Hibernating"
+	case actionForceOff:
+		return "Powering off"
+	}
+	return "Shutting down"
+}
+
+// validateActions checks the action definitions of a target
+func validateActions(target TargetConfig) []string {
+	var names []string
+	for name := range target.Actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		action := target.Actions[name]
+		if !containsString(powerActions, name) {
+			problems = append(problems, fmt.Sprintf("unknown action %q, use one of %s", name, strings.Join(powerActions, ", ")))
+			continue
+		}
+		if strings.TrimSpace(action.Command) == "" {
+			problems = append(problems, fmt.Sprintf("%s: command is required", name))
+			continue
+		}
+		if _, err := action.remoteCommand(target); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	return problems
+}
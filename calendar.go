@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Calendars holds the parsed iCalendar files of the configuration
+type Calendars struct {
+	Blackout []CalendarEvent // Days on which no window wakes the server
+	Events   []CalendarEvent // Events that become one-time windows
+}
+
+var activeCalendars atomic.Pointer[Calendars]
+
+func init() {
+	activeCalendars.Store(&Calendars{})
+}
+
+// How far ahead calendar events are turned into one-time windows
+const calendarHorizon = 14 * 24 * time.Hour
+
+// Days covered by the calendar preview of the UI and the default of the API
+const calendarPreviewDays = 60
+
+// Overrides created from the events calendar carry this source
+const overrideSourceCalendar = "calendar"
+
+// currentCalendars returns the active calendars. The returned value must not be modified.
+func currentCalendars() *Calendars {
+	return activeCalendars.Load()
+}
+
+// applyCalendars atomically makes cal the active calendars
+func applyCalendars(cal *Calendars) {
+	activeCalendars.Store(cal)
+}
+
+// loadCalendars reads the calendar files named in the configuration
+func loadCalendars(cfg *Config) (*Calendars, error) {
+	cal := &Calendars{}
+	var err error
+	if cfg.Calendar.Blackout != "" {
+		if cal.Blackout, err = loadCalendarFile(cfg.Calendar.Blackout); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Calendar.Events != "" {
+		if cal.Events, err = loadCalendarFile(cfg.Calendar.Events); err != nil {
+			return nil, err
+		}
+	}
+	return cal, nil
+}
+
+// blackoutOn returns the blackout event on the calendar day of t, in the
+// location of t, or nil
+func (cal *Calendars) blackoutOn(t time.Time) *CalendarEvent {
+	y, m, d := t.Date()
+	dayStart := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	// All-day dates are floating, look a day further on both sides
+	from, to := dayStart.AddDate(0, 0, -1), dayStart.AddDate(0, 0, 2)
+	for _, event := range cal.Blackout {
+		for _, occurrence := range event.occurrences(from, to) {
+			if occurrence.coversDay(t) {
+				return &occurrence
+			}
+		}
+	}
+	return nil
+}
+
+// eventOverrides returns the one-time windows for the event occurrences that
+// have not ended before from and start before to
+func (cal *Calendars) eventOverrides(from, to time.Time, autoShutdown bool) []ScheduleOverride {
+	var overrides []ScheduleOverride
+	for _, event := range cal.Events {
+		for _, occurrence := range event.occurrences(from, to) {
+			start, end := occurrence.localSpan()
+			if !end.After(start) || !end.After(from) {
+				continue
+			}
+			key := event.UID
+			if key == "" {
+				key = event.Summary
+			}
+			overrides = append(overrides, ScheduleOverride{
+				ID:           fmt.Sprintf("cal-%s-%d", key, start.Unix()),
+				Type:         overrideOnce,
+				Name:         fmt.Sprintf("%s %s", event.Summary, start.Format("2006-01-02 15:04")),
+				Start:        start.Format(time.RFC3339),
+				End:          end.Format(time.RFC3339),
+				AutoShutdown: autoShutdown,
+				Source:       overrideSourceCalendar,
+			})
+		}
+	}
+	return overrides
+}
+
+// syncCalendarOverrides makes the calendar overrides of the schedule match
+// desired and describes what changed. The run state of existing windows is
+// kept, and a window that still owns the server stays until the scheduler is
+// done with it.
+func (c *ScheduleConfig) syncCalendarOverrides(desired []ScheduleOverride, now time.Time) []string {
+	want := make(map[string]ScheduleOverride)
+	for _, o := range desired {
+		want[o.ID] = o
+	}
+
+	var changes []string
+	var kept []ScheduleOverride
+	for _, o := range c.Overrides {
+		if o.Source != overrideSourceCalendar {
+			kept = append(kept, o)
+			continue
+		}
+		w, ok := want[o.ID]
+		delete(want, o.ID)
+		switch {
+		case ok:
+			w.Created, w.LastRun = o.Created, o.LastRun
+			if w != o {
+				changes = append(changes, fmt.Sprintf("updating one-time window %q", w.Name))
+			}
+			kept = append(kept, w)
+		case c.StartedBySchedule && c.ActiveWindow == o.Name:
+			kept = append(kept, o)
+		default:
+			changes = append(changes, fmt.Sprintf("removing one-time window %q, the event is gone", o.Name))
+		}
+	}
+	for _, o := range desired {
+		if _, added := want[o.ID]; !added {
+			continue
+		}
+		o.Created = now.Format(time.RFC3339)
+		changes = append(changes, fmt.Sprintf("adding one-time window %q", o.Name))
+		kept = append(kept, o)
+	}
+
+	c.Overrides = kept
+	return changes
+}
+
+// BlackoutDay is a day blacked out by the blackout calendar
+type BlackoutDay struct {
+	Date    string `json:"date"`
+	Summary string `json:"summary"`
+}
+
+// CancelledWake is a wake time of a window that falls on a blackout day
+type CancelledWake struct {
+	Time   time.Time `json:"time"`
+	Window string    `json:"window"`
+	Reason string    `json:"reason"`
+}
+
+// CalendarPreview lists what the calendars change in the coming days
+type CalendarPreview struct {
+	Blackouts      []BlackoutDay      `json:"blackouts"`
+	CancelledWakes []CancelledWake    `json:"cancelledWakes"`
+	Events         []ScheduleOverride `json:"events"`
+}
+
+// calendarPreview returns the blackout days, the wake times they cancel and the
+// one-time windows from events in the days from now
+func (c ScheduleConfig) calendarPreview(cal *Calendars, now time.Time, days int) CalendarPreview {
+	preview := CalendarPreview{
+		Blackouts:      []BlackoutDay{},
+		CancelledWakes: []CancelledWake{},
+		Events:         []ScheduleOverride{},
+	}
+	until := now.AddDate(0, 0, days)
+
+	local := now.In(time.Local)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 12, 0, 0, 0, time.Local)
+	for i := 0; i < days; i++ {
+		day := today.AddDate(0, 0, i)
+		if event := cal.blackoutOn(day); event != nil {
+			preview.Blackouts = append(preview.Blackouts, BlackoutDay{Date: day.Format("2006-01-02"), Summary: event.Summary})
+		}
+	}
+
+	for _, window := range c.Windows {
+		if !window.Enabled {
+			continue
+		}
+		wake, err := window.wakeSchedule()
+		if err != nil {
+			continue
+		}
+		for t := wake.Next(now); !t.IsZero() && t.Before(until); t = wake.Next(t) {
+			if event := cal.blackoutOn(t); event != nil {
+				preview.CancelledWakes = append(preview.CancelledWakes, CancelledWake{Time: t, Window: window.Name, Reason: event.Summary})
+			}
+		}
+	}
+
+	preview.Events = append(preview.Events, cal.eventOverrides(now, until, currentConfig().Calendar.AutoShutdown)...)
+	return preview
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+const mainUsage = `Usage: wol-server [command] [arguments]
+
+Commands:
+  serve          Run the web interface and schedule checker (default)
+  wake           Wake the configured server and wait until it is online
+  shutdown       Shut the configured server down over SSH
+  probe          Print whether the configured server is reachable (exit 1 if offline)
+  check-config   Validate config.yaml, .env and schedule.json (exit 1 on errors)
+  ctl            Talk to a running wol-server over HTTP (see 'wol-server ctl -h')
+`
+
+// newCommandFlagSet creates the flag set shared by the one-shot commands
+func newCommandFlagSet(name, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: wol-server %s\n\n%s\n", name, description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runWakeCommand runs the wake workflow for the configured target
+func runWakeCommand(args []string) int {
+	fs := newCommandFlagSet("wake", "Wake the configured server, resending packets until it answers the probe.\nExits 4 if it is not online within the wake timeout.")
+	noWait := fs.Bool("no-wait", false, "Send a single packet and exit without waiting for the server")
+	timeout := fs.Duration("timeout", 0, "Override the wake timeout of the configuration")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	loadEnvVariables()
+
+	if *noWait {
+		if err := sendWakeOnLAN(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to wake %s: %v\n", currentTarget().Host, err)
+			return exitFailure
+		}
+		fmt.Printf("Wake-on-LAN packet sent to %s (%s)\n", currentTarget().Host, currentTarget().MAC)
+		return exitOK
+	}
+
+	workflow := newWakeWorkflow(clock, power, currentConfig())
+	if *timeout > 0 {
+		workflow.timeout = *timeout
+	}
+	sent := 0
+	result := workflow.run(wakeSourceCLI, func(r WakeResult) {
+		if r.Packets > sent {
+			sent = r.Packets
+			fmt.Printf("Wake-on-LAN packet %d sent to %s (%s)\n", sent, currentTarget().Host, currentTarget().MAC)
+		}
+	})
+
+	fmt.Printf("%s: %s\n", currentTarget().Host, result.Summary())
+	switch result.Outcome {
+	case wakeOnline, wakeAlreadyOnline:
+		return exitOK
+	case wakeTimedOut:
+		return exitTimeout
+	}
+	return exitFailure
+}
+
+// runShutdownCommand runs the shutdown path once
+func runShutdownCommand(args []string) int {
+	fs := newCommandFlagSet("shutdown", "Shut the configured server down over SSH using SHUTDOWN_PASSWORD.")
+	force := fs.Bool("force", false, "Shut down even if the safety checks on the server fail")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	loadEnvVariables()
+
+	if currentConfig().passwordMissing("", actionShutdown) {
+		fmt.Fprintln(os.Stderr, "SHUTDOWN_PASSWORD not set in environment, cannot perform shutdown")
+		return exitFailure
+	}
+
+	if !isServerOnline() {
+		fmt.Printf("Server %s is already offline\n", currentTarget().Host)
+		return exitOK
+	}
+
+	if !*force {
+		// Leases taken on a running wol-server block the shutdown as well
+		if err := loadLeases(currentConfig().Leases.File); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		if reasons := checkGuards(); len(reasons) > 0 {
+			fmt.Fprintf(os.Stderr, "Not shutting down %s, the safety checks failed (use -force to override):\n", currentTarget().Host)
+			for _, reason := range reasons {
+				fmt.Fprintf(os.Stderr, "  %s\n", reason)
+			}
+			return exitFailure
+		}
+	}
+
+	if err := shutdownServer(currentConfig().Auth.ShutdownPassword); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to shutdown %s: %v\n", currentTarget().Host, err)
+		return exitFailure
+	}
+
+	fmt.Printf("Shutdown initiated on %s\n", currentTarget().Host)
+	return exitOK
+}
+
+// runProbeCommand prints whether the server is reachable
+func runProbeCommand(args []string) int {
+	fs := newCommandFlagSet("probe", "Print whether the configured server is reachable. Exits 1 if it is offline.")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	loadEnvVariables()
+
+	if !isServerOnline() {
+		fmt.Printf("%s: offline\n", currentTarget().Host)
+		return exitFailure
+	}
+
+	fmt.Printf("%s: online\n", currentTarget().Host)
+	return exitOK
+}
+
+// runCheckConfigCommand validates the configuration and schedule.json without starting anything
+func runCheckConfigCommand(args []string) int {
+	fs := newCommandFlagSet("check-config", "Validate config.yaml, environment overrides, schedule.json and the calendar files. Exits 1 if any error is found.")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	// Configuration file and environment overrides (the .env file is optional)
+	if !loadDotEnv() {
+		fmt.Println("No .env file found, checking process environment only")
+	}
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		fmt.Printf("%s not found, using defaults and environment variables\n", configPath)
+	}
+
+	cfg, problems, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return exitFailure
+	}
+	scheduleConfigPath = cfg.Schedule.File
+
+	// Schedule file
+	if data, err := os.ReadFile(scheduleConfigPath); os.IsNotExist(err) {
+		fmt.Printf("%s not found, a default schedule will be created on start\n", scheduleConfigPath)
+	} else if err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", scheduleConfigPath, err))
+	} else {
+		var schedule ScheduleConfig
+		if err := json.Unmarshal(data, &schedule); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid JSON: %v", scheduleConfigPath, err))
+		} else if _, err := migrateLegacySchedule(&schedule); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", scheduleConfigPath, err))
+		} else if err := validateScheduleConfig(schedule, cfg); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", scheduleConfigPath, err))
+		} else {
+			for _, window := range schedule.Windows {
+				if window.Enabled && window.AutoShutdown && cfg.windowPasswordMissing(window) {
+					problems = append(problems, fmt.Sprintf("%s: window %q has autoShutdown enabled but SHUTDOWN_PASSWORD is not set", scheduleConfigPath, window.Name))
+				}
+			}
+		}
+	}
+
+	// Calendar files
+	if cal, err := loadCalendars(cfg); err != nil {
+		problems = append(problems, err.Error())
+	} else if cfg.Calendar.Blackout != "" || cfg.Calendar.Events != "" {
+		fmt.Printf("Calendars: %d blackout event(s), %d event(s)\n", len(cal.Blackout), len(cal.Events))
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", problem)
+		}
+		return exitFailure
+	}
+
+	fmt.Println("Configuration OK")
+	return exitOK
+}
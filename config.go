@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the structure of the config.yaml file
+type Config struct {
+	Server        ServerConfig       `yaml:"server" json:"server"`
+	Targets       []TargetConfig     `yaml:"targets" json:"targets"`
+	Probes        ProbeConfig        `yaml:"probes" json:"probes"`
+	Wake          WakeConfig         `yaml:"wake" json:"wake"`
+	Schedule      ScheduleFileConfig `yaml:"schedule" json:"schedule"`
+	Calendar      CalendarConfig     `yaml:"calendar" json:"calendar"`
+	Auth          AuthConfig         `yaml:"auth" json:"auth"`
+	Notifications NotifyConfig       `yaml:"notifications" json:"notifications"`
+	Proxy         ProxyConfig        `yaml:"proxy" json:"proxy"`
+	Leases        LeaseConfig        `yaml:"leases" json:"leases"`
+	Groups        []GroupConfig      `yaml:"groups" json:"groups"`
+}
+
+// ServerConfig holds the settings of the web interface
+type ServerConfig struct {
+	Port            int `yaml:"port" json:"port"`                       // Port to listen on
+	RefreshInterval int `yaml:"refreshInterval" json:"refreshInterval"` // UI refresh interval in seconds
+}
+
+// TargetConfig describes a machine that can be woken and shut down.
+// The first target is the one controlled by the web interface and scheduler.
+type TargetConfig struct {
+	Name string `yaml:"name" json:"name"` // Display name
+	Host string `yaml:"host" json:"host"` // Hostname/IP used for probes and SSH
+	User string `yaml:"user" json:"user"` // SSH username
+	MAC  string `yaml:"mac" json:"mac"`   // MAC address for Wake-on-LAN
+
+	// How the target is powered on and off: "wol-ssh" (default) or "redfish"
+	Driver  string        `yaml:"driver" json:"driver,omitempty"`
+	Redfish RedfishConfig `yaml:"redfish" json:"redfish,omitempty"`
+
+	// Power actions run over SSH, keyed by shutdown, reboot, suspend or hibernate
+	Actions map[string]ActionConfig `yaml:"actions" json:"actions,omitempty"`
+
+	// Checks that postpone or block powering the target off
+	Guards GuardConfig `yaml:"guards" json:"guards"`
+
+	// Checks telling when the target is idle, for windows shut down when idle
+	Idle IdleConfig `yaml:"idle" json:"idle"`
+}
+
+// ProbeConfig defines how reachability of a target is checked
+type ProbeConfig struct {
+	Method  string `yaml:"method" json:"method"`   // "ping" or "tcp"
+	Port    int    `yaml:"port" json:"port"`       // TCP port for the "tcp" method
+	Timeout string `yaml:"timeout" json:"timeout"` // Go duration, e.g. "1s"
+}
+
+// WakeConfig tunes the wake workflow: packets are resent with a doubling delay
+// until the server answers the probe or the timeout expires
+type WakeConfig struct {
+	Timeout      string `yaml:"timeout" json:"timeout"`           // Go duration to wait for the server to come online
+	PollInterval string `yaml:"pollInterval" json:"pollInterval"` // Go duration between two probes
+	ResendAfter  string `yaml:"resendAfter" json:"resendAfter"`   // Go duration before the second packet
+	Packets      int    `yaml:"packets" json:"packets"`           // Maximum number of packets sent
+}
+
+// ScheduleFileConfig points at the file holding the backup schedule and sets
+// how wake times missed by the scheduler are handled
+type ScheduleFileConfig struct {
+	File        string `yaml:"file" json:"file"`
+	History     string `yaml:"history" json:"history"`         // File recording what happened to each scheduled run
+	GracePeriod string `yaml:"gracePeriod" json:"gracePeriod"` // Go duration a late wake is still performed within
+	CatchUp     bool   `yaml:"catchUp" json:"catchUp"`         // Wake for windows still open after a restart
+}
+
+// CalendarConfig points at iCalendar files that adjust the schedule
+type CalendarConfig struct {
+	Blackout     string `yaml:"blackout" json:"blackout"`         // .ics file with the days on which no window wakes
+	Events       string `yaml:"events" json:"events"`             // .ics file whose events become one-time windows
+	AutoShutdown bool   `yaml:"autoShutdown" json:"autoShutdown"` // Shut down at the end of calendar events
+}
+
+// AuthConfig holds credentials used by wol-server
+type AuthConfig struct {
+	ShutdownPassword string `yaml:"shutdownPassword" json:"shutdownPassword"` // SSH/sudo password used for shutdown
+	APIToken         string `yaml:"apiToken" json:"apiToken"`                 // Bearer token for admin endpoints
+}
+
+// NotifyConfig configures the webhook notified about power actions
+type NotifyConfig struct {
+	WebhookURL string   `yaml:"webhookURL" json:"webhookURL"`
+	Events     []string `yaml:"events" json:"events"` // Subset of notifyEvents, empty means all
+}
+
+// Events that can be sent to the notification webhook
+var notifyEvents = []string{"wake", "shutdown", "failure"}
+
+var activeConfig atomic.Pointer[Config]
+var configPath = "config.yaml"
+
+// Keys set from the .env file, so a reload can tell them apart from the process environment
+var dotEnvKeys = map[string]bool{}
+var dotEnvMu sync.Mutex
+
+func init() {
+	activeConfig.Store(defaultConfig())
+}
+
+// defaultConfig returns the configuration used when no file or env var is set
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{Port: 8080, RefreshInterval: 60},
+		Targets: []TargetConfig{{
+			Name: "server",
+			Host: "server",
+			User: "root",
+			MAC:  "aa:aa:aa:aa:aa:aa",
+		}},
+		Probes:   ProbeConfig{Method: "ping", Timeout: "1s"},
+		Wake:     WakeConfig{Timeout: "5m", PollInterval: "5s", ResendAfter: "30s", Packets: 3},
+		Schedule: ScheduleFileConfig{File: "schedule.json", History: "history.json", GracePeriod: "15m", CatchUp: true},
+		Leases:   LeaseConfig{File: "leases.json", MaxTTL: "24h"},
+	}
+}
+
+// loadConfig reads the config file (if present) and applies environment overrides.
+// It returns the resulting configuration together with every validation problem found.
+func loadConfig(path string) (*Config, []string, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	if err == nil {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			// Name the misspelled keys by their path rather than the Go type they are in
+			var root yaml.Node
+			if yaml.Unmarshal(data, &root) == nil {
+				if unknown := unknownFields(&root, reflect.TypeOf(cfg).Elem(), ""); len(unknown) > 0 {
+					return nil, nil, fmt.Errorf("failed to parse config file %s: unknown field %s", path, strings.Join(unknown, ", "))
+				}
+			}
+			return nil, nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
+	problems := applyEnvOverrides(cfg)
+	problems = append(problems, cfg.validate()...)
+	return cfg, problems, nil
+}
+
+// unknownFields returns the path and line of every key of node that does not
+// match a field of t
+func unknownFields(node *yaml.Node, t reflect.Type, path string) []string {
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return nil
+		}
+		node = node.Content[0]
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var unknown []string
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(t.Field(i).Name)
+			}
+			fields[name] = t.Field(i).Type
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			field := joinFieldPath(path, key.Value)
+			if fieldType, ok := fields[key.Value]; ok {
+				unknown = append(unknown, unknownFields(node.Content[i+1], fieldType, field)...)
+			} else {
+				unknown = append(unknown, fmt.Sprintf("%s (line %d)", field, key.Line))
+			}
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			unknown = append(unknown, unknownFields(node.Content[i+1], t.Elem(), joinFieldPath(path, node.Content[i].Value))...)
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			unknown = append(unknown, unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return unknown
+}
+
+func joinFieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// applyEnvOverrides lets the historic environment variables override the file
+func applyEnvOverrides(cfg *Config) []string {
+	var problems []string
+
+	if len(cfg.Targets) == 0 {
+		cfg.Targets = append(cfg.Targets, TargetConfig{Name: "server"})
+	}
+	target := &cfg.Targets[0]
+
+	if envServerName := os.Getenv("SERVER_NAME"); envServerName != "" {
+		// Keep an explicit display name from the file, otherwise name the target after its host
+		if target.Name == "" || target.Name == target.Host {
+			target.Name = envServerName
+		}
+		target.Host = envServerName
+	}
+
+	if envServerUser := os.Getenv("SERVER_USER"); envServerUser != "" {
+		target.User = envServerUser
+	}
+
+	if envMacAddress := os.Getenv("MAC_ADDRESS"); envMacAddress != "" {
+		target.MAC = envMacAddress
+	}
+
+	if envPort := os.Getenv("PORT"); envPort != "" {
+		val, err := strconv.Atoi(envPort)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("server.port (PORT): %q is not a number", envPort))
+		} else {
+			cfg.Server.Port = val
+		}
+	}
+
+	if envRefresh := os.Getenv("REFRESH_INTERVAL"); envRefresh != "" {
+		val, err := strconv.Atoi(envRefresh)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("server.refreshInterval (REFRESH_INTERVAL): %q is not a number", envRefresh))
+		} else {
+			cfg.Server.RefreshInterval = val
+		}
+	}
+
+	if envPassword := os.Getenv("SHUTDOWN_PASSWORD"); envPassword != "" {
+		cfg.Auth.ShutdownPassword = envPassword
+	}
+
+	return problems
+}
+
+// validate checks every field and reports all problems with their field path
+func (c *Config) validate() []string {
+	var problems []string
+	add := func(field, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		add("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.RefreshInterval <= 0 {
+		add("server.refreshInterval", "must be a positive number of seconds, got %d", c.Server.RefreshInterval)
+	}
+
+	if len(c.Targets) == 0 {
+		add("targets", "at least one target is required")
+	}
+	names := map[string]bool{}
+	for i, target := range c.Targets {
+		field := fmt.Sprintf("targets[%d]", i)
+		if target.Name == "" {
+			add(field+".name", "is required")
+		} else if names[target.Name] {
+			add(field+".name", "duplicate target name %q", target.Name)
+		}
+		names[target.Name] = true
+		if target.Host == "" {
+			add(field+".host", "is required")
+		}
+		if target.User == "" {
+			add(field+".user", "is required")
+		}
+		// The MAC address is only needed for Wake-on-LAN
+		if _, err := net.ParseMAC(target.MAC); err != nil && (target.MAC != "" || target.DriverName() == driverWOLSSH) {
+			add(field+".mac", "invalid MAC address %q", target.MAC)
+		}
+		switch target.DriverName() {
+		case driverWOLSSH:
+		case driverRedfish:
+			for _, problem := range validateRedfish(target.Redfish) {
+				add(field+".redfish", "%s", problem)
+			}
+		default:
+			add(field+".driver", "must be %q or %q, got %q", driverWOLSSH, driverRedfish, target.Driver)
+		}
+		for _, problem := range validateActions(target) {
+			add(field+".actions", "%s", problem)
+		}
+		for _, problem := range validateGuards(target.Guards) {
+			add(field+".guards", "%s", problem)
+		}
+		for _, problem := range validateIdle(target.Idle) {
+			add(field+".idle", "%s", problem)
+		}
+	}
+
+	switch c.Probes.Method {
+	case "ping":
+	case "tcp":
+		if c.Probes.Port < 1 || c.Probes.Port > 65535 {
+			add("probes.port", "must be between 1 and 65535 for the tcp method, got %d", c.Probes.Port)
+		}
+	default:
+		add("probes.method", "must be 'ping' or 'tcp', got %q", c.Probes.Method)
+	}
+	if d, err := time.ParseDuration(c.Probes.Timeout); err != nil || d <= 0 {
+		add("probes.timeout", "invalid duration %q", c.Probes.Timeout)
+	}
+
+	if d, err := time.ParseDuration(c.Wake.Timeout); err != nil || d <= 0 {
+		add("wake.timeout", "invalid duration %q", c.Wake.Timeout)
+	}
+	if d, err := time.ParseDuration(c.Wake.PollInterval); err != nil || d <= 0 {
+		add("wake.pollInterval", "invalid duration %q", c.Wake.PollInterval)
+	}
+	if d, err := time.ParseDuration(c.Wake.ResendAfter); err != nil || d <= 0 {
+		add("wake.resendAfter", "invalid duration %q", c.Wake.ResendAfter)
+	}
+	if c.Wake.Packets < 1 {
+		add("wake.packets", "must be at least 1, got %d", c.Wake.Packets)
+	}
+
+	if c.Schedule.File == "" {
+		add("schedule.file", "is required")
+	}
+	if c.Schedule.History == "" {
+		add("schedule.history", "is required")
+	}
+	if d, err := time.ParseDuration(c.Schedule.GracePeriod); err != nil || d < 0 {
+		add("schedule.gracePeriod", "invalid duration %q", c.Schedule.GracePeriod)
+	}
+
+	if c.Calendar.AutoShutdown && c.Calendar.Events != "" && c.passwordMissing("", actionShutdown) {
+		add("calendar.autoShutdown", "requires auth.shutdownPassword")
+	}
+
+	for _, problem := range validateProxy(c.Proxy) {
+		add("proxy", "%s", problem)
+	}
+	if c.Proxy.IdleShutdown && len(c.Targets) > 0 && !c.Targets[0].Idle.Enabled() {
+		add("proxy.idleShutdown", "requires idle checks in targets[0].idle")
+	}
+
+	if c.Leases.File == "" {
+		add("leases.file", "is required")
+	}
+	if d, err := time.ParseDuration(c.Leases.MaxTTL); err != nil || d <= 0 {
+		add("leases.maxTTL", "invalid duration %q", c.Leases.MaxTTL)
+	}
+
+	groups := make(map[string]bool)
+	for i, group := range c.Groups {
+		field := fmt.Sprintf("groups[%d]", i)
+		if group.Name != "" && groups[group.Name] {
+			add(field+".name", "duplicate group name %q", group.Name)
+		}
+		groups[group.Name] = true
+		for _, problem := range validateGroup(group, c.Targets) {
+			add(field, "%s", problem)
+		}
+	}
+
+	if c.Notifications.WebhookURL != "" {
+		u, err := url.Parse(c.Notifications.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("notifications.webhookURL", "must be an http(s) URL, got %q", c.Notifications.WebhookURL)
+		}
+	}
+	for i, event := range c.Notifications.Events {
+		if !containsString(notifyEvents, event) {
+			add(fmt.Sprintf("notifications.events[%d]", i), "unknown event %q, use one of %s", event, strings.Join(notifyEvents, ", "))
+		}
+	}
+
+	return problems
+}
+
+// ProbeTimeout returns the parsed probe timeout
+func (c *Config) ProbeTimeout() time.Duration {
+	d, err := time.ParseDuration(c.Probes.Timeout)
+	if err != nil || d <= 0 {
+		return time.Second
+	}
+	return d
+}
+
+// WakeTimeout returns how long the wake workflow waits for the server
+func (c *Config) WakeTimeout() time.Duration {
+	d, err := time.ParseDuration(c.Wake.Timeout)
+	if err != nil || d <= 0 {
+		return 5 * time.Minute
+	}
+	return d
+}
+
+// WakePollInterval returns the time between two probes of the wake workflow
+func (c *Config) WakePollInterval() time.Duration {
+	d, err := time.ParseDuration(c.Wake.PollInterval)
+	if err != nil || d <= 0 {
+		return 5 * time.Second
+	}
+	return d
+}
+
+// WakeResendAfter returns the delay before the wake workflow sends a second packet
+func (c *Config) WakeResendAfter() time.Duration {
+	d, err := time.ParseDuration(c.Wake.ResendAfter)
+	if err != nil || d <= 0 {
+		return 30 * time.Second
+	}
+	return d
+}
+
+// ScheduleGracePeriod returns how late a scheduled wake may still be performed
+func (c *Config) ScheduleGracePeriod() time.Duration {
+	d, err := time.ParseDuration(c.Schedule.GracePeriod)
+	if err != nil || d < 0 {
+		return 15 * time.Minute
+	}
+	return d
+}
+
+// LeaseMaxTTL returns the longest a lease may be acquired or renewed for
+func (c *Config) LeaseMaxTTL() time.Duration {
+	d, err := time.ParseDuration(c.Leases.MaxTTL)
+	if err != nil || d <= 0 {
+		return 24 * time.Hour
+	}
+	return d
+}
+
+// Masked returns a copy of the configuration with secrets hidden
+func (c *Config) Masked() Config {
+	masked := *c
+	masked.Targets = append([]TargetConfig(nil), c.Targets...)
+	for i := range masked.Targets {
+		masked.Targets[i].Redfish.Password = maskSecret(masked.Targets[i].Redfish.Password)
+	}
+	masked.Auth.ShutdownPassword = maskSecret(c.Auth.ShutdownPassword)
+	masked.Auth.APIToken = maskSecret(c.Auth.APIToken)
+	// Webhook URLs usually carry a token in their path or query
+	masked.Notifications.WebhookURL = maskSecret(c.Notifications.WebhookURL)
+	return masked
+}
+
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "********"
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// currentConfig returns the active configuration. The returned value must not be modified.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// currentTarget returns the primary target controlled by the UI and scheduler
+func currentTarget() TargetConfig {
+	return currentConfig().Targets[0]
+}
+
+// Target returns the target of that name
+func (c *Config) Target(name string) (TargetConfig, bool) {
+	for _, target := range c.Targets {
+		if target.Name == name {
+			return target, true
+		}
+	}
+	return TargetConfig{}, false
+}
+
+// passwordMissing reports whether the power action on the named target, empty
+// for the primary one, needs the shutdown password and none is set
+func (c *Config) passwordMissing(target, action string) bool {
+	if c.Auth.ShutdownPassword != "" || len(c.Targets) == 0 {
+		return false
+	}
+	t := c.Targets[0]
+	if target != "" {
+		var ok bool
+		if t, ok = c.Target(target); !ok {
+			return false
+		}
+	}
+	return t.NeedsPassword(action)
+}
+
+// groupPasswordMissing reports whether shutting the group down needs the
+// shutdown password and none is set
+func (c *Config) groupPasswordMissing(group GroupConfig) bool {
+	for _, member := range group.Members {
+		if c.passwordMissing(member.Target, actionShutdown) {
+			return true
+		}
+	}
+	return false
+}
+
+// windowPasswordMissing reports whether the auto shutdown of the window, of
+// the primary target or of its group, needs the shutdown password and none is set
+func (c *Config) windowPasswordMissing(window ScheduleWindow) bool {
+	if window.Group != "" {
+		group, ok := c.Group(window.Group)
+		return ok && c.groupPasswordMissing(group)
+	}
+	return c.passwordMissing("", actionShutdown)
+}
+
+// applyConfig atomically makes cfg the active configuration
+func applyConfig(cfg *Config) {
+	activeConfig.Store(cfg)
+}
+
+// loadDotEnv loads the optional .env file and picks up CONFIG_FILE.
+// Variables that were already set in the process environment win over the file,
+// and variables removed from the file are unset again when it is reloaded.
+// It reports whether a .env file was found.
+func loadDotEnv() bool {
+	dotEnvMu.Lock()
+	defer dotEnvMu.Unlock()
+
+	values, err := godotenv.Read()
+	found := err == nil
+
+	for key := range dotEnvKeys {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+			delete(dotEnvKeys, key)
+		}
+	}
+	for key, value := range values {
+		if _, fromFile := dotEnvKeys[key]; !fromFile {
+			if _, inProcess := os.LookupEnv(key); inProcess {
+				continue
+			}
+		}
+		os.Setenv(key, value)
+		dotEnvKeys[key] = true
+	}
+
+	if envConfig := os.Getenv("CONFIG_FILE"); envConfig != "" {
+		configPath = envConfig
+	}
+	return found
+}
+
+// loadEnvVariables loads .env, the config file and env overrides, and exits on invalid configuration
+func loadEnvVariables() {
+	// Load .env file if it exists
+	if !loadDotEnv() {
+		log.Println("No .env file found, using default values")
+	}
+
+	cfg, problems, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("Configuration error: %s", problem)
+		}
+		log.Fatalf("Invalid configuration: %d error(s), run 'wol-server check-config' for details", len(problems))
+	}
+
+	applyConfig(cfg)
+	scheduleConfigPath = cfg.Schedule.File
+
+	if cfg.passwordMissing("", actionShutdown) {
+		log.Println("SHUTDOWN_PASSWORD not set in environment. Automatic shutdown will be disabled.")
+	} else if cfg.Auth.ShutdownPassword == "" {
+		log.Println("SHUTDOWN_PASSWORD not set in environment. Power actions run over SSH will be disabled.")
+	} else {
+		log.Println("SHUTDOWN_PASSWORD loaded from environment")
+	}
+
+	target := cfg.Targets[0]
+	log.Printf("Configuration loaded: SERVER_NAME=%s, SERVER_USER=%s, MAC_ADDRESS=%s, PORT=%d, REFRESH=%d",
+		target.Host, target.User, target.MAC, cfg.Server.Port, cfg.Server.RefreshInterval)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Longest delay of a delayed shutdown, the UI offers 1, 5 and 15 minutes
+const maxShutdownDelay = time.Hour
+
+// PendingShutdown is a power action waiting for its countdown to end. Times are RFC3339.
+type PendingShutdown struct {
+	Action    string `json:"action"`
+	Requested string `json:"requested"`
+	At        string `json:"at"`    // When the action runs
+	Wall      bool   `json:"wall"`  // Logged-in users were warned with wall
+	Force     bool   `json:"force"` // Run even if the safety checks fail
+}
+
+// Remaining returns the time left until the action runs
+func (p PendingShutdown) Remaining(now time.Time) time.Duration {
+	at, err := time.Parse(time.RFC3339, p.At)
+	if err != nil || at.Before(now) {
+		return 0
+	}
+	return at.Sub(now)
+}
+
+// shutdownCountdown runs at most one delayed power action at a time
+type shutdownCountdown struct {
+	clock Clock
+	run   func(PendingShutdown) // Runs the action when the countdown ends
+
+	mu         sync.Mutex
+	pending    *PendingShutdown
+	generation int // Counts the countdowns started, so a cancelled one never fires
+}
+
+// The delayed shutdown started from the UI, the API or ctl
+var countdown = &shutdownCountdown{clock: clock, run: runDelayedAction}
+
+// Pending returns the action waiting for its countdown, or nil
+func (c *shutdownCountdown) Pending() *PendingShutdown {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		return nil
+	}
+	pending := *c.pending
+	return &pending
+}
+
+// Start runs the action after delay. With wall the users logged in on the
+// target are told about it first. Only one action can be pending.
+func (c *shutdownCountdown) Start(action string, delay time.Duration, wall, force bool) (PendingShutdown, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending != nil {
+		return PendingShutdown{}, fmt.Errorf("a %s is already pending at %s, cancel it first", c.pending.Action, c.pending.At)
+	}
+
+	now := c.clock.Now()
+	pending := PendingShutdown{
+		Action:    action,
+		Requested: now.Format(time.RFC3339),
+		At:        now.Add(delay).Format(time.RFC3339),
+		Wall:      wall,
+		Force:     force,
+	}
+	c.pending = &pending
+	c.generation++
+	generation := c.generation
+	go func() {
+		c.clock.Sleep(delay)
+		c.fire(generation)
+	}()
+	log.Printf("Delayed %s: running in %s at %s", action, delay, pending.At)
+
+	if wall {
+		go sendWall(fmt.Sprintf("%s will %s in %s, save your work. (wol-server)", currentTarget().Host, action, delay))
+	}
+	return pending, nil
+}
+
+// Cancel stops the pending action and returns it, or nil if none was pending
+func (c *shutdownCountdown) Cancel() *PendingShutdown {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		return nil
+	}
+	cancelled := *c.pending
+	c.pending = nil
+	log.Printf("Delayed %s at %s cancelled", cancelled.Action, cancelled.At)
+
+	if cancelled.Wall {
+		go sendWall(fmt.Sprintf("The %s of %s was cancelled. (wol-server)", cancelled.Action, currentTarget().Host))
+	}
+	return &cancelled
+}
+
+// fire runs the action when countdown generation ends, unless it was cancelled
+func (c *shutdownCountdown) fire(generation int) {
+	c.mu.Lock()
+	if c.pending == nil || c.generation != generation {
+		c.mu.Unlock()
+		return
+	}
+	pending := *c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	c.run(pending)
+}
+
+// runDelayedAction runs a delayed power action once its countdown ended
+func runDelayedAction(pending PendingShutdown) {
+	if !isServerOnline() {
+		log.Printf("Delayed %s: server is already offline", pending.Action)
+		return
+	}
+	if !pending.Force {
+		if reasons := checkGuards(); len(reasons) > 0 {
+			log.Printf("Delayed %s refused by the safety checks: %s", pending.Action, strings.Join(reasons, "; "))
+			notify("failure", fmt.Sprintf("Delayed %s refused by the safety checks: %s", pending.Action, strings.Join(reasons, "; ")))
+			return
+		}
+	}
+	if err := runPowerAction(pending.Action, currentConfig().Auth.ShutdownPassword); err != nil {
+		log.Printf("Delayed %s failed: %v", pending.Action, err)
+		notify("failure", fmt.Sprintf("Delayed %s failed: %v", pending.Action, err))
+		return
+	}
+	log.Printf("Delayed %s initiated", pending.Action)
+}
+
+// sendWall sends a message to the users logged in on the target
+func sendWall(message string) {
+	if err := power.Message(message); err != nil {
+		log.Printf("Failed to send wall message: %v", err)
+	}
+}
+
+// parseShutdownDelay reads a delay given as a Go duration or a number of
+// minutes; empty means now
+func parseShutdownDelay(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		minutes, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid delay %q, use a duration such as 5m", value)
+		}
+		delay = time.Duration(minutes) * time.Minute
+	}
+	if delay < 0 || delay > maxShutdownDelay {
+		return 0, fmt.Errorf("delay must be between 0 and %s, got %s", maxShutdownDelay, delay)
+	}
+	return delay, nil
+}
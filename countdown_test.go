@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// manualClock is a Clock only moved by Advance; Sleep waits until it reaches
+// the end of the sleep
+type manualClock struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	now      time.Time
+	sleepers int
+}
+
+func newManualClock(now time.Time) *manualClock {
+	c := &manualClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	c.sleepers++
+	c.cond.Broadcast()
+	for c.now.Before(end) {
+		c.cond.Wait()
+	}
+	c.sleepers--
+}
+
+// waitSleepers waits until n goroutines are sleeping
+func (c *manualClock) waitSleepers(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.sleepers != n {
+		c.cond.Wait()
+	}
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.cond.Broadcast()
+}
+
+// newTestCountdown returns a countdown on a manual clock which sends the
+// actions it runs to ran
+func newTestCountdown() (c *shutdownCountdown, clock *manualClock, ran chan PendingShutdown) {
+	clock = newManualClock(at("02:00:00"))
+	ran = make(chan PendingShutdown, 1)
+	c = &shutdownCountdown{
+		clock: clock,
+		run:   func(p PendingShutdown) { ran <- p },
+	}
+	return c, clock, ran
+}
+
+// expectRun waits for the countdown to run an action, or fails
+func expectRun(t *testing.T, ran chan PendingShutdown) PendingShutdown {
+	t.Helper()
+	select {
+	case p := <-ran:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("action did not run when the countdown ended")
+		return PendingShutdown{}
+	}
+}
+
+// expectNoRun fails if the countdown runs an action soon
+func expectNoRun(t *testing.T, ran chan PendingShutdown) {
+	t.Helper()
+	select {
+	case p := <-ran:
+		t.Fatalf("action %+v ran before its countdown ended", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestShutdownCountdownFires(t *testing.T) {
+	c, clock, ran := newTestCountdown()
+	pending, err := c.Start(actionShutdown, 5*time.Minute, false, false)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if pending.At != at("02:05:00").Format(time.RFC3339) {
+		t.Errorf("At = %s, want 02:05", pending.At)
+	}
+	if _, err := c.Start(actionShutdown, time.Minute, false, false); err == nil {
+		t.Error("second Start succeeded while one is pending")
+	}
+	if p := c.Pending(); p == nil || *p != pending {
+		t.Fatalf("Pending = %+v, want %+v", p, pending)
+	}
+
+	clock.waitSleepers(1)
+	clock.Advance(4 * time.Minute)
+	expectNoRun(t, ran)
+	clock.Advance(time.Minute)
+	if p := expectRun(t, ran); p != pending {
+		t.Errorf("ran %+v, want %+v", p, pending)
+	}
+	if p := c.Pending(); p != nil {
+		t.Errorf("Pending = %+v after the action ran", p)
+	}
+}
+
+func TestShutdownCountdownCancel(t *testing.T) {
+	c, clock, ran := newTestCountdown()
+	if _, err := c.Start(actionShutdown, 5*time.Minute, false, false); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if cancelled := c.Cancel(); cancelled == nil || cancelled.Action != actionShutdown {
+		t.Fatalf("Cancel = %+v, want the pending shutdown", cancelled)
+	}
+	if c.Cancel() != nil {
+		t.Error("second Cancel returned an action")
+	}
+
+	// A countdown started after the cancel is not ended by the first one
+	if _, err := c.Start(actionShutdown, 10*time.Minute, false, false); err != nil {
+		t.Fatalf("Start after Cancel: %v", err)
+	}
+	clock.waitSleepers(2)
+	clock.Advance(5 * time.Minute)
+	expectNoRun(t, ran)
+	if c.Pending() == nil {
+		t.Error("cancelled countdown ended the new one")
+	}
+
+	clock.Advance(5 * time.Minute)
+	expectRun(t, ran)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed standard 5-field cron expression:
+// minute hour day-of-month month day-of-week
+type CronSchedule struct {
+	Expr    string
+	minute  uint64 // bits 0-59
+	hour    uint64 // bits 0-23
+	dom     uint64 // bits 1-31
+	month   uint64 // bits 1-12
+	dow     uint64 // bits 0-6, Sunday = 0
+	domStar bool   // day-of-month was "*"
+	dowStar bool   // day-of-week was "*"
+
+	// dayFilter optionally restricts the matching days further
+	dayFilter func(time.Time) bool
+
+	// loc is the time zone the expression is evaluated in; nil uses the
+	// location of the time passed in
+	loc *time.Location
+}
+
+// Aliases accepted in place of a 5-field expression
+var cronAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+}
+
+var cronDayNames = map[string]int{
+	"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+}
+
+// How many days Next and Prev search before giving up (e.g. "0 0 30 2 *" never matches)
+const cronSearchDays = 5 * 366
+
+// ParseCron parses a 5-field cron expression or one of the @-aliases
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	spec := expr
+	if alias, ok := cronAliases[strings.ToLower(spec)]; ok {
+		spec = alias
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &CronSchedule{Expr: expr}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("invalid minute field in %q: %v", expr, err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("invalid hour field in %q: %v", expr, err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("invalid day-of-month field in %q: %v", expr, err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("invalid month field in %q: %v", expr, err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return nil, fmt.Errorf("invalid day-of-week field in %q: %v", expr, err)
+	}
+	// 7 is an alias for Sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow = (s.dow | 1) &^ (1 << 7)
+	}
+	s.domStar = fields[2] == "*" || fields[2] == "?"
+	s.dowStar = fields[4] == "*" || fields[4] == "?"
+
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		var lo, hi int
+		switch {
+		case rangePart == "*" || rangePart == "?":
+			lo, hi = min, max
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = parseCronValue(bounds[0], names); err != nil {
+				return 0, err
+			}
+			if hi, err = parseCronValue(bounds[1], names); err != nil {
+				return 0, err
+			}
+		default:
+			value, err := parseCronValue(rangePart, names)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = value, value
+			// "5/15" means starting at 5 every 15
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToUpper(value)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return n, nil
+}
+
+// matchesDay applies the cron rule that day-of-month and day-of-week are OR-ed
+// when both are restricted
+func (s *CronSchedule) matchesDay(t time.Time) bool {
+	if s.dayFilter != nil && !s.dayFilter(t) {
+		return false
+	}
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// location returns the time zone t is evaluated in
+func (s *CronSchedule) location(t time.Time) *time.Location {
+	if s.loc != nil {
+		return s.loc
+	}
+	return t.Location()
+}
+
+// Matches reports whether t (truncated to the minute) is an occurrence
+func (s *CronSchedule) Matches(t time.Time) bool {
+	t = t.In(s.location(t))
+	return s.month&(1<<uint(t.Month())) != 0 &&
+		s.matchesDay(t) &&
+		s.hour&(1<<uint(t.Hour())) != 0 &&
+		s.minute&(1<<uint(t.Minute())) != 0
+}
+
+// Next returns the first occurrence strictly after t, or the zero time if there is none.
+// Occurrences are wall-clock times in the schedule's time zone, see localTime for
+// times skipped or repeated by daylight saving changes.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.location(t))
+	for i := 0; i <= cronSearchDays; i++ {
+		var next time.Time
+		s.eachOnDay(t.Year(), t.Month(), t.Day()+i, t.Location(), func(c time.Time) {
+			if c.After(t) && (next.IsZero() || c.Before(next)) {
+				next = c
+			}
+		})
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// Prev returns the latest occurrence at or before t, or the zero time if there is none
+func (s *CronSchedule) Prev(t time.Time) time.Time {
+	t = t.In(s.location(t))
+	for i := 0; i <= cronSearchDays; i++ {
+		var prev time.Time
+		s.eachOnDay(t.Year(), t.Month(), t.Day()-i, t.Location(), func(c time.Time) {
+			if !c.After(t) && (prev.IsZero() || c.After(prev)) {
+				prev = c
+			}
+		})
+		if !prev.IsZero() {
+			return prev
+		}
+	}
+	return time.Time{}
+}
+
+// eachOnDay calls fn with every occurrence on the given day. The day is
+// normalized, so day may be out of the month's range.
+func (s *CronSchedule) eachOnDay(year int, month time.Month, day int, loc *time.Location, fn func(time.Time)) {
+	// Noon is never affected by daylight saving changes
+	noon := time.Date(year, month, day, 12, 0, 0, 0, loc)
+	if s.month&(1<<uint(noon.Month())) == 0 || !s.matchesDay(noon) {
+		return
+	}
+
+	for hour := 0; hour < 24; hour++ {
+		if s.hour&(1<<uint(hour)) == 0 {
+			continue
+		}
+		for minute := 0; minute < 60; minute++ {
+			if s.minute&(1<<uint(minute)) != 0 {
+				fn(localTime(noon.Year(), noon.Month(), noon.Day(), hour, minute, loc))
+			}
+		}
+	}
+}
+
+// localTime returns the instant of a wall-clock time in loc, independent of how
+// time.Date resolves ambiguous times. A time skipped when the clocks spring
+// forward resolves to the end of the gap (02:30 becomes 03:00, like cron runs
+// such jobs right after the change); a time repeated when the clocks fall back
+// resolves to its first, earlier instant.
+func localTime(year int, month time.Month, day, hour, minute int, loc *time.Location) time.Time {
+	wall := time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+
+	// Transitions are months apart, so a day either side gives the offsets in
+	// effect before and after any change on this day
+	_, before := wall.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := wall.Add(24 * time.Hour).In(loc).Zone()
+
+	var result time.Time
+	for _, offset := range []int{before, after} {
+		t := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		if t.Day() == day && t.Hour() == hour && t.Minute() == minute {
+			if result.IsZero() || t.Before(result) {
+				result = t
+			}
+		}
+	}
+	if !result.IsZero() {
+		return result
+	}
+
+	// Skipped wall-clock time: find the first instant after the change
+	t := wall.Add(-time.Duration(after) * time.Second)
+	limit := wall.Add(-time.Duration(before) * time.Second)
+	for t.Before(limit) {
+		if _, offset := t.In(loc).Zone(); offset == after {
+			break
+		}
+		t = t.Add(time.Minute)
+	}
+	return t.In(loc)
+}
+
+// NextN returns up to n occurrences after t
+func (s *CronSchedule) NextN(t time.Time, n int) []time.Time {
+	var times []time.Time
+	for len(times) < n {
+		t = s.Next(t)
+		if t.IsZero() {
+			break
+		}
+		times = append(times, t)
+	}
+	return times
+}
+
+// onceSchedule returns a schedule whose only occurrence is t, truncated to the
+// minute. It is evaluated in the location of t, so a fixed offset parsed from
+// RFC3339 is never affected by daylight saving changes.
+func onceSchedule(t time.Time) *CronSchedule {
+	year := t.Year()
+	return &CronSchedule{
+		Expr:      t.Format(time.RFC3339),
+		minute:    1 << uint(t.Minute()),
+		hour:      1 << uint(t.Hour()),
+		dom:       1 << uint(t.Day()),
+		month:     1 << uint(t.Month()),
+		dow:       1<<7 - 1,
+		dowStar:   true,
+		dayFilter: func(d time.Time) bool { return d.Year() == year },
+		loc:       t.Location(),
+	}
+}
+
+// legacyFrequencyToCron converts the old StartTime/Frequency pair to a cron expression.
+// ref anchors the weekday of "weekly" and the day of "monthly" schedules.
+func legacyFrequencyToCron(hhmm, frequency string, ref time.Time) (string, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return "", fmt.Errorf("invalid time %q: use 24-hour format (HH:MM)", hhmm)
+	}
+
+	switch frequency {
+	case "", "daily":
+		return fmt.Sprintf("%d %d * * *", t.Minute(), t.Hour()), nil
+	case "every2days":
+		// Only an approximation: the old rule waited 48 hours after the last
+		// run, "*/2" on the day of the month fires on the 31st and again on
+		// the 1st, and no other cron expression keeps that spacing either
+		return fmt.Sprintf("%d %d */2 * *", t.Minute(), t.Hour()), nil
+	case "weekly":
+		return fmt.Sprintf("%d %d * * %d", t.Minute(), t.Hour(), int(ref.Weekday())), nil
+	case "monthly":
+		// Stay on a day that exists in every month
+		day := ref.Day()
+		if day > 28 {
+			day = 28
+		}
+		return fmt.Sprintf("%d %d %d * *", t.Minute(), t.Hour(), day), nil
+	default:
+		return "", fmt.Errorf("invalid frequency %q", frequency)
+	}
+}
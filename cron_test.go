@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rome loads the time zone used by the daylight saving tests. In 2026 the
+// clocks spring forward on March 29 (02:00 CET becomes 03:00 CEST) and fall
+// back on October 25 (03:00 CEST becomes 02:00 CET).
+func rome(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skipf("time zone database not available: %v", err)
+	}
+	return loc
+}
+
+func utc(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestLocalTime(t *testing.T) {
+	loc := rome(t)
+	tests := []struct {
+		name         string
+		day          time.Time
+		hour, minute int
+		want         string
+	}{
+		{name: "ordinary day", day: utc("2026-03-28T00:00:00Z"), hour: 2, minute: 30, want: "2026-03-28T01:30:00Z"},
+		{name: "spring forward, skipped time", day: utc("2026-03-29T00:00:00Z"), hour: 2, minute: 30, want: "2026-03-29T01:00:00Z"},
+		{name: "spring forward, start of gap", day: utc("2026-03-29T00:00:00Z"), hour: 2, minute: 0, want: "2026-03-29T01:00:00Z"},
+		{name: "spring forward, before gap", day: utc("2026-03-29T00:00:00Z"), hour: 1, minute: 59, want: "2026-03-29T00:59:00Z"},
+		{name: "spring forward, after gap", day: utc("2026-03-29T00:00:00Z"), hour: 3, minute: 0, want: "2026-03-29T01:00:00Z"},
+		{name: "fall back, repeated time", day: utc("2026-10-25T00:00:00Z"), hour: 2, minute: 30, want: "2026-10-25T00:30:00Z"},
+		{name: "fall back, after repeat", day: utc("2026-10-25T00:00:00Z"), hour: 3, minute: 0, want: "2026-10-25T02:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := localTime(tt.day.Year(), tt.day.Month(), tt.day.Day(), tt.hour, tt.minute, loc)
+			if !got.Equal(utc(tt.want)) {
+				t.Errorf("localTime(%02d:%02d) = %s, want %s", tt.hour, tt.minute, got.UTC().Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestCronNextAcrossDST(t *testing.T) {
+	loc := rome(t)
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want []string
+	}{
+		{
+			name: "daily in the skipped hour runs at the end of the gap",
+			expr: "30 2 * * *",
+			from: "2026-03-28T02:00:00Z",
+			want: []string{"2026-03-29T01:00:00Z", "2026-03-30T00:30:00Z"},
+		},
+		{
+			name: "daily in the repeated hour runs once",
+			expr: "30 2 * * *",
+			from: "2026-10-24T02:00:00Z",
+			want: []string{"2026-10-25T00:30:00Z", "2026-10-26T01:30:00Z"},
+		},
+		{
+			name: "hourly on spring forward day skips 02:00",
+			expr: "0 * * * *",
+			from: "2026-03-29T00:30:00Z",
+			want: []string{"2026-03-29T01:00:00Z", "2026-03-29T02:00:00Z"},
+		},
+		{
+			name: "hourly on fall back day runs 02:00 once",
+			expr: "0 * * * *",
+			from: "2026-10-24T23:30:00Z",
+			want: []string{"2026-10-25T00:00:00Z", "2026-10-25T02:00:00Z", "2026-10-25T03:00:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := ParseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			schedule.loc = loc
+			got := schedule.NextN(utc(tt.from), len(tt.want))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d occurrences, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !got[i].Equal(utc(want)) {
+					t.Errorf("occurrence %d = %s, want %s", i, got[i].UTC().Format(time.RFC3339), want)
+				}
+			}
+		})
+	}
+}
+
+func TestCronOccurrencesPerDSTDay(t *testing.T) {
+	loc := rome(t)
+	schedule, err := ParseCron("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule.loc = loc
+
+	// Every wall-clock hour fires once, skipped ones at the end of the gap
+	tests := []struct {
+		day  time.Time
+		want int
+	}{
+		{day: time.Date(2026, 3, 29, 0, 0, 0, 0, loc), want: 23},
+		{day: time.Date(2026, 10, 25, 0, 0, 0, 0, loc), want: 24},
+		{day: time.Date(2026, 6, 1, 0, 0, 0, 0, loc), want: 24},
+	}
+	for _, tt := range tests {
+		end := tt.day.AddDate(0, 0, 1)
+		count := 0
+		for next := schedule.Next(tt.day.Add(-time.Minute)); next.Before(end); next = schedule.Next(next) {
+			count++
+		}
+		if count != tt.want {
+			t.Errorf("%s: %d occurrences, want %d", tt.day.Format("2006-01-02"), count, tt.want)
+		}
+	}
+}
+
+func TestWindowIsOpenAcrossDST(t *testing.T) {
+	rome(t)
+	overnight := ScheduleWindow{Name: "overnight", Enabled: true, WakeCron: "30 23 * * *", ShutdownCron: "0 1 * * *", TimeZone: "Europe/Rome"}
+	gap := ScheduleWindow{Name: "gap", Enabled: true, WakeCron: "30 1 * * *", ShutdownCron: "30 2 * * *", TimeZone: "Europe/Rome"}
+	repeat := ScheduleWindow{Name: "repeat", Enabled: true, WakeCron: "15 2 * * *", ShutdownCron: "45 2 * * *", TimeZone: "Europe/Rome"}
+
+	tests := []struct {
+		name   string
+		window ScheduleWindow
+		now    string
+		want   bool
+	}{
+		{name: "overnight before wake", window: overnight, now: "2026-06-01T21:00:00Z", want: false},        // 23:00 CEST
+		{name: "overnight after wake", window: overnight, now: "2026-06-01T21:45:00Z", want: true},          // 23:45 CEST
+		{name: "overnight after midnight", window: overnight, now: "2026-06-01T22:30:00Z", want: true},      // 00:30 CEST
+		{name: "overnight at shutdown", window: overnight, now: "2026-06-01T23:00:00Z", want: false},        // 01:00 CEST
+		{name: "overnight into spring forward", window: overnight, now: "2026-03-28T23:45:00Z", want: true}, // 00:45 CET
+		{name: "overnight closed on spring forward", window: overnight, now: "2026-03-29T00:00:00Z", want: false},
+		{name: "overnight into fall back", window: overnight, now: "2026-10-24T22:45:00Z", want: true}, // 00:45 CEST
+		{name: "overnight closed on fall back", window: overnight, now: "2026-10-24T23:00:00Z", want: false},
+		{name: "shutdown in the gap, before it", window: gap, now: "2026-03-29T00:45:00Z", want: true}, // 01:45 CET
+		{name: "shutdown in the gap, after it", window: gap, now: "2026-03-29T01:00:00Z", want: false}, // 03:00 CEST
+		{name: "repeated hour, first pass", window: repeat, now: "2026-10-25T00:30:00Z", want: true},   // 02:30 CEST
+		{name: "repeated hour, second pass", window: repeat, now: "2026-10-25T01:30:00Z", want: false}, // 02:30 CET
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.isOpen(utc(tt.now)); got != tt.want {
+				t.Errorf("isOpen(%s) = %v, want %v", tt.now, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes returned by the ctl subcommand so scripts can branch on the outcome
+const (
+	exitOK          = 0 // Operation succeeded (status: target is online)
+	exitFailure     = 1 // Operation failed (status: target is offline)
+	exitUsage       = 2 // Invalid command line
+	exitUnreachable = 3 // The wol-server API could not be reached
+	exitTimeout     = 4 // --wait gave up before the target reached the expected state
+)
+
+const ctlUsage = `Usage: wol-server ctl [options] <command> [arguments]
+
+Commands:
+  status                  Show whether the server is online (exit 1 if offline)
+  wake [--wait]           Send a Wake-on-LAN packet, optionally wait until online
+  shutdown [--wait]       Shut the server down, optionally wait until offline (also -force, -delay 5m, -wall)
+  action [-force] NAME    Run a power action: shutdown, reboot, suspend or hibernate (also -delay, -wall)
+  cancel                  Cancel a delayed shutdown or power action
+  schedule get            Show the schedule windows
+  schedule set [flags]    Add or update a schedule window (-name selects it)
+  schedule delete -name N Remove a schedule window
+  schedule skip -name N   Skip the next run of a window
+  schedule pause -until T Pause all windows (or -name N) until a date
+  schedule once [flags]   Add a one-time window (-name, -start, -end, -auto-shutdown)
+  schedule cancel -id ID  Remove a skip, pause or one-time window
+  schedule simulate       Show what the scheduler would do (-from, -to, -online, -file)
+  history [flags]         Show the schedule run history (-window, -limit)
+  lease list              Show the active keep-awake leases
+  lease acquire -name N   Keep the server awake (-ttl 2h, -reason R, -wake to boot it)
+  lease renew -name N     Extend a held lease (-ttl, default: its TTL)
+  lease release -name N   Release a lease
+  group list              Show the groups, their members in wake order and the last run
+  group wake -name N      Wake a group in dependency order (-wait until all members are online)
+  group shutdown -name N  Shut a group down in reverse order (-wait, -force)
+  maintenance status      Show whether maintenance mode is on
+  maintenance on          Suspend all automatic power actions (-for 2h or -until T, -reason R)
+  maintenance off         Resume the automatic power actions
+
+Options:
+`
+
+// ctlClient is a small HTTP client for the wol-server JSON API
+type ctlClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+// errUnreachable wraps transport errors so they map to exitUnreachable
+type errUnreachable struct{ err error }
+
+func (e errUnreachable) Error() string { return fmt.Sprintf("wol-server not reachable: %v", e.err) }
+
+// apiStatus mirrors the /api/status response
+type apiStatus struct {
+	Success     bool   `json:"success"`
+	Server      string `json:"server"`
+	Online      bool   `json:"online"`
+	Status      string `json:"status"`
+	Driver      string `json:"driver,omitempty"`
+	PowerState  string `json:"powerState,omitempty"`
+	LastUpdated string `json:"lastUpdated"`
+	Error       string `json:"error,omitempty"`
+
+	PendingShutdown *PendingShutdown `json:"pendingShutdown,omitempty"`
+	Leases          []Lease          `json:"leases,omitempty"`
+	Maintenance     *MaintenanceMode `json:"maintenance,omitempty"`
+}
+
+// apiResult mirrors the generic {success, message, error} API responses
+type apiResult struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// do performs a request and decodes the JSON response into out.
+// It returns the HTTP status code so callers can react to 404s.
+func (c *ctlClient) do(method, path string, body interface{}, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(c.baseURL, "/")+path, reader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to build request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, errUnreachable{err}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, errUnreachable{err}
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			// Some handlers answer with http.Error and a plain JSON error string
+			return resp.StatusCode, fmt.Errorf("unexpected response (HTTP %d): %s", resp.StatusCode, strings.TrimSpace(string(data)))
+		}
+	}
+
+	return resp.StatusCode, nil
+}
+
+// status fetches the current server status
+func (c *ctlClient) status() (apiStatus, error) {
+	var st apiStatus
+	code, err := c.do("GET", "/api/status", nil, &st)
+	if err != nil {
+		return st, err
+	}
+	if code != http.StatusOK || !st.Success {
+		return st, fmt.Errorf("status request failed (HTTP %d): %s", code, st.Error)
+	}
+	return st, nil
+}
+
+// waitFor polls the status endpoint until the server reaches the wanted state
+func (c *ctlClient) waitFor(online bool, timeout, interval time.Duration) (apiStatus, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		st, err := c.status()
+		if err == nil && st.Online == online {
+			return st, nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("timed out after %s waiting for server to be %s", timeout, onlineWord(online))
+			}
+			return st, err
+		}
+		time.Sleep(interval)
+	}
+}
+
+func onlineWord(online bool) string {
+	if online {
+		return "online"
+	}
+	return "offline"
+}
+
+// ctlPrinter writes either human readable text or JSON
+type ctlPrinter struct {
+	json bool
+	out  io.Writer
+}
+
+func (p ctlPrinter) print(v interface{}, human func(io.Writer)) {
+	if p.json {
+		enc := json.NewEncoder(p.out)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	human(p.out)
+}
+
+// exitCodeFor maps an error to the matching exit code
+func exitCodeFor(err error) int {
+	var unreachable errUnreachable
+	if errors.As(err, &unreachable) {
+		return exitUnreachable
+	}
+	return exitFailure
+}
+
+// runCtl is the entry point of the `wol-server ctl` subcommand
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	defaultURL := os.Getenv("WOL_SERVER_URL")
+	if defaultURL == "" {
+		defaultURL = "http://localhost:8080"
+	}
+	baseURL := fs.String("url", defaultURL, "Base URL of the wol-server (env WOL_SERVER_URL)")
+	jsonOut := fs.Bool("json", false, "Print machine readable JSON instead of text")
+	requestTimeout := fs.Duration("timeout", 30*time.Second, "Timeout for each HTTP request")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), ctlUsage)
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	client := &ctlClient{baseURL: *baseURL, http: &http.Client{Timeout: *requestTimeout}}
+	printer := ctlPrinter{json: *jsonOut, out: os.Stdout}
+
+	command, rest := fs.Arg(0), fs.Args()[1:]
+	switch command {
+	case "status":
+		return ctlStatus(client, printer)
+	case "wake":
+		return ctlPower(client, printer, rest, true)
+	case "shutdown":
+		return ctlPower(client, printer, rest, false)
+	case "action":
+		return ctlAction(client, printer, rest)
+	case "cancel":
+		return ctlCancel(client, printer)
+	case "schedule":
+		return ctlSchedule(client, printer, rest)
+	case "history":
+		return ctlHistory(client, printer, rest)
+	case "lease":
+		return ctlLease(client, printer, rest)
+	case "group":
+		return ctlGroup(client, printer, rest)
+	case "maintenance":
+		return ctlMaintenance(client, printer, rest)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		fs.Usage()
+		return exitUsage
+	}
+}
+
+// ctlStatus prints the server status
+func ctlStatus(client *ctlClient, printer ctlPrinter) int {
+	st, err := client.status()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+
+	printer.print(st, func(w io.Writer) {
+		fmt.Fprintf(w, "Server: %s\nStatus: %s\n", st.Server, st.Status)
+		if st.PowerState != "" {
+			fmt.Fprintf(w, "Power: %s (%s)\n", st.PowerState, st.Driver)
+		}
+		if p := st.PendingShutdown; p != nil {
+			fmt.Fprintf(w, "Pending: %s at %s\n", p.Action, p.At)
+		}
+		for _, lease := range st.Leases {
+			fmt.Fprintf(w, "Kept awake: %s\n", lease.Description())
+		}
+		if m := st.Maintenance; m != nil {
+			fmt.Fprintf(w, "Maintenance: %s\n", m.Description())
+		}
+	})
+
+	if !st.Online {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// ctlPower handles both wake and shutdown, which only differ in endpoint and target state
+func ctlPower(client *ctlClient, printer ctlPrinter, args []string, wake bool) int {
+	name, path := "shutdown", "/api/shutdown"
+	if wake {
+		name, path = "wake", "/api/wake"
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	wait := fs.Bool("wait", false, "Wait until the server reaches the expected state")
+	waitTimeout := fs.Duration("wait-timeout", 5*time.Minute, "Maximum time to wait with --wait")
+	pollInterval := fs.Duration("poll-interval", 5*time.Second, "Status polling interval with --wait")
+	var force, wall *bool
+	var delay *time.Duration
+	if !wake {
+		force = fs.Bool("force", false, "Shut down even if the safety checks on the server fail")
+		delay = fs.Duration("delay", 0, "Shut down after this long, e.g. 5m, instead of now")
+		wall = fs.Bool("wall", false, "Warn the users logged in on the server about a delayed shutdown")
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	body := map[string]interface{}{}
+	if !wake {
+		body["force"] = *force
+		body["wall"] = *wall
+		if *delay > 0 {
+			body["delay"] = delay.String()
+			// The countdown comes before the wait for the server to go offline
+			*waitTimeout += *delay
+		}
+	}
+	var result apiResult
+	code, err := client.do("POST", path, body, &result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	if code != http.StatusOK || !result.Success {
+		printer.print(result, func(w io.Writer) {
+			fmt.Fprintf(w, "%s failed: %s\n", name, result.Error)
+		})
+		return exitFailure
+	}
+
+	if !*wait {
+		printer.print(result, func(w io.Writer) {
+			fmt.Fprintln(w, result.Message)
+		})
+		return exitOK
+	}
+
+	started := time.Now()
+	st, err := client.waitFor(wake, *waitTimeout, *pollInterval)
+	output := map[string]interface{}{
+		"success": err == nil,
+		"message": result.Message,
+		"online":  st.Online,
+		"status":  st.Status,
+		"waited":  time.Since(started).Round(time.Second).String(),
+	}
+	if err != nil {
+		output["error"] = err.Error()
+	}
+	printer.print(output, func(w io.Writer) {
+		fmt.Fprintln(w, result.Message)
+		if err != nil {
+			fmt.Fprintln(w, err)
+		} else {
+			fmt.Fprintf(w, "Server is %s after %s\n", onlineWord(wake), output["waited"])
+		}
+	})
+
+	if err != nil {
+		var unreachable errUnreachable
+		if errors.As(err, &unreachable) {
+			return exitUnreachable
+		}
+		return exitTimeout
+	}
+	return exitOK
+}
+
+// ctlAction runs a power action configured for the server
+func ctlAction(client *ctlClient, printer ctlPrinter, args []string) int {
+	fs := flag.NewFlagSet("action", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Run the action even if the safety checks on the server fail")
+	delay := fs.Duration("delay", 0, "Run the action after this long, e.g. 5m, instead of now")
+	wall := fs.Bool("wall", false, "Warn the users logged in on the server about a delayed action")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	args = fs.Args()
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: wol-server ctl action [-force] [-delay D] [-wall] %s\n", strings.Join(powerActions, "|"))
+		return exitUsage
+	}
+
+	body := map[string]interface{}{"action": args[0], "force": *force, "wall": *wall}
+	if *delay > 0 {
+		body["delay"] = delay.String()
+	}
+	var result apiResult
+	code, err := client.do("POST", "/api/actions", body, &result)
+	if code == http.StatusNotFound {
+		fmt.Fprintln(os.Stderr, "Power actions are not available on this wol-server")
+		return exitFailure
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	printer.print(result, func(w io.Writer) {
+		if code != http.StatusOK || !result.Success {
+			fmt.Fprintf(w, "%s failed: %s\n", args[0], result.Error)
+			return
+		}
+		fmt.Fprintln(w, result.Message)
+	})
+	if code != http.StatusOK || !result.Success {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// ctlCancel cancels a delayed shutdown or power action
+func ctlCancel(client *ctlClient, printer ctlPrinter) int {
+	var result apiResult
+	code, err := client.do("DELETE", "/api/shutdown/pending", nil, &result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	printer.print(result, func(w io.Writer) {
+		if !result.Success {
+			fmt.Fprintln(w, result.Error)
+			return
+		}
+		fmt.Fprintln(w, result.Message)
+	})
+	if code != http.StatusOK || !result.Success {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// ctlSchedule implements `schedule get`, `schedule set`, `schedule delete` and the overrides
+func ctlSchedule(client *ctlClient, printer ctlPrinter, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: wol-server ctl schedule get|set|delete|skip|pause|once|cancel|simulate [flags]")
+		return exitUsage
+	}
+
+	var current ScheduleConfig
+	code, err := client.do("GET", "/api/schedule", nil, &current)
+	if err == nil && code != http.StatusOK {
+		err = fmt.Errorf("failed to fetch schedule (HTTP %d)", code)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	// Servers from before schedule windows answer with a single window
+	migrateLegacySchedule(&current)
+
+	// Without -name, commands apply to the only window or to the default one
+	defaultName := legacyWindowName
+	if len(current.Windows) == 1 {
+		defaultName = current.Windows[0].Name
+	}
+
+	fs := flag.NewFlagSet("schedule "+args[0], flag.ContinueOnError)
+	name := fs.String("name", defaultName, "Name of the schedule window")
+
+	newConfig := current
+	newConfig.Windows = append([]ScheduleWindow{}, current.Windows...)
+
+	switch args[0] {
+	case "get":
+		printSchedule(printer, current)
+		return exitOK
+	case "delete":
+		if err := fs.Parse(args[1:]); err != nil {
+			return exitUsage
+		}
+		if current.Window(*name) == nil {
+			fmt.Fprintf(os.Stderr, "No schedule window named %q\n", *name)
+			return exitFailure
+		}
+		newConfig.Windows = newConfig.Windows[:0]
+		for _, window := range current.Windows {
+			if window.Name != *name {
+				newConfig.Windows = append(newConfig.Windows, window)
+			}
+		}
+		return ctlPostSchedule(client, printer, newConfig)
+	case "skip", "pause", "once", "cancel":
+		return ctlOverride(client, printer, fs, name, args)
+	case "simulate":
+		return ctlSimulate(client, printer, fs, args)
+	case "set":
+		// handled below
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown schedule command %q\n", args[0])
+		return exitUsage
+	}
+
+	file := fs.String("file", "", "Read the full schedule with all windows as JSON from a file (- for stdin)")
+	enabled := fs.Bool("enabled", true, "Enable or disable the window")
+	wakeCron := fs.String("wake", "", "Wake cron expression, e.g. '0 2 * * *' or @daily")
+	shutdownCron := fs.String("shutdown", "", "Shutdown cron expression")
+	start := fs.String("start", "", "Legacy start time (HH:MM), converted to a wake expression")
+	end := fs.String("end", "", "Legacy end time (HH:MM), converted to a shutdown expression")
+	frequency := fs.String("frequency", "daily", "Legacy frequency used with -start: daily, weekly or monthly")
+	autoShutdown := fs.Bool("auto-shutdown", false, "Shut down automatically at the shutdown time")
+	shutdownMode := fs.String("shutdown-mode", "", "When to shut down automatically: time (at the shutdown time) or idle (once the server is idle)")
+	weekdays := fs.String("weekdays", "", "Comma separated weekdays the window wakes on, e.g. mon,wed,fri (empty for any)")
+	monthDays := fs.String("month-days", "", "Comma separated days of the month, e.g. 1,15,last (empty for any)")
+	timeZone := fs.String("tz", "", "IANA time zone of the window, e.g. Europe/Rome (empty for the server's)")
+	group := fs.String("group", "", "Group woken and shut down by the window instead of the server (empty for the server)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	if *file != "" {
+		var data []byte
+		if *file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(*file)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read schedule file: %v\n", err)
+			return exitUsage
+		}
+		newConfig = ScheduleConfig{}
+		if err := json.Unmarshal(data, &newConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse schedule file: %v\n", err)
+			return exitUsage
+		}
+		return ctlPostSchedule(client, printer, newConfig)
+	}
+
+	// Only the flags given on the command line change the window
+	visited := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { visited[f.Name] = true })
+
+	window := newConfig.Window(*name)
+	if window == nil {
+		newConfig.Windows = append(newConfig.Windows, ScheduleWindow{Name: *name, Enabled: true})
+		window = &newConfig.Windows[len(newConfig.Windows)-1]
+	}
+	if visited["enabled"] {
+		window.Enabled = *enabled
+	}
+	if visited["wake"] {
+		window.WakeCron = *wakeCron
+	}
+	if visited["shutdown"] {
+		window.ShutdownCron = *shutdownCron
+	}
+	if visited["auto-shutdown"] {
+		window.AutoShutdown = *autoShutdown
+	}
+	if visited["shutdown-mode"] {
+		window.ShutdownMode = *shutdownMode
+	}
+	if visited["weekdays"] {
+		window.Weekdays = splitList(*weekdays)
+	}
+	if visited["month-days"] {
+		window.MonthDays = splitList(*monthDays)
+	}
+	if visited["tz"] {
+		window.TimeZone = *timeZone
+	}
+	if visited["group"] {
+		window.Group = *group
+	}
+	if *start != "" {
+		if err := migrateLegacyTimes(window, *start, *end, *frequency); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+
+	return ctlPostSchedule(client, printer, newConfig)
+}
+
+// ctlOverride adds or cancels a schedule override
+func ctlOverride(client *ctlClient, printer ctlPrinter, fs *flag.FlagSet, name *string, args []string) int {
+	start := fs.String("start", "", "One-time window wake time: YYYY-MM-DD, YYYY-MM-DDTHH:MM or RFC3339")
+	end := fs.String("end", "", "One-time window shutdown time")
+	until := fs.String("until", "", "End of the pause: YYYY-MM-DD, YYYY-MM-DDTHH:MM or RFC3339")
+	autoShutdown := fs.Bool("auto-shutdown", false, "Shut the one-time window down automatically at its end")
+	id := fs.String("id", "", "Override to cancel, as listed by 'schedule get'")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	nameSet := false
+	fs.Visit(func(f *flag.Flag) { nameSet = nameSet || f.Name == "name" })
+
+	var (
+		method = "POST"
+		path   = "/api/schedule/overrides"
+		body   map[string]interface{}
+	)
+	switch args[0] {
+	case "skip":
+		body = map[string]interface{}{"type": overrideSkip, "window": *name}
+	case "pause":
+		// Without -name every window is paused
+		window := ""
+		if nameSet {
+			window = *name
+		}
+		body = map[string]interface{}{"type": overridePause, "window": window, "end": *until}
+	case "once":
+		if !nameSet {
+			fmt.Fprintln(os.Stderr, "schedule once requires -name")
+			return exitUsage
+		}
+		body = map[string]interface{}{"type": overrideOnce, "name": *name, "start": *start, "end": *end, "autoShutdown": *autoShutdown}
+	case "cancel":
+		if *id == "" {
+			fmt.Fprintln(os.Stderr, "schedule cancel requires -id")
+			return exitUsage
+		}
+		method, path = "DELETE", path+"?id="+url.QueryEscape(*id)
+	}
+
+	var result struct {
+		apiResult
+		Override *overrideView `json:"override,omitempty"`
+	}
+	var payload interface{}
+	if body != nil {
+		payload = body
+	}
+	code, err := client.do(method, path, payload, &result)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	printer.print(result, func(w io.Writer) {
+		switch {
+		case code != http.StatusOK:
+			fmt.Fprintf(w, "Failed to update overrides: %s\n", result.Error)
+		case result.Override != nil:
+			fmt.Fprintf(w, "Added override %s: %s\n", result.Override.ID, result.Override.Description)
+		default:
+			fmt.Fprintf(w, "Cancelled override %s\n", *id)
+		}
+	})
+	if code != http.StatusOK {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// ctlSimulate prints the actions the scheduler would take over a time range,
+// for the current schedule or the one in a file
+func ctlSimulate(client *ctlClient, printer ctlPrinter, fs *flag.FlagSet, args []string) int {
+	from := fs.String("from", "", "Start of the simulation: YYYY-MM-DD, YYYY-MM-DDTHH:MM or RFC3339 (default: now)")
+	to := fs.String("to", "", fmt.Sprintf("End of the simulation (default: %d days after the start)", simulationDefaultDays))
+	online := fs.Bool("online", false, "The server is running at the start of the simulation")
+	file := fs.String("file", "", "Simulate the full schedule in this JSON file (- for stdin) instead of the current one")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	body := map[string]interface{}{"from": *from, "to": *to, "online": *online}
+	if *file != "" {
+		var data []byte
+		var err error
+		if *file == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(*file)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read schedule file: %v\n", err)
+			return exitUsage
+		}
+		var cfg ScheduleConfig
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse schedule file: %v\n", err)
+			return exitUsage
+		}
+		body["schedule"] = cfg
+	}
+
+	var result struct {
+		apiResult
+		From    string            `json:"from"`
+		To      string            `json:"to"`
+		Actions []SimulatedAction `json:"actions"`
+	}
+	code, err := client.do("POST", "/api/schedule/simulate", body, &result)
+	if code == http.StatusNotFound {
+		fmt.Fprintln(os.Stderr, "Simulation is not available on this wol-server")
+		return exitFailure
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	printer.print(result, func(w io.Writer) {
+		if code != http.StatusOK {
+			fmt.Fprintf(w, "Simulation failed: %s\n", result.Error)
+			return
+		}
+		fmt.Fprintf(w, "Simulation from %s to %s\n", result.From, result.To)
+		if len(result.Actions) == 0 {
+			fmt.Fprintln(w, "No scheduled actions")
+			return
+		}
+		for _, action := range result.Actions {
+			fmt.Fprintf(w, "  %s\n", action.Description())
+		}
+	})
+	if code != http.StatusOK {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// ctlPostSchedule saves the schedule and prints the result
+func ctlPostSchedule(client *ctlClient, printer ctlPrinter, newConfig ScheduleConfig) int {
+	// The API answers validation errors with a plain {"error": ...} body
+	var raw json.RawMessage
+	code, err := client.do("POST", "/api/schedule", newConfig, &raw)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	if code != http.StatusOK {
+		var result apiResult
+		json.Unmarshal(raw, &result)
+		printer.print(result, func(w io.Writer) {
+			fmt.Fprintf(w, "Failed to update schedule: %s\n", result.Error)
+		})
+		return exitFailure
+	}
+
+	var updated ScheduleConfig
+	if err := json.Unmarshal(raw, &updated); err != nil {
+		fmt.Fprintf(os.Stderr, "Unexpected schedule response: %v\n", err)
+		return exitFailure
+	}
+	printSchedule(printer, updated)
+	return exitOK
+}
+
+func printSchedule(printer ctlPrinter, cfg ScheduleConfig) {
+	printer.print(cfg, func(w io.Writer) {
+		if len(cfg.Windows) == 0 {
+			fmt.Fprintln(w, "Schedule: no windows")
+			return
+		}
+		for i, window := range cfg.Windows {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			state := "disabled"
+			if window.Enabled {
+				state = "enabled"
+			}
+			fmt.Fprintf(w, "Window: %s (%s)\n", window.Name, state)
+			fmt.Fprintf(w, "Wake: %s\n", window.WakeCron)
+			if window.TimeZone != "" {
+				fmt.Fprintf(w, "Time zone: %s\n", window.TimeZone)
+			}
+			if len(window.Weekdays) > 0 {
+				fmt.Fprintf(w, "Weekdays: %s\n", strings.Join(window.Weekdays, ","))
+			}
+			if len(window.MonthDays) > 0 {
+				fmt.Fprintf(w, "Days of month: %s\n", strings.Join(window.MonthDays, ","))
+			}
+			fmt.Fprintf(w, "Shutdown: %s\n", window.ShutdownCron)
+			fmt.Fprintf(w, "Auto shutdown: %v\n", window.AutoShutdown)
+			if window.ShutdownMode != "" {
+				fmt.Fprintf(w, "Shutdown mode: %s\n", window.ShutdownMode)
+			}
+			if window.Group != "" {
+				fmt.Fprintf(w, "Group: %s\n", window.Group)
+			}
+			if window.LastRun != "" {
+				fmt.Fprintf(w, "Last run: %s\n", window.LastRun)
+			}
+		}
+		if len(cfg.Overrides) > 0 {
+			fmt.Fprintln(w, "\nOverrides:")
+			for _, o := range cfg.Overrides {
+				fmt.Fprintf(w, "  %s  %s\n", o.ID, o.Description())
+			}
+		}
+		if cfg.StartedBySchedule {
+			fmt.Fprintf(w, "\nServer started by window: %s\n", cfg.ActiveWindow)
+		}
+		if m := cfg.Maintenance; m != nil {
+			fmt.Fprintf(w, "\nMaintenance: %s\n", m.Description())
+		}
+	})
+}
+
+// ctlHistory prints the schedule run history if the server provides it
+func ctlHistory(client *ctlClient, printer ctlPrinter, args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	window := fs.String("window", "", "Only show the runs of this schedule window")
+	limit := fs.Int("limit", 0, "Number of runs to show (default: the server's page size)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	query := url.Values{}
+	if *window != "" {
+		query.Set("window", *window)
+	}
+	if *limit > 0 {
+		query.Set("limit", strconv.Itoa(*limit))
+	}
+	path := "/api/history"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var resp struct {
+		Runs []RunRecord `json:"runs"`
+	}
+	code, err := client.do("GET", path, nil, &resp)
+	if code == http.StatusNotFound {
+		fmt.Fprintln(os.Stderr, "History is not available on this wol-server")
+		return exitFailure
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	if code != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Failed to fetch history (HTTP %d)\n", code)
+		return exitFailure
+	}
+
+	printer.print(resp.Runs, func(w io.Writer) {
+		if len(resp.Runs) == 0 {
+			fmt.Fprintln(w, "No scheduled runs recorded")
+			return
+		}
+		for i, run := range resp.Runs {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s planned %s\n", run.Window, run.Planned)
+			fmt.Fprintf(w, "  Wake sent: %s\n", orDash(run.WakeSent))
+			fmt.Fprintf(w, "  Online: %s\n", orDash(run.Online))
+			if run.BootSeconds > 0 {
+				fmt.Fprintf(w, "  Boot time: %s\n", run.BootTime())
+			}
+			fmt.Fprintf(w, "  Shutdown requested: %s\n", orDash(run.ShutdownRequested))
+			fmt.Fprintf(w, "  Offline: %s\n", orDash(run.Offline))
+			if run.Skipped != "" {
+				fmt.Fprintf(w, "  Skipped: %s\n", run.Skipped)
+			}
+			if run.Postponed != "" {
+				fmt.Fprintf(w, "  Shutdown postponed: %s\n", run.Postponed)
+			}
+			for _, e := range run.Errors {
+				fmt.Fprintf(w, "  Error: %s\n", e)
+			}
+		}
+	})
+	return exitOK
+}
+
+// ctlLease lists, acquires, renews and releases keep-awake leases
+func ctlLease(client *ctlClient, printer ctlPrinter, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: wol-server ctl lease list|acquire|renew|release [flags]")
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("lease "+args[0], flag.ContinueOnError)
+	name := fs.String("name", "", "Name of the lease, e.g. the job holding it")
+	ttl := fs.Duration("ttl", 0, "How long the lease is held, e.g. 2h")
+	reason := fs.String("reason", "", "Why the server is kept awake")
+	wake := fs.Bool("wake", false, "Wake the server if it is offline")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	var (
+		method = "POST"
+		path   = "/api/leases"
+		body   interface{}
+	)
+	switch args[0] {
+	case "list":
+		method = "GET"
+	case "acquire", "renew":
+		if *name == "" {
+			fmt.Fprintf(os.Stderr, "lease %s requires -name\n", args[0])
+			return exitUsage
+		}
+		if args[0] == "acquire" && *ttl == 0 {
+			fmt.Fprintln(os.Stderr, "lease acquire requires -ttl")
+			return exitUsage
+		}
+		req := map[string]interface{}{"name": *name, "reason": *reason, "wake": *wake, "renew": args[0] == "renew"}
+		if *ttl > 0 {
+			req["ttl"] = ttl.String()
+		}
+		body = req
+	case "release":
+		if *name == "" {
+			fmt.Fprintln(os.Stderr, "lease release requires -name")
+			return exitUsage
+		}
+		method, path = "DELETE", path+"?name="+url.QueryEscape(*name)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown lease command %q\n", args[0])
+		return exitUsage
+	}
+
+	var result struct {
+		apiResult
+		Leases []Lease     `json:"leases,omitempty"`
+		Wake   *WakeResult `json:"wake,omitempty"`
+	}
+	code, err := client.do(method, path, body, &result)
+	if code == http.StatusNotFound && result.Error == "" {
+		fmt.Fprintln(os.Stderr, "Leases are not available on this wol-server")
+		return exitFailure
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	printer.print(result, func(w io.Writer) {
+		switch {
+		case code != http.StatusOK || !result.Success:
+			fmt.Fprintf(w, "lease %s failed: %s\n", args[0], result.Error)
+		case args[0] == "list" && len(result.Leases) == 0:
+			fmt.Fprintln(w, "No active leases")
+		case args[0] == "list":
+			for _, lease := range result.Leases {
+				fmt.Fprintln(w, lease.Description())
+			}
+		default:
+			fmt.Fprintln(w, result.Message)
+			if result.Wake != nil {
+				fmt.Fprintf(w, "Wake: %s\n", result.Wake.Summary())
+			}
+		}
+	})
+	if code != http.StatusOK || !result.Success {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// ctlGroup lists groups and wakes or shuts them down
+func ctlGroup(client *ctlClient, printer ctlPrinter, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: wol-server ctl group list|wake|shutdown [flags]")
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("group "+args[0], flag.ContinueOnError)
+	name := fs.String("name", "", "Name of the group")
+	wait := fs.Bool("wait", false, "Wait until every member reached the state")
+	waitTimeout := fs.Duration("wait-timeout", 15*time.Minute, "Maximum time to wait with --wait")
+	pollInterval := fs.Duration("poll-interval", 5*time.Second, "Status polling interval with --wait")
+	force := fs.Bool("force", false, "Shut down even if the safety checks of a member fail")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	var body interface{}
+	method := "POST"
+	switch args[0] {
+	case "list":
+		method = "GET"
+	case "wake", "shutdown":
+		if *name == "" {
+			fmt.Fprintf(os.Stderr, "group %s requires -name\n", args[0])
+			return exitUsage
+		}
+		body = map[string]interface{}{"group": *name, "action": args[0], "force": *force}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown group command %q\n", args[0])
+		return exitUsage
+	}
+
+	var result struct {
+		apiResult
+		Groups []GroupStatus `json:"groups,omitempty"`
+		Run    *GroupResult  `json:"run,omitempty"`
+	}
+	code, err := client.do(method, "/api/groups", body, &result)
+	if code == http.StatusNotFound && result.Error == "" {
+		fmt.Fprintln(os.Stderr, "Groups are not available on this wol-server")
+		return exitFailure
+	}
+	if err == nil && *wait && code == http.StatusOK && result.Run != nil {
+		// The run goes on in the background, poll until it is over
+		result.Run, err = client.waitForGroup(*result.Run, *waitTimeout, *pollInterval)
+		var unreachable errUnreachable
+		if err != nil && !errors.As(err, &unreachable) {
+			fmt.Fprintln(os.Stderr, err)
+			return exitTimeout
+		}
+		if result.Run != nil && !result.Run.Success {
+			result.Success, result.Error = false, result.Run.Summary()
+		} else if result.Run != nil {
+			result.Message = result.Run.Summary()
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	printer.print(result, func(w io.Writer) {
+		switch {
+		case code != http.StatusOK || !result.Success:
+			fmt.Fprintf(w, "group %s failed: %s\n", args[0], result.Error)
+		case args[0] == "list" && len(result.Groups) == 0:
+			fmt.Fprintln(w, "No groups configured")
+		case args[0] == "list":
+			for i, group := range result.Groups {
+				if i > 0 {
+					fmt.Fprintln(w)
+				}
+				fmt.Fprintf(w, "Group: %s\n", group.Name)
+				for _, member := range group.Members {
+					fmt.Fprintf(w, "  %s: %s", member.Target, onlineWord(member.Online))
+					if len(member.DependsOn) > 0 {
+						fmt.Fprintf(w, " (after %s)", strings.Join(member.DependsOn, ", "))
+					}
+					fmt.Fprintln(w)
+				}
+				if group.LastRun != nil {
+					fmt.Fprintf(w, "Last run (%s, %s): %s\n", group.LastRun.Source, group.LastRun.Started, group.LastRun.Summary())
+				}
+			}
+		default:
+			fmt.Fprintln(w, result.Message)
+		}
+	})
+	if code != http.StatusOK || !result.Success {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// ctlMaintenance shows and toggles maintenance mode
+func ctlMaintenance(client *ctlClient, printer ctlPrinter, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: wol-server ctl maintenance status|on|off [flags]")
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("maintenance "+args[0], flag.ContinueOnError)
+	duration := fs.Duration("for", 0, "How long maintenance mode lasts, e.g. 2h (default: until turned off)")
+	until := fs.String("until", "", "When maintenance mode ends, e.g. 2026-10-20T18:00")
+	reason := fs.String("reason", "", "Why the automatic power actions are suspended")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+
+	var body interface{}
+	method := "GET"
+	switch args[0] {
+	case "status":
+	case "on":
+		if *duration > 0 && *until != "" {
+			fmt.Fprintln(os.Stderr, "maintenance on takes either -for or -until")
+			return exitUsage
+		}
+		req := map[string]interface{}{"until": *until, "reason": *reason}
+		if *duration > 0 {
+			req["for"] = duration.String()
+		}
+		method, body = "POST", req
+	case "off":
+		method = "DELETE"
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown maintenance command %q\n", args[0])
+		return exitUsage
+	}
+
+	var result struct {
+		apiResult
+		Enabled     bool             `json:"enabled"`
+		Maintenance *MaintenanceMode `json:"maintenance,omitempty"`
+	}
+	code, err := client.do(method, "/api/maintenance", body, &result)
+	if code == http.StatusNotFound && result.Error == "" {
+		fmt.Fprintln(os.Stderr, "Maintenance mode is not available on this wol-server")
+		return exitFailure
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCodeFor(err)
+	}
+	printer.print(result, func(w io.Writer) {
+		switch {
+		case code != http.StatusOK || !result.Success:
+			fmt.Fprintf(w, "maintenance %s failed: %s\n", args[0], result.Error)
+		case args[0] == "status" && result.Maintenance != nil:
+			fmt.Fprintf(w, "Maintenance: %s\n", result.Maintenance.Description())
+		case args[0] == "status":
+			fmt.Fprintln(w, "Maintenance mode is off")
+		default:
+			fmt.Fprintln(w, result.Message)
+		}
+	})
+	if code != http.StatusOK || !result.Success {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// waitForGroup polls the groups until the run started is over and returns its result
+func (c *ctlClient) waitForGroup(run GroupResult, timeout, interval time.Duration) (*GroupResult, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var list struct {
+			Groups []GroupStatus `json:"groups"`
+		}
+		if _, err := c.do("GET", "/api/groups", nil, &list); err != nil {
+			return nil, err
+		}
+		for _, group := range list.Groups {
+			if last := group.LastRun; group.Name == run.Group && last != nil && last.Started >= run.Started && last.Outcome != groupOutcomeRunning {
+				return last, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out after %s waiting for the %s of group %s", timeout, run.Action, run.Group)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// orDash prints "-" for steps that did not happen
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GroupConfig is a named set of targets woken and shut down together. Members
+// are woken after the members they depend on and shut down before them.
+type GroupConfig struct {
+	Name    string        `yaml:"name" json:"name"`
+	Members []GroupMember `yaml:"members" json:"members"`
+}
+
+// GroupMember is a target of a group and the members it needs to be running
+type GroupMember struct {
+	Target    string   `yaml:"target" json:"target"`                 // Name of the target
+	DependsOn []string `yaml:"dependsOn" json:"dependsOn,omitempty"` // Members woken before and shut down after this one
+}
+
+// Group actions
+const (
+	groupActionWake     = "wake"
+	groupActionShutdown = "shutdown"
+)
+
+// Outcomes of a group member in a group run
+const (
+	groupStepOnline         = "online"          // Woken and seen online
+	groupStepAlreadyOnline  = "already-online"  // Online before anything was sent
+	groupStepOffline        = "offline"         // Shut down and seen offline
+	groupStepAlreadyOffline = "already-offline" // Offline before anything was sent
+	groupStepFailed         = "failed"          // The wake or shutdown could not be sent
+	groupStepTimedOut       = "timeout"         // Did not reach the state in time
+	groupStepBlocked        = "blocked"         // Safety checks refused the shutdown
+	groupStepSkipped        = "skipped"         // Not attempted because a member it needs failed
+)
+
+// Outcomes of a group run
+const (
+	groupOutcomeRunning = "running"
+	groupOutcomeDone    = "done"   // Every member reached the state
+	groupOutcomeFailed  = "failed" // A member failed, was blocked or timed out
+)
+
+// GroupStep is what a group run did to one member
+type GroupStep struct {
+	Target  string  `json:"target"`
+	Outcome string  `json:"outcome"`
+	Seconds float64 `json:"seconds,omitempty"` // Time until the member was online or offline
+	Error   string  `json:"error,omitempty"`
+}
+
+// GroupResult describes a run waking or shutting down a group in dependency
+// order. Times are RFC3339.
+type GroupResult struct {
+	Group    string      `json:"group"`
+	Action   string      `json:"action"` // wake or shutdown
+	Source   string      `json:"source"` // ui, api, schedule or cli
+	Outcome  string      `json:"outcome"`
+	Success  bool        `json:"success"`
+	Started  string      `json:"started"`
+	Finished string      `json:"finished,omitempty"`
+	Steps    []GroupStep `json:"steps"`
+}
+
+// Summary returns the result as a line of text, used by the UI and ctl
+func (r GroupResult) Summary() string {
+	var steps []string
+	for _, step := range r.Steps {
+		line := step.Target + " " + step.Outcome
+		if step.Error != "" {
+			line += " (" + step.Error + ")"
+		}
+		steps = append(steps, line)
+	}
+	return fmt.Sprintf("%s of group %s %s: %s", r.Action, r.Group, r.Outcome, strings.Join(steps, ", "))
+}
+
+// Blocked reports whether the safety checks of a member stopped the run
+func (r GroupResult) Blocked() bool {
+	for _, step := range r.Steps {
+		if step.Outcome == groupStepBlocked {
+			return true
+		}
+	}
+	return false
+}
+
+// Group returns the group of that name
+func (c *Config) Group(name string) (GroupConfig, bool) {
+	for _, group := range c.Groups {
+		if group.Name == name {
+			return group, true
+		}
+	}
+	return GroupConfig{}, false
+}
+
+// Order returns the targets of the group in wake order: every member comes
+// after the members it depends on, otherwise in the order they are listed
+func (g GroupConfig) Order() ([]string, error) {
+	done := make(map[string]bool)
+	var order []string
+	for len(order) < len(g.Members) {
+		progress := false
+		for _, member := range g.Members {
+			if done[member.Target] {
+				continue
+			}
+			ready := true
+			for _, dependency := range member.DependsOn {
+				ready = ready && done[dependency]
+			}
+			if ready {
+				done[member.Target] = true
+				order = append(order, member.Target)
+				progress = true
+				break
+			}
+		}
+		if !progress {
+			var left []string
+			for _, member := range g.Members {
+				if !done[member.Target] {
+					left = append(left, member.Target)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between %s", strings.Join(left, ", "))
+		}
+	}
+	return order, nil
+}
+
+// validateGroup checks that a group lists known targets, each once, whose
+// dependencies are members of the same group and do not form a cycle
+func validateGroup(group GroupConfig, targets []TargetConfig) []string {
+	var problems []string
+	if group.Name == "" {
+		problems = append(problems, "name: is required")
+	}
+	if len(group.Members) == 0 {
+		problems = append(problems, "members: at least one member is required")
+	}
+
+	members := make(map[string]bool)
+	for i, member := range group.Members {
+		known := false
+		for _, target := range targets {
+			known = known || target.Name == member.Target
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("members[%d].target: unknown target %q", i, member.Target))
+		} else if members[member.Target] {
+			problems = append(problems, fmt.Sprintf("members[%d].target: %q is listed more than once", i, member.Target))
+		}
+		members[member.Target] = true
+	}
+	for i, member := range group.Members {
+		for _, dependency := range member.DependsOn {
+			if !members[dependency] {
+				problems = append(problems, fmt.Sprintf("members[%d].dependsOn: %q is not a member of the group", i, dependency))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		if _, err := group.Order(); err != nil {
+			problems = append(problems, fmt.Sprintf("members: %v", err))
+		}
+	}
+	return problems
+}
+
+// groupRunner wakes and shuts down the members of a group one at a time,
+// waiting for each to reach the state before moving on to the next
+type groupRunner struct {
+	clock    Clock
+	powerFor func(target string) PowerDriver
+	wakes    *wakeTracker // Runs the wake of the primary target, so the status shows it
+	cfg      *Config
+	logf     func(format string, v ...interface{})
+	report   func(GroupResult) // Called after every member with the result so far, may be nil
+}
+
+// newGroupRunner creates a runner with the live drivers and configuration
+func newGroupRunner() groupRunner {
+	return groupRunner{
+		clock:    clock,
+		powerFor: powerFor,
+		wakes:    wakes,
+		cfg:      currentConfig(),
+		logf:     log.Printf,
+	}
+}
+
+// start returns the result of a run that has not done anything yet
+func (r groupRunner) start(group GroupConfig, action, source string) GroupResult {
+	return GroupResult{
+		Group:   group.Name,
+		Action:  action,
+		Source:  source,
+		Outcome: groupOutcomeRunning,
+		Started: r.clock.Now().Format(time.RFC3339),
+		Steps:   []GroupStep{},
+	}
+}
+
+// finish completes a run, marking the members not reached as skipped
+func (r groupRunner) finish(result GroupResult, order []string) GroupResult {
+	result.Success = true
+	for _, step := range result.Steps {
+		switch step.Outcome {
+		case groupStepOnline, groupStepAlreadyOnline, groupStepOffline, groupStepAlreadyOffline:
+		default:
+			result.Success = false
+		}
+	}
+	for _, target := range order[len(result.Steps):] {
+		result.Steps = append(result.Steps, GroupStep{Target: target, Outcome: groupStepSkipped})
+	}
+	result.Outcome = groupOutcomeDone
+	if !result.Success {
+		result.Outcome = groupOutcomeFailed
+	}
+	result.Finished = r.clock.Now().Format(time.RFC3339)
+	r.logf("Group: %s", result.Summary())
+	return result
+}
+
+// step records what happened to a member and reports the progress
+func (r groupRunner) step(result *GroupResult, step GroupStep) {
+	result.Steps = append(result.Steps, step)
+	if r.report != nil {
+		r.report(*result)
+	}
+}
+
+// wake wakes the members in dependency order. A member that does not come
+// online only stops the members depending on it, directly or through other
+// members; the rest of the group is still woken.
+func (r groupRunner) wake(group GroupConfig, source string) GroupResult {
+	result := r.start(group, groupActionWake, source)
+	order, err := group.Order()
+	if err != nil {
+		result.Outcome = groupOutcomeFailed
+		result.Finished = result.Started
+		return result
+	}
+	dependsOn := make(map[string][]string)
+	for _, member := range group.Members {
+		dependsOn[member.Target] = member.DependsOn
+	}
+
+	failed := make(map[string]bool) // Members not online, failed or skipped
+	for _, target := range order {
+		var missing []string
+		for _, dependency := range dependsOn[target] {
+			if failed[dependency] {
+				missing = append(missing, dependency)
+			}
+		}
+		if len(missing) > 0 {
+			failed[target] = true
+			r.step(&result, GroupStep{Target: target, Outcome: groupStepSkipped, Error: "needs " + strings.Join(missing, ", ")})
+			continue
+		}
+
+		r.logf("Group %s: waking %s", group.Name, target)
+		workflow := newWakeWorkflow(r.clock, r.powerFor(target), r.cfg)
+		workflow.logf = r.logf
+		var wake WakeResult
+		if target == r.cfg.Targets[0].Name && r.wakes != nil {
+			wake = r.wakes.run(workflow, source, nil)
+		} else {
+			wake = workflow.run(source, nil)
+		}
+
+		step := GroupStep{Target: target, Seconds: wake.BootSeconds, Error: wake.Error}
+		switch wake.Outcome {
+		case wakeOnline:
+			step.Outcome = groupStepOnline
+		case wakeAlreadyOnline:
+			step.Outcome = groupStepAlreadyOnline
+		case wakeTimedOut:
+			step.Outcome = groupStepTimedOut
+		default:
+			step.Outcome = groupStepFailed
+		}
+		r.step(&result, step)
+		failed[target] = !wake.Success
+	}
+	return r.finish(result, order)
+}
+
+// shutdown shuts the members down in reverse dependency order and waits for
+// each to be offline before the members it depends on. Unless force is set,
+// the safety checks of every member run first and a failing one stops the run.
+func (r groupRunner) shutdown(group GroupConfig, password string, force bool, source string) GroupResult {
+	result := r.start(group, groupActionShutdown, source)
+	order, err := group.Order()
+	if err != nil {
+		result.Outcome = groupOutcomeFailed
+		result.Finished = result.Started
+		return result
+	}
+	reverse := make([]string, len(order))
+	for i, target := range order {
+		reverse[len(order)-1-i] = target
+	}
+
+	for _, target := range reverse {
+		driver := r.powerFor(target)
+		if !driver.Online() {
+			r.step(&result, GroupStep{Target: target, Outcome: groupStepAlreadyOffline})
+			continue
+		}
+		if !force {
+			if reasons := r.safetyChecks(target, driver); len(reasons) > 0 {
+				r.step(&result, GroupStep{Target: target, Outcome: groupStepBlocked, Error: strings.Join(reasons, "; ")})
+				break
+			}
+		}
+
+		r.logf("Group %s: shutting down %s", group.Name, target)
+		requested := r.clock.Now()
+		if err := driver.Shutdown(password); err != nil {
+			r.step(&result, GroupStep{Target: target, Outcome: groupStepFailed, Error: err.Error()})
+			break
+		}
+		step := r.waitOffline(target, driver, requested)
+		r.step(&result, step)
+		if step.Outcome != groupStepOffline {
+			break
+		}
+	}
+	return r.finish(result, reverse)
+}
+
+// safetyChecks returns why a member must not be shut down: the guard checks
+// of the target and, for the primary target, the keep-awake leases
+func (r groupRunner) safetyChecks(target string, driver PowerDriver) []string {
+	var reasons []string
+	if target == r.cfg.Targets[0].Name {
+		reasons = leaseStore.Reasons(r.clock.Now())
+	}
+	if config, ok := r.cfg.Target(target); !ok || !config.Guards.Enabled() {
+		return reasons
+	}
+	failed, err := driver.CheckGuards()
+	if err != nil {
+		return append(reasons, fmt.Sprintf("guard checks could not run: %v", err))
+	}
+	return append(reasons, failed...)
+}
+
+// waitOffline polls a member until it stops answering the probe or the wake
+// timeout expires
+func (r groupRunner) waitOffline(target string, driver PowerDriver, requested time.Time) GroupStep {
+	deadline := requested.Add(r.cfg.WakeTimeout())
+	for {
+		r.clock.Sleep(r.cfg.WakePollInterval())
+		if !driver.Online() {
+			return GroupStep{Target: target, Outcome: groupStepOffline, Seconds: r.clock.Now().Sub(requested).Seconds()}
+		}
+		if !r.clock.Now().Before(deadline) {
+			return GroupStep{Target: target, Outcome: groupStepTimedOut, Error: fmt.Sprintf("still online %s after the shutdown", r.cfg.WakeTimeout())}
+		}
+	}
+}
+
+// groupTracker runs at most one run per group at a time and remembers the
+// result of the last run of every group
+type groupTracker struct {
+	mu      sync.Mutex
+	last    map[string]*GroupResult
+	running map[string]bool
+}
+
+// The group runs started by the UI, the API and the scheduler
+var groupRuns = &groupTracker{last: make(map[string]*GroupResult), running: make(map[string]bool)}
+
+// Last returns the result of the running or last run of the group, or nil
+func (t *groupTracker) Last(name string) *GroupResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last[name] == nil {
+		return nil
+	}
+	last := *t.last[name]
+	last.Steps = append([]GroupStep(nil), last.Steps...)
+	return &last
+}
+
+// set stores the result of the running run of the group
+func (t *groupTracker) set(r GroupResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last[r.Group] = &r
+}
+
+// begin marks a run of the group as in progress, with the result it starts
+// with, or fails if one is in progress already
+func (t *groupTracker) begin(initial GroupResult) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running[initial.Group] {
+		return fmt.Errorf("a run of group %q is already in progress", initial.Group)
+	}
+	t.running[initial.Group] = true
+	t.last[initial.Group] = &initial
+	return nil
+}
+
+// end stores the final result of the run of the group
+func (t *groupTracker) end(result GroupResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last[result.Group] = &result
+	delete(t.running, result.Group)
+}
+
+// run runs fn for the group and returns its result. If a run of the group is
+// in progress already, it fails without starting another one.
+func (t *groupTracker) run(initial GroupResult, fn func(report func(GroupResult)) GroupResult) (GroupResult, error) {
+	if err := t.begin(initial); err != nil {
+		return GroupResult{}, err
+	}
+	result := fn(t.set)
+	t.end(result)
+	return result, nil
+}
+
+// start runs fn for the group in the background, like run, and returns once
+// it is under way
+func (t *groupTracker) start(initial GroupResult, fn func(report func(GroupResult)) GroupResult) error {
+	if err := t.begin(initial); err != nil {
+		return err
+	}
+	go func() { t.end(fn(t.set)) }()
+	return nil
+}
+
+// runGroup wakes or shuts down a group with the live drivers through the
+// tracker. With wait it returns the final result, otherwise it returns as
+// soon as the run has started.
+func runGroup(group GroupConfig, action, source string, force, wait bool) (GroupResult, error) {
+	runner := newGroupRunner()
+	fn := func(report func(GroupResult)) GroupResult {
+		runner.report = report
+		if action == groupActionShutdown {
+			return runner.shutdown(group, runner.cfg.Auth.ShutdownPassword, force, source)
+		}
+		return runner.wake(group, source)
+	}
+	initial := runner.start(group, action, source)
+	if wait {
+		return groupRuns.run(initial, fn)
+	}
+	return initial, groupRuns.start(initial, fn)
+}
+
+// GroupStatus describes a group for the status page and the API
+type GroupStatus struct {
+	Name    string              `json:"name"`
+	Members []GroupMemberStatus `json:"members"`
+	LastRun *GroupResult        `json:"lastRun,omitempty"`
+}
+
+// GroupMemberStatus is a member of a group in wake order
+type GroupMemberStatus struct {
+	Target    string   `json:"target"`
+	Online    bool     `json:"online"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// groupStatuses probes the members of every group
+func groupStatuses() []GroupStatus {
+	var statuses []GroupStatus
+	online := make(map[string]bool)
+	for _, group := range currentConfig().Groups {
+		status := GroupStatus{Name: group.Name, LastRun: groupRuns.Last(group.Name)}
+		order, _ := group.Order()
+		for _, target := range order {
+			if _, probed := online[target]; !probed {
+				online[target] = powerFor(target).Online()
+			}
+			member := GroupMemberStatus{Target: target, Online: online[target]}
+			for _, m := range group.Members {
+				if m.Target == target {
+					member.DependsOn = m.DependsOn
+				}
+			}
+			status.Members = append(status.Members, member)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupWakeSkipsDependentsOfFailedMembers(t *testing.T) {
+	cfg := testConfig()
+	for _, name := range []string{"nas", "hypervisor", "vm", "printer"} {
+		cfg.Targets = append(cfg.Targets, TargetConfig{Name: name})
+	}
+	// vm needs hypervisor which needs nas; printer needs nothing
+	group := GroupConfig{Name: "lab", Members: []GroupMember{
+		{Target: "nas"},
+		{Target: "hypervisor", DependsOn: []string{"nas"}},
+		{Target: "vm", DependsOn: []string{"hypervisor"}},
+		{Target: "printer"},
+	}}
+
+	tests := []struct {
+		name   string
+		broken string
+		want   map[string]string
+	}{
+		{name: "all online", want: map[string]string{
+			"nas": groupStepOnline, "hypervisor": groupStepOnline, "vm": groupStepOnline, "printer": groupStepOnline}},
+		{name: "leaf fails", broken: "vm", want: map[string]string{
+			"nas": groupStepOnline, "hypervisor": groupStepOnline, "vm": groupStepTimedOut, "printer": groupStepOnline}},
+		{name: "root fails", broken: "nas", want: map[string]string{
+			"nas": groupStepTimedOut, "hypervisor": groupStepSkipped, "vm": groupStepSkipped, "printer": groupStepOnline}},
+		{name: "independent member fails", broken: "printer", want: map[string]string{
+			"nas": groupStepOnline, "hypervisor": groupStepOnline, "vm": groupStepOnline, "printer": groupStepTimedOut}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			powers := make(map[string]*fakePower)
+			for target := range tt.want {
+				powers[target] = &fakePower{broken: target == tt.broken}
+			}
+			runner := groupRunner{
+				clock:    &fakeClock{now: at("02:00:00")},
+				powerFor: func(target string) PowerDriver { return powers[target] },
+				cfg:      cfg,
+				logf:     func(string, ...interface{}) {},
+			}
+
+			result := runner.wake(group, "test")
+			if len(result.Steps) != len(tt.want) {
+				t.Fatalf("got %d steps, want %d: %s", len(result.Steps), len(tt.want), result.Summary())
+			}
+			for _, step := range result.Steps {
+				if step.Outcome != tt.want[step.Target] {
+					t.Errorf("%s: outcome %s, want %s", step.Target, step.Outcome, tt.want[step.Target])
+				}
+				if wakes, _ := powers[step.Target].counts(); (wakes > 0) != (step.Outcome != groupStepSkipped) {
+					t.Errorf("%s: %d wakes sent for outcome %s", step.Target, wakes, step.Outcome)
+				}
+			}
+			if result.Success != (tt.broken == "") {
+				t.Errorf("Success = %v, want %v", result.Success, tt.broken == "")
+			}
+			if _, err := time.Parse(time.RFC3339, result.Finished); err != nil {
+				t.Errorf("Finished = %q: %v", result.Finished, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GuardConfig lists the checks run on a target before it is powered off. A
+// failing check postpones an automatic shutdown and blocks a manual one unless
+// it is forced.
+type GuardConfig struct {
+	Sessions      bool     `yaml:"sessions" json:"sessions"`                     // Someone is logged in (who)
+	Processes     []string `yaml:"processes" json:"processes,omitempty"`         // One of these processes is running (pgrep -x)
+	LockFiles     []string `yaml:"lockFiles" json:"lockFiles,omitempty"`         // One of these files exists
+	MaxLoad       float64  `yaml:"maxLoad" json:"maxLoad,omitempty"`             // The 1-minute load average is above this, 0 disables
+	Commands      []string `yaml:"commands" json:"commands,omitempty"`           // One of these commands exits non-zero
+	RetryInterval string   `yaml:"retryInterval" json:"retryInterval,omitempty"` // Go duration between checks of a postponed shutdown
+	MaxDeferral   string   `yaml:"maxDeferral" json:"maxDeferral,omitempty"`     // Go duration after which the shutdown happens anyway
+}
+
+// Defaults of a postponed automatic shutdown
+const (
+	defaultGuardRetryInterval = 5 * time.Minute
+	defaultGuardMaxDeferral   = 2 * time.Hour
+)
+
+// ShutdownDeferral records an automatic shutdown postponed by a guard check
+type ShutdownDeferral struct {
+	Window  string   `json:"window"`
+	Since   string   `json:"since"`   // Planned shutdown time (RFC3339)
+	Until   string   `json:"until"`   // The shutdown happens anyway at this time (RFC3339)
+	Checked string   `json:"checked"` // Last guard check (RFC3339)
+	Reasons []string `json:"reasons"`
+}
+
+// Enabled reports whether any check is configured
+func (g GuardConfig) Enabled() bool {
+	return g.Sessions || len(g.Processes) > 0 || len(g.LockFiles) > 0 || g.MaxLoad > 0 || len(g.Commands) > 0
+}
+
+// retryInterval returns the time between checks of a postponed shutdown
+func (g GuardConfig) retryInterval() time.Duration {
+	d, err := time.ParseDuration(g.RetryInterval)
+	if err != nil || d <= 0 {
+		return defaultGuardRetryInterval
+	}
+	return d
+}
+
+// maxDeferral returns how long an automatic shutdown may be postponed
+func (g GuardConfig) maxDeferral() time.Duration {
+	d, err := time.ParseDuration(g.MaxDeferral)
+	if err != nil || d < 0 {
+		return defaultGuardMaxDeferral
+	}
+	return d
+}
+
+// script returns the shell script run on the target. It prints one line per
+// failing check and nothing if the target may be powered off.
+func (g GuardConfig) script() string {
+	var lines []string
+	if g.Sessions {
+		lines = append(lines, sessionCheck)
+	}
+	for _, process := range g.Processes {
+		lines = append(lines, fmt.Sprintf(`pgrep -x %s >/dev/null && echo %s`, shellQuote(process), shellQuote("process "+process+" is running")))
+	}
+	for _, file := range g.LockFiles {
+		lines = append(lines, fmt.Sprintf(`[ -e %s ] && echo %s`, shellQuote(file), shellQuote("lock file "+file+" exists")))
+	}
+	if g.MaxLoad > 0 {
+		lines = append(lines, loadCheck(g.MaxLoad))
+	}
+	for _, command := range g.Commands {
+		lines = append(lines, commandCheck(command))
+	}
+	return checkScript(lines)
+}
+
+// Check line printing the users logged in on the target
+const sessionCheck = `users=$(who | awk '{print $1}' | sort -u | tr '\n' ' '); [ -n "$users" ] && echo "users logged in: $users"`
+
+// loadCheck returns a check line printing the load average if it is above max
+func loadCheck(max float64) string {
+	limit := strconv.FormatFloat(max, 'f', -1, 64)
+	return fmt.Sprintf(`awk -v max=%s '$1 > max {print "load average " $1 " is above " max}' /proc/loadavg`, limit)
+}
+
+// commandCheck returns a check line reporting the command if it exits non-zero
+func commandCheck(command string) string {
+	return fmt.Sprintf(`(%s) >/dev/null 2>&1 || echo %s`, command, shellQuote("check '"+command+"' failed"))
+}
+
+// checkScript joins check lines into a script that always exits successfully,
+// so only the printed lines tell whether a check failed
+func checkScript(lines []string) string {
+	return strings.Join(append(lines, "true"), "\n")
+}
+
+// shellQuote quotes a value for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// validateGuards checks the guard configuration of a target
+func validateGuards(g GuardConfig) []string {
+	var problems []string
+	if g.RetryInterval != "" {
+		if d, err := time.ParseDuration(g.RetryInterval); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("retryInterval: invalid duration %q", g.RetryInterval))
+		}
+	}
+	if g.MaxDeferral != "" {
+		if d, err := time.ParseDuration(g.MaxDeferral); err != nil || d < 0 {
+			problems = append(problems, fmt.Sprintf("maxDeferral: invalid duration %q", g.MaxDeferral))
+		}
+	}
+	if g.MaxLoad < 0 {
+		problems = append(problems, fmt.Sprintf("maxLoad: must not be negative, got %g", g.MaxLoad))
+	}
+	for i, process := range g.Processes {
+		if strings.TrimSpace(process) == "" {
+			problems = append(problems, fmt.Sprintf("processes[%d]: must not be empty", i))
+		}
+	}
+	for i, file := range g.LockFiles {
+		if strings.TrimSpace(file) == "" {
+			problems = append(problems, fmt.Sprintf("lockFiles[%d]: must not be empty", i))
+		}
+	}
+	for i, command := range g.Commands {
+		if strings.TrimSpace(command) == "" {
+			problems = append(problems, fmt.Sprintf("commands[%d]: must not be empty", i))
+		}
+	}
+	return problems
+}
+
+// checkGuards returns why the target must not be powered off now: the active
+// keep-awake leases and the failing guard checks of the target. A check that
+// cannot run counts as failing.
+func checkGuards() []string {
+	reasons := leaseStore.Reasons(clock.Now())
+	if !currentTarget().Guards.Enabled() {
+		return reasons
+	}
+	failed, err := power.CheckGuards()
+	if err != nil {
+		return append(reasons, fmt.Sprintf("guard checks could not run: %v", err))
+	}
+	return append(reasons, failed...)
+}
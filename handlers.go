@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -31,18 +33,18 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	scheduleConfig := GetScheduleConfig()
 
 	data := StatusData{
-		Server:          serverName,
+		Server:          currentTarget().Host,
 		Status:          status,
 		Color:           color,
 		IsTestMode:      runtime.GOOS == "darwin",
 		AskPassword:     false,
 		ErrorMessage:    "",
 		Schedule:        scheduleConfig,
-		LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
-		RefreshInterval: refreshInterval,
+		LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+		RefreshInterval: currentConfig().Server.RefreshInterval,
 	}
 
-	if err := tmpl.Execute(w, data); err != nil {
+	if err := renderStatus(w, data); err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		log.Printf("Template render error: %v", err)
 	}
@@ -51,74 +53,78 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 // Handle boot request
 func bootHandler(w http.ResponseWriter, r *http.Request) {
 	if !isServerOnline() {
-		// Boot the server using wakeonlan
-		err := sendWakeOnLAN()
-		if err != nil {
-			log.Printf("Error booting server: %v", err)
+		// Boot the server in the background, the page shows how the wake goes
+		result := wakes.start(newWakeWorkflow(clock, power, currentConfig()), wakeSourceUI)
+		if result.Outcome == wakeFailed {
+			log.Printf("Error booting server: %s", result.Error)
 		}
 
 		// Display booting status
 		data := StatusData{
-			Server:          serverName,
+			Server:          currentTarget().Host,
 			Status:          "Booting",
 			Color:           "#607d8b", // Material blue-gray
 			IsTestMode:      runtime.GOOS == "darwin",
 			AskPassword:     false,
 			Schedule:        GetScheduleConfig(),
-			LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
-			RefreshInterval: refreshInterval,
+			LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+			RefreshInterval: currentConfig().Server.RefreshInterval,
 		}
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := renderStatus(w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 			log.Printf("Template render error: %v", err)
 		}
 	} else {
 		// Server is already online
 		data := StatusData{
-			Server:          serverName,
+			Server:          currentTarget().Host,
 			Status:          "Online",
 			Color:           "#4caf50", // Material green
 			IsTestMode:      runtime.GOOS == "darwin",
 			AskPassword:     false,
 			Schedule:        GetScheduleConfig(),
-			LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
-			RefreshInterval: refreshInterval,
+			LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+			RefreshInterval: currentConfig().Server.RefreshInterval,
 		}
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := renderStatus(w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 			log.Printf("Template render error: %v", err)
 		}
 	}
 }
 
-// Handle shutdown confirmation request
+// Handle shutdown confirmation request, ?action= selects another power action
 func confirmShutdownHandler(w http.ResponseWriter, r *http.Request) {
+	action := r.URL.Query().Get("action")
+	if action == "" {
+		action = actionShutdown
+	}
 	online := isServerOnline()
 
 	if !online {
 		// Server is already offline
 		data := StatusData{
-			Server:          serverName,
+			Server:          currentTarget().Host,
 			Status:          "Offline",
 			Color:           "#d32f2f", // Material red
 			IsTestMode:      runtime.GOOS == "darwin",
 			AskPassword:     false,
 			Schedule:        GetScheduleConfig(),
-			LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
-			RefreshInterval: refreshInterval,
+			LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+			RefreshInterval: currentConfig().Server.RefreshInterval,
 		}
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := renderStatus(w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 			log.Printf("Template render error: %v", err)
 		}
 		return
 	}
 
-	// Check if shutdown password is set
-	if shutdownPassword == "" {
+	// Check if shutdown password is set, when the action needs it
+	if currentConfig().passwordMissing("", action) {
 		// Show error about missing password
 		data := StatusData{
-			Server:          serverName,
+			Server:          currentTarget().Host,
 			Status:          "Online",
 			Color:           "#4caf50", // Material green
 			IsTestMode:      runtime.GOOS == "darwin",
@@ -126,10 +132,10 @@ func confirmShutdownHandler(w http.ResponseWriter, r *http.Request) {
 			ConfirmShutdown: false,
 			ErrorMessage:    "SHUTDOWN_PASSWORD not set in environment. Please set it in the .env file.",
 			Schedule:        GetScheduleConfig(),
-			LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
-			RefreshInterval: refreshInterval,
+			LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+			RefreshInterval: currentConfig().Server.RefreshInterval,
 		}
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := renderStatus(w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 			log.Printf("Template render error: %v", err)
 		}
@@ -138,22 +144,25 @@ func confirmShutdownHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Show confirmation dialog - we'll use the password from .env
 	data := StatusData{
-		Server:          serverName,
+		Server:          currentTarget().Host,
 		Status:          "Online",
 		Color:           "#4caf50", // Material green
 		IsTestMode:      runtime.GOOS == "darwin",
 		ConfirmShutdown: true,
+		ConfirmAction:   action,
 		AskPassword:     false, // Make sure we don't ask for password
 		Schedule:        GetScheduleConfig(),
-		LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
+		LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
 	}
-
-	// Notify the user if password is not configured
-	if shutdownPassword == "" {
-		data.ErrorMessage = "SHUTDOWN_PASSWORD not set in environment. Shutdown may fail."
+	if _, ok := currentTarget().Action(action); !ok {
+		data.ConfirmShutdown = false
+		data.ErrorMessage = fmt.Sprintf("Action %q is not configured for this server.", action)
+	} else {
+		// Warn about failed safety checks, the user can still go ahead
+		data.GuardReasons = checkGuards()
 	}
 
-	if err := tmpl.Execute(w, data); err != nil {
+	if err := renderStatus(w, data); err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		log.Printf("Template render error: %v", err)
 	}
@@ -162,30 +171,42 @@ func confirmShutdownHandler(w http.ResponseWriter, r *http.Request) {
 // Handle shutdown confirmation without password
 // enterPasswordHandler function removed - we now use the password from .env directly
 
-// Handle actual shutdown request
+// Handle actual shutdown request, the action form field selects another power action.
+// Failed safety checks bring the confirmation back unless the force field is set, a
+// delay field starts a countdown instead and wall warns the users logged in.
 func shutdownHandler(w http.ResponseWriter, r *http.Request) {
 	// Only process POST requests for security
 	if r.Method != "POST" {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	action := r.FormValue("action")
+	if action == "" {
+		action = actionShutdown
+	}
+	wall := r.FormValue("wall") != ""
+	delay, err := parseShutdownDelay(r.FormValue("delay"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Use the password from environment variable
-	if shutdownPassword == "" {
+	// Use the password from environment variable, when the action needs it
+	if currentConfig().passwordMissing("", action) {
 		log.Printf("SHUTDOWN_PASSWORD not set in environment, cannot perform shutdown")
 		// Show error message
 		data := StatusData{
-			Server:          serverName,
+			Server:          currentTarget().Host,
 			Status:          "Online",
 			Color:           "#4caf50",
 			IsTestMode:      runtime.GOOS == "darwin",
 			AskPassword:     false,
 			ErrorMessage:    "SHUTDOWN_PASSWORD not set in environment",
 			Schedule:        GetScheduleConfig(),
-			LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
-			RefreshInterval: refreshInterval,
+			LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+			RefreshInterval: currentConfig().Server.RefreshInterval,
 		}
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := renderStatus(w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 			log.Printf("Template render error: %v", err)
 		}
@@ -193,24 +214,70 @@ func shutdownHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if isServerOnline() {
+		if r.FormValue("force") == "" {
+			if reasons := checkGuards(); len(reasons) > 0 {
+				log.Printf("%s refused by the safety checks: %s", action, strings.Join(reasons, "; "))
+				data := StatusData{
+					Server:          currentTarget().Host,
+					Status:          "Online",
+					Color:           "#4caf50",
+					IsTestMode:      runtime.GOOS == "darwin",
+					ConfirmShutdown: true,
+					ConfirmAction:   action,
+					ConfirmDelay:    r.FormValue("delay"),
+					ConfirmWall:     wall,
+					GuardReasons:    reasons,
+					Schedule:        GetScheduleConfig(),
+					LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+				}
+				if err := renderStatus(w, data); err != nil {
+					http.Error(w, "Failed to render template", http.StatusInternalServerError)
+					log.Printf("Template render error: %v", err)
+				}
+				return
+			}
+		}
+
+		if delay > 0 {
+			data := StatusData{
+				Server:          currentTarget().Host,
+				Status:          "Online",
+				Color:           "#4caf50",
+				IsTestMode:      runtime.GOOS == "darwin",
+				AskPassword:     false,
+				Schedule:        GetScheduleConfig(),
+				LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+				RefreshInterval: currentConfig().Server.RefreshInterval,
+			}
+			if _, err := countdown.Start(action, delay, wall, r.FormValue("force") != ""); err != nil {
+				log.Printf("Error scheduling %s: %v", action, err)
+				data.ErrorMessage = fmt.Sprintf("Failed to schedule %s: %v", action, err)
+			}
+			if err := renderStatus(w, data); err != nil {
+				http.Error(w, "Failed to render template", http.StatusInternalServerError)
+				log.Printf("Template render error: %v", err)
+			}
+			return
+		}
+
 		// Shutdown the server using the password from .env file
-		err := shutdownServer(shutdownPassword)
+		err := runPowerAction(action, currentConfig().Auth.ShutdownPassword)
 		if err != nil {
-			log.Printf("Error shutting down server: %v", err)
+			log.Printf("Error running %s on server: %v", action, err)
 
 			// Show error message
 			data := StatusData{
-				Server:          serverName,
+				Server:          currentTarget().Host,
 				Status:          "Online",
 				Color:           "#4caf50",
 				IsTestMode:      runtime.GOOS == "darwin",
 				AskPassword:     false, // No longer asking for password
-				ErrorMessage:    "Failed to shutdown server. Please check the password in .env file.",
+				ErrorMessage:    fmt.Sprintf("Failed to %s server. Please check the password in .env file.", action),
 				Schedule:        GetScheduleConfig(),
-				LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
-				RefreshInterval: refreshInterval,
+				LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+				RefreshInterval: currentConfig().Server.RefreshInterval,
 			}
-			if err := tmpl.Execute(w, data); err != nil {
+			if err := renderStatus(w, data); err != nil {
 				http.Error(w, "Failed to render template", http.StatusInternalServerError)
 				log.Printf("Template render error: %v", err)
 			}
@@ -219,34 +286,142 @@ func shutdownHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Display shutting down status
 		data := StatusData{
-			Server:          serverName,
-			Status:          "Shutting down",
+			Server:          currentTarget().Host,
+			Status:          actionStatus(action),
 			Color:           "#5d4037", // Material brown
 			IsTestMode:      runtime.GOOS == "darwin",
 			AskPassword:     false,
 			Schedule:        GetScheduleConfig(),
-			LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
-			RefreshInterval: refreshInterval,
+			LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+			RefreshInterval: currentConfig().Server.RefreshInterval,
 		}
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := renderStatus(w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 			log.Printf("Template render error: %v", err)
 		}
 	} else {
 		// Server is already offline
 		data := StatusData{
-			Server:          serverName,
+			Server:          currentTarget().Host,
 			Status:          "Offline",
 			Color:           "#d32f2f", // Material red
 			IsTestMode:      runtime.GOOS == "darwin",
 			AskPassword:     false,
 			Schedule:        GetScheduleConfig(),
-			LastUpdated:     time.Now().Format("2006-01-02 15:04:05"),
-			RefreshInterval: refreshInterval,
+			LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+			RefreshInterval: currentConfig().Server.RefreshInterval,
 		}
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := renderStatus(w, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 			log.Printf("Template render error: %v", err)
 		}
 	}
 }
+
+// Handle cancelling a delayed shutdown
+func cancelShutdownHandler(w http.ResponseWriter, r *http.Request) {
+	// Only process POST requests for security
+	if r.Method == "POST" {
+		countdown.Cancel()
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Handle waking or shutting down a group. The run goes on in the background and
+// the page shows its progress; force skips the safety checks of the members.
+func groupHandler(w http.ResponseWriter, r *http.Request) {
+	// Only process POST requests for security
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	action := r.FormValue("action")
+
+	var err error
+	group, ok := currentConfig().Group(r.FormValue("group"))
+	switch {
+	case !ok:
+		err = fmt.Errorf("Unknown group %q", r.FormValue("group"))
+	case action != groupActionWake && action != groupActionShutdown:
+		err = fmt.Errorf("Invalid group action %q", action)
+	case action == groupActionShutdown && currentConfig().groupPasswordMissing(group):
+		err = fmt.Errorf("SHUTDOWN_PASSWORD not set in environment")
+	default:
+		_, err = runGroup(group, action, wakeSourceUI, r.FormValue("force") != "", false)
+	}
+	if err == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	log.Printf("Error running group %s: %v", action, err)
+	online := isServerOnline()
+	data := StatusData{
+		Server:          currentTarget().Host,
+		Status:          "Online",
+		Color:           "#4caf50", // Material green
+		IsTestMode:      runtime.GOOS == "darwin",
+		ErrorMessage:    err.Error(),
+		Schedule:        GetScheduleConfig(),
+		LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+		RefreshInterval: currentConfig().Server.RefreshInterval,
+	}
+	if !online {
+		data.Status = "Offline"
+		data.Color = "#d32f2f" // Material red
+	}
+	if err := renderStatus(w, data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		log.Printf("Template render error: %v", err)
+	}
+}
+
+// Handle turning maintenance mode on or off. The for field sets how long it
+// lasts, empty until it is turned off.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	// Only process POST requests for security
+	if r.Method != "POST" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	now := clock.Now()
+	var err error
+	if r.FormValue("action") == "off" {
+		if _, err = stopMaintenance(now); err == nil {
+			log.Printf("Maintenance mode turned off")
+		}
+	} else {
+		var end time.Time
+		if end, err = parseMaintenanceEnd(r.FormValue("for"), "", now); err == nil {
+			var maintenance MaintenanceMode
+			if maintenance, err = startMaintenance(end, r.FormValue("reason"), now); err == nil {
+				log.Printf("Maintenance mode turned on: %s", maintenance.Description())
+			}
+		}
+	}
+	if err == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	log.Printf("Error changing maintenance mode: %v", err)
+	data := StatusData{
+		Server:          currentTarget().Host,
+		Status:          "Online",
+		Color:           "#4caf50", // Material green
+		IsTestMode:      runtime.GOOS == "darwin",
+		ErrorMessage:    fmt.Sprintf("Failed to change maintenance mode: %v", err),
+		Schedule:        GetScheduleConfig(),
+		LastUpdated:     clock.Now().Format("2006-01-02 15:04:05"),
+		RefreshInterval: currentConfig().Server.RefreshInterval,
+	}
+	if !isServerOnline() {
+		data.Status = "Offline"
+		data.Color = "#d32f2f" // Material red
+	}
+	if err := renderStatus(w, data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		log.Printf("Template render error: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Number of runs kept in the history file, older runs are dropped
+const maxHistoryRecords = 500
+
+// Number of runs returned by the API and shown in the UI by default
+const historyPageSize = 50
+
+// Number of errors kept per run, so a shutdown retried for hours stays readable
+const maxRunErrors = 20
+
+// RunRecord describes one scheduled occurrence of a window and what the
+// scheduler did about it. Times are RFC3339, empty when the step did not happen.
+type RunRecord struct {
+	Window            string   `json:"window"`
+	Planned           string   `json:"planned"`                     // Wake time of the occurrence
+	WakeSent          string   `json:"wakeSent,omitempty"`          // Wake-on-LAN packet sent
+	Online            string   `json:"online,omitempty"`            // Server seen online
+	ShutdownRequested string   `json:"shutdownRequested,omitempty"` // Shutdown command accepted
+	Offline           string   `json:"offline,omitempty"`           // Server seen offline after the shutdown
+	BootSeconds       float64  `json:"bootSeconds,omitempty"`       // Time from the first wake packet to the server answering
+	Skipped           string   `json:"skipped,omitempty"`           // Override that cancelled the occurrence
+	Postponed         string   `json:"postponed,omitempty"`         // Guard check that last postponed the shutdown
+	Errors            []string `json:"errors,omitempty"`
+}
+
+// BootTime returns the measured boot duration for humans
+func (r RunRecord) BootTime() string {
+	return formatSeconds(r.BootSeconds)
+}
+
+// HistoryStore keeps the run history of the schedule windows and persists it
+// next to the schedule
+type HistoryStore struct {
+	mu      sync.RWMutex
+	path    string
+	records []RunRecord // Oldest first
+}
+
+var historyStore = NewHistoryStore("history.json")
+
+// NewHistoryStore creates a store backed by the file at path. With an empty
+// path the history is only kept in memory.
+func NewHistoryStore(path string) *HistoryStore {
+	return &HistoryStore{path: path}
+}
+
+// Load reads the history from disk, a missing file is an empty history
+func (h *HistoryStore) Load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	data, err := os.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		h.records = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read history file: %v", err)
+	}
+
+	var records []RunRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("failed to parse history %s: %v", h.path, err)
+	}
+	h.records = records
+	return nil
+}
+
+// Recent returns up to limit runs, newest first, optionally only those of one window
+func (h *HistoryStore) Recent(window string, limit int) []RunRecord {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	runs := []RunRecord{}
+	for i := len(h.records) - 1; i >= 0 && (limit <= 0 || len(runs) < limit); i-- {
+		if window != "" && h.records[i].Window != window {
+			continue
+		}
+		run := h.records[i]
+		run.Errors = append([]string(nil), run.Errors...)
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// Record applies fn to the run of window planned at the given wake time,
+// creating it if needed, and persists the history
+func (h *HistoryStore) Record(window string, planned time.Time, fn func(*RunRecord)) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := planned.Format(time.RFC3339)
+	var run *RunRecord
+	for i := len(h.records) - 1; i >= 0; i-- {
+		if h.records[i].Window == window && h.records[i].Planned == key {
+			run = &h.records[i]
+			break
+		}
+	}
+	if run == nil {
+		h.records = append(h.records, RunRecord{Window: window, Planned: key})
+		run = &h.records[len(h.records)-1]
+	}
+	fn(run)
+
+	if len(h.records) > maxHistoryRecords {
+		h.records = append([]RunRecord(nil), h.records[len(h.records)-maxHistoryRecords:]...)
+	}
+	return h.saveLocked()
+}
+
+// saveLocked writes the history to disk; the caller must hold the lock
+func (h *HistoryStore) saveLocked() error {
+	if h.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(h.records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal history: %v", err)
+	}
+	if err := writeFileAtomic(h.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save history: %v", err)
+	}
+	return nil
+}
+
+// Load the run history from file
+func loadHistory(path string) error {
+	historyStore = NewHistoryStore(path)
+	return historyStore.Load()
+}
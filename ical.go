@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CalendarEvent is one VEVENT of an iCalendar file. All-day events have their
+// dates at midnight UTC with an exclusive end date; they are floating and apply
+// to that date in every time zone.
+type CalendarEvent struct {
+	UID     string    `json:"uid"`
+	Summary string    `json:"summary"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	AllDay  bool      `json:"allDay"`
+
+	rule    *recurrenceRule
+	exdates []time.Time
+}
+
+// recurrenceRule is the supported subset of an RRULE: FREQ, INTERVAL, COUNT,
+// UNTIL, WKST, BYMONTH, BYMONTHDAY and BYDAY
+type recurrenceRule struct {
+	freq       string // DAILY, WEEKLY, MONTHLY or YEARLY
+	interval   int
+	count      int       // 0 for no limit
+	until      time.Time // zero for no limit
+	weekStart  time.Weekday
+	byMonth    []time.Month
+	byMonthDay []int // Negative days count from the end of the month
+	byDay      []ruleWeekday
+}
+
+// ruleWeekday is a BYDAY entry such as MO, 2TU or -1FR
+type ruleWeekday struct {
+	n   int // Occurrence within the month, negative from its end, 0 for every one
+	day time.Weekday
+}
+
+// unsupportedRuleError is returned for a valid RRULE this parser cannot expand;
+// the event is skipped instead of the whole calendar being rejected
+type unsupportedRuleError struct {
+	reason string
+}
+
+func (e unsupportedRuleError) Error() string {
+	return "unsupported RRULE: " + e.reason
+}
+
+// Upper bound of recurrences expanded per event, guards against endless rules
+const maxRecurrences = 10000
+
+// loadCalendarFile parses the iCalendar file at path
+func loadCalendarFile(path string) ([]CalendarEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open calendar: %v", err)
+	}
+	defer f.Close()
+
+	events, err := parseICS(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse calendar %s: %v", path, err)
+	}
+	return events, nil
+}
+
+// parseICS reads the VEVENTs of an iCalendar stream. Nested components such as
+// VALARM are ignored, as are events without a start.
+func parseICS(r io.Reader) ([]CalendarEvent, error) {
+	lines, err := unfoldICSLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []CalendarEvent
+	var current *CalendarEvent
+	var duration string
+	var unsupported string // Why the current event is skipped
+	depth := 0             // Components nested in the current VEVENT
+
+	for n, line := range lines {
+		name, params, value, ok := splitICSLine(line)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT" && current == nil:
+			current = &CalendarEvent{}
+			duration = ""
+			unsupported = ""
+			continue
+		case name == "BEGIN" && current != nil:
+			depth++
+			continue
+		case name == "END" && current != nil && depth > 0:
+			depth--
+			continue
+		case name == "END" && value == "VEVENT" && current != nil:
+			if current.Start.IsZero() {
+				log.Printf("Calendar: skipping event %q without DTSTART", current.Summary)
+			} else if unsupported != "" {
+				log.Printf("Calendar: skipping event %q: %s", current.Summary, unsupported)
+			} else {
+				if err := finishEvent(current, duration); err != nil {
+					return nil, fmt.Errorf("line %d: event %q: %v", n+1, current.Summary, err)
+				}
+				events = append(events, *current)
+			}
+			current = nil
+			continue
+		}
+		if current == nil || depth > 0 {
+			continue
+		}
+
+		switch name {
+		case "UID":
+			current.UID = value
+		case "SUMMARY":
+			current.Summary = unescapeICSText(value)
+		case "DTSTART":
+			current.Start, current.AllDay, err = parseICSTime(value, params)
+		case "DTEND":
+			current.End, _, err = parseICSTime(value, params)
+		case "DURATION":
+			duration = value
+		case "RRULE":
+			current.rule, err = parseRecurrenceRule(value)
+			var unsupportedRule unsupportedRuleError
+			if errors.As(err, &unsupportedRule) {
+				unsupported, err = unsupportedRule.Error(), nil
+			}
+		case "EXDATE":
+			for _, v := range strings.Split(value, ",") {
+				var t time.Time
+				if t, _, err = parseICSTime(v, params); err != nil {
+					break
+				}
+				current.exdates = append(current.exdates, t)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", n+1, name, err)
+		}
+	}
+
+	return events, nil
+}
+
+// finishEvent fills in the end of an event from its duration or its start
+func finishEvent(e *CalendarEvent, duration string) error {
+	if !e.End.IsZero() {
+		if e.End.Before(e.Start) {
+			return fmt.Errorf("DTEND is before DTSTART")
+		}
+		return nil
+	}
+	if duration != "" {
+		d, days, err := parseICSDuration(duration)
+		if err != nil {
+			return fmt.Errorf("DURATION: %v", err)
+		}
+		e.End = e.Start.AddDate(0, 0, days).Add(d)
+		return nil
+	}
+	// Without an end an all-day event lasts one day, a timed one is an instant
+	e.End = e.Start
+	if e.AllDay {
+		e.End = e.Start.AddDate(0, 0, 1)
+	}
+	return nil
+}
+
+// unfoldICSLines joins folded content lines (continuations start with a space or tab)
+func unfoldICSLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// splitICSLine splits "NAME;PARAM=VALUE:value" into its parts. Colons inside
+// quoted parameter values do not end the name.
+func splitICSLine(line string) (name string, params map[string]string, value string, ok bool) {
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, "", false
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	params = make(map[string]string)
+	for _, p := range parts[1:] {
+		if k, v, found := strings.Cut(p, "="); found {
+			params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, line[colon+1:], true
+}
+
+// unescapeICSText undoes the escaping of TEXT values
+func unescapeICSText(value string) string {
+	return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// parseICSTime parses a DATE or DATE-TIME value. UTC times end in Z, times with
+// a TZID are in that zone and floating times are in the server's time zone.
+func parseICSTime(value string, params map[string]string) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	if params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err := time.Parse("20060102", value)
+		if err != nil {
+			return t, false, fmt.Errorf("invalid date %q", value)
+		}
+		return t, true, nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		if err != nil {
+			return t, false, fmt.Errorf("invalid time %q", value)
+		}
+		return t, false, nil
+	}
+
+	loc := time.Local
+	if tzid := params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		} else {
+			log.Printf("Calendar: unknown TZID %q, using local time", tzid)
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	if err != nil {
+		return t, false, fmt.Errorf("invalid time %q", value)
+	}
+	return t, false, nil
+}
+
+// parseICSDuration parses a positive duration such as P1D, PT2H30M or P1W. Days
+// and weeks are returned separately so they follow the calendar across DST changes.
+func parseICSDuration(value string) (time.Duration, int, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(value), "+")
+	if !strings.HasPrefix(s, "P") {
+		return 0, 0, fmt.Errorf("invalid duration %q", value)
+	}
+	s = s[1:]
+
+	var d time.Duration
+	days := 0
+	inTime := false
+	number := ""
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			number += string(c)
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid duration %q", value)
+		}
+		number = ""
+		switch {
+		case c == 'W' && !inTime:
+			days += 7 * n
+		case c == 'D' && !inTime:
+			days += n
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, 0, fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	if number != "" {
+		return 0, 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, days, nil
+}
+
+// icsWeekdays maps the two-letter iCalendar day names to weekdays
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseRecurrenceRule parses an RRULE. Malformed values are errors; valid rules
+// using parts this parser does not expand, such as BYSETPOS or an hourly
+// frequency, return an unsupportedRuleError rather than being expanded wrongly.
+func parseRecurrenceRule(value string) (*recurrenceRule, error) {
+	rule := &recurrenceRule{interval: 1, weekStart: time.Monday}
+	for _, part := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(part, "=")
+		v = strings.ToUpper(v)
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			rule.freq = v
+		case "INTERVAL":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid INTERVAL %q", v)
+			}
+			rule.interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid COUNT %q", v)
+			}
+			rule.count = n
+		case "UNTIL":
+			t, _, err := parseICSTime(v, nil)
+			if err != nil {
+				return nil, fmt.Errorf("invalid UNTIL %q", v)
+			}
+			rule.until = t
+		case "WKST":
+			day, ok := icsWeekdays[v]
+			if !ok {
+				return nil, fmt.Errorf("invalid WKST %q", v)
+			}
+			rule.weekStart = day
+		case "BYMONTH":
+			for _, m := range strings.Split(v, ",") {
+				n, err := strconv.Atoi(m)
+				if err != nil || n < 1 || n > 12 {
+					return nil, fmt.Errorf("invalid BYMONTH %q", m)
+				}
+				rule.byMonth = append(rule.byMonth, time.Month(n))
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(v, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("invalid BYMONTHDAY %q", d)
+				}
+				rule.byMonthDay = append(rule.byMonthDay, n)
+			}
+		case "BYDAY":
+			for _, d := range strings.Split(v, ",") {
+				wd, err := parseRuleWeekday(d)
+				if err != nil {
+					return nil, err
+				}
+				rule.byDay = append(rule.byDay, wd)
+			}
+		default:
+			return nil, unsupportedRuleError{fmt.Sprintf("part %s is not supported", strings.ToUpper(k))}
+		}
+	}
+
+	ordinals := false
+	for _, wd := range rule.byDay {
+		ordinals = ordinals || wd.n != 0
+	}
+	switch rule.freq {
+	case "DAILY", "WEEKLY":
+		if ordinals {
+			return nil, unsupportedRuleError{"numbered BYDAY needs a MONTHLY or YEARLY frequency"}
+		}
+		if rule.freq == "WEEKLY" && len(rule.byMonthDay) > 0 {
+			return nil, unsupportedRuleError{"BYMONTHDAY cannot be used with a WEEKLY frequency"}
+		}
+	case "MONTHLY":
+	case "YEARLY":
+		if ordinals && len(rule.byMonth) == 0 {
+			return nil, unsupportedRuleError{"numbered BYDAY in a YEARLY rule needs BYMONTH"}
+		}
+	case "":
+		return nil, fmt.Errorf("missing FREQ")
+	default:
+		return nil, unsupportedRuleError{fmt.Sprintf("frequency %s is not supported", rule.freq)}
+	}
+	return rule, nil
+}
+
+// parseRuleWeekday parses a BYDAY entry such as MO, 2TU or -1FR
+func parseRuleWeekday(value string) (ruleWeekday, error) {
+	if len(value) < 2 {
+		return ruleWeekday{}, fmt.Errorf("invalid BYDAY %q", value)
+	}
+	day, ok := icsWeekdays[value[len(value)-2:]]
+	if !ok {
+		return ruleWeekday{}, fmt.Errorf("invalid BYDAY %q", value)
+	}
+	wd := ruleWeekday{day: day}
+	if prefix := strings.TrimPrefix(value[:len(value)-2], "+"); prefix != "" {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return ruleWeekday{}, fmt.Errorf("invalid BYDAY %q", value)
+		}
+		wd.n = n
+	}
+	return wd, nil
+}
+
+// occurrences returns the instances of the event overlapping [from, to)
+func (e CalendarEvent) occurrences(from, to time.Time) []CalendarEvent {
+	length := e.End.Sub(e.Start)
+	var result []CalendarEvent
+	add := func(start time.Time) {
+		for _, ex := range e.exdates {
+			if ex.Equal(start) {
+				return
+			}
+		}
+		end := start.Add(length)
+		if e.AllDay {
+			// Keep whole days, the dates are at midnight UTC
+			end = start.AddDate(0, 0, int(length/(24*time.Hour)))
+		}
+		if start.Before(to) && (end.After(from) || (end.Equal(start) && !start.Before(from))) {
+			occurrence := e
+			occurrence.Start, occurrence.End = start, end
+			occurrence.rule, occurrence.exdates = nil, nil
+			result = append(result, occurrence)
+		}
+	}
+
+	if e.rule == nil {
+		add(e.Start)
+		return result
+	}
+
+	// Candidates before DTSTART, such as earlier days of its week, do not count
+	produced := 0
+periods:
+	for i := 0; i < maxRecurrences; i++ {
+		periodStart, starts := e.rule.period(e.Start, i)
+		if !periodStart.Before(to) || (!e.rule.until.IsZero() && periodStart.After(e.rule.until)) {
+			break
+		}
+		for _, start := range starts {
+			if start.Before(e.Start) {
+				continue
+			}
+			if (e.rule.count > 0 && produced >= e.rule.count) || (!e.rule.until.IsZero() && start.After(e.rule.until)) {
+				break periods
+			}
+			produced++
+			add(start)
+		}
+	}
+	return result
+}
+
+// period returns the beginning of the i-th period of the rule (day, week,
+// month or year) and the starts of the recurrences within it, in order and
+// at the wall-clock time of start. Days missing from a month, such as the
+// 31st of April, are skipped.
+func (r *recurrenceRule) period(start time.Time, i int) (time.Time, []time.Time) {
+	n := i * r.interval
+	y, m, d := start.Date()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+	}
+
+	var starts []time.Time
+	switch r.freq {
+	case "DAILY":
+		day := at(y, m, d+n)
+		last := daysInMonth(day.Year(), day.Month())
+		if r.inMonths(day.Month()) && r.onMonthDay(day.Day(), last) && r.onWeekday(day.Weekday(), day.Day(), last) {
+			starts = append(starts, day)
+		}
+		return day, starts
+
+	case "WEEKLY":
+		offset := (int(start.Weekday()) - int(r.weekStart) + 7) % 7
+		first := at(y, m, d-offset+7*n)
+		for k := 0; k < 7; k++ {
+			day := at(y, m, d-offset+7*n+k)
+			onDay := day.Weekday() == start.Weekday()
+			if len(r.byDay) > 0 {
+				onDay = r.onWeekday(day.Weekday(), 0, 0)
+			}
+			if onDay && r.inMonths(day.Month()) {
+				starts = append(starts, day)
+			}
+		}
+		return first, starts
+
+	case "MONTHLY":
+		first := at(y, m+time.Month(n), 1)
+		if r.inMonths(first.Month()) {
+			starts = r.monthDays(first.Year(), first.Month(), start, at)
+		}
+		return first, starts
+
+	default:
+		months := r.byMonth
+		if len(months) == 0 {
+			months = []time.Month{m}
+			if len(r.byDay) > 0 || len(r.byMonthDay) > 0 {
+				months = nil
+				for month := time.January; month <= time.December; month++ {
+					months = append(months, month)
+				}
+			}
+		}
+		for month := time.January; month <= time.December; month++ {
+			for _, wanted := range months {
+				if month == wanted {
+					starts = append(starts, r.monthDays(y+n, month, start, at)...)
+					break
+				}
+			}
+		}
+		return at(y+n, time.January, 1), starts
+	}
+}
+
+// monthDays returns the recurrences in a month of a monthly or yearly rule.
+// Without BYMONTHDAY or BYDAY that is the day of the month of start.
+func (r *recurrenceRule) monthDays(y int, m time.Month, start time.Time, at func(int, time.Month, int) time.Time) []time.Time {
+	last := daysInMonth(y, m)
+	var days []time.Time
+	for d := 1; d <= last; d++ {
+		day := at(y, m, d)
+		match := d == start.Day()
+		if len(r.byMonthDay) > 0 || len(r.byDay) > 0 {
+			match = r.onMonthDay(d, last) && r.onWeekday(day.Weekday(), d, last)
+		}
+		if match {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// inMonths reports whether BYMONTH allows the month
+func (r *recurrenceRule) inMonths(m time.Month) bool {
+	if len(r.byMonth) == 0 {
+		return true
+	}
+	for _, month := range r.byMonth {
+		if month == m {
+			return true
+		}
+	}
+	return false
+}
+
+// onMonthDay reports whether BYMONTHDAY allows day d of a month of last days
+func (r *recurrenceRule) onMonthDay(d, last int) bool {
+	if len(r.byMonthDay) == 0 {
+		return true
+	}
+	for _, md := range r.byMonthDay {
+		if md == d || last+md+1 == d {
+			return true
+		}
+	}
+	return false
+}
+
+// onWeekday reports whether BYDAY allows day d of a month of last days, which
+// falls on weekday; numbered entries such as 2TU count within the month
+func (r *recurrenceRule) onWeekday(weekday time.Weekday, d, last int) bool {
+	if len(r.byDay) == 0 {
+		return true
+	}
+	for _, wd := range r.byDay {
+		if wd.day != weekday {
+			continue
+		}
+		switch {
+		case wd.n == 0:
+			return true
+		case wd.n > 0 && (d-1)/7+1 == wd.n:
+			return true
+		case wd.n < 0 && (last-d)/7+1 == -wd.n:
+			return true
+		}
+	}
+	return false
+}
+
+// daysInMonth returns the number of days of a month
+func daysInMonth(y int, m time.Month) int {
+	return time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// coversDay reports whether the event takes place on the calendar day of t,
+// in the location of t
+func (e CalendarEvent) coversDay(t time.Time) bool {
+	y, m, d := t.Date()
+	if e.AllDay {
+		day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		return !day.Before(e.Start) && day.Before(e.End)
+	}
+	dayStart := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	if e.End.Equal(e.Start) {
+		return !e.Start.Before(dayStart) && e.Start.Before(dayEnd)
+	}
+	return e.Start.Before(dayEnd) && e.End.After(dayStart)
+}
+
+// localSpan returns the start and end of an occurrence as instants; all-day
+// events span whole days in the server's time zone
+func (e CalendarEvent) localSpan() (time.Time, time.Time) {
+	if !e.AllDay {
+		return e.Start, e.End
+	}
+	start := time.Date(e.Start.Year(), e.Start.Month(), e.Start.Day(), 0, 0, 0, 0, time.Local)
+	end := time.Date(e.End.Year(), e.End.Month(), e.End.Day(), 0, 0, 0, 0, time.Local)
+	return start, end
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseEvents parses a calendar made of the given VEVENT bodies
+func parseEvents(t *testing.T, events ...string) []CalendarEvent {
+	t.Helper()
+	ics := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n"
+	for _, e := range events {
+		ics += "BEGIN:VEVENT\r\n" + strings.ReplaceAll(strings.TrimSpace(e), "\n", "\r\n") + "\r\nEND:VEVENT\r\n"
+	}
+	ics += "END:VCALENDAR\r\n"
+	parsed, err := parseICS(strings.NewReader(ics))
+	if err != nil {
+		t.Fatalf("parseICS: %v", err)
+	}
+	return parsed
+}
+
+func TestParseICSEvent(t *testing.T) {
+	loc := rome(t)
+	tests := []struct {
+		name      string
+		event     string
+		wantStart time.Time
+		wantEnd   time.Time
+		wantAll   bool
+	}{
+		{
+			name:      "all-day without end",
+			event:     "SUMMARY:Holiday\nDTSTART;VALUE=DATE:20260601",
+			wantStart: utc("2026-06-01T00:00:00Z"), wantEnd: utc("2026-06-02T00:00:00Z"), wantAll: true,
+		},
+		{
+			name:      "all-day over several days",
+			event:     "SUMMARY:Trip\nDTSTART;VALUE=DATE:20260601\nDTEND;VALUE=DATE:20260604",
+			wantStart: utc("2026-06-01T00:00:00Z"), wantEnd: utc("2026-06-04T00:00:00Z"), wantAll: true,
+		},
+		{
+			name:      "UTC times",
+			event:     "SUMMARY:Backup\nDTSTART:20260601T020000Z\nDTEND:20260601T043000Z",
+			wantStart: utc("2026-06-01T02:00:00Z"), wantEnd: utc("2026-06-01T04:30:00Z"),
+		},
+		{
+			name:      "TZID times",
+			event:     "SUMMARY:Backup\nDTSTART;TZID=Europe/Rome:20260601T020000\nDTEND;TZID=Europe/Rome:20260601T040000",
+			wantStart: time.Date(2026, 6, 1, 2, 0, 0, 0, loc), wantEnd: time.Date(2026, 6, 1, 4, 0, 0, 0, loc),
+		},
+		{
+			name:      "DURATION",
+			event:     "SUMMARY:Backup\nDTSTART:20260601T020000Z\nDURATION:PT2H30M",
+			wantStart: utc("2026-06-01T02:00:00Z"), wantEnd: utc("2026-06-01T04:30:00Z"),
+		},
+		{
+			name:      "DURATION in days keeps the wall-clock time across DST",
+			event:     "SUMMARY:Away\nDTSTART;TZID=Europe/Rome:20260328T120000\nDURATION:P1D",
+			wantStart: time.Date(2026, 3, 28, 12, 0, 0, 0, loc), wantEnd: time.Date(2026, 3, 29, 12, 0, 0, 0, loc),
+		},
+		{
+			name:      "folded summary and nested alarm",
+			event:     "SUMMARY:Long\n  name\nDTSTART:20260601T020000Z\nBEGIN:VALARM\nDTSTART:20990101T000000Z\nEND:VALARM",
+			wantStart: utc("2026-06-01T02:00:00Z"), wantEnd: utc("2026-06-01T02:00:00Z"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := parseEvents(t, tt.event)
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			e := events[0]
+			if !e.Start.Equal(tt.wantStart) || !e.End.Equal(tt.wantEnd) || e.AllDay != tt.wantAll {
+				t.Errorf("event = %s to %s all-day %v, want %s to %s all-day %v",
+					e.Start, e.End, e.AllDay, tt.wantStart, tt.wantEnd, tt.wantAll)
+			}
+		})
+	}
+}
+
+func TestParseICSErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   string
+		wantErr string
+	}{
+		{name: "end before start", event: "DTSTART:20260601T020000Z\nDTEND:20260601T010000Z", wantErr: "DTEND is before DTSTART"},
+		{name: "invalid date", event: "DTSTART;VALUE=DATE:2026061", wantErr: "invalid"},
+		{name: "invalid duration", event: "DTSTART:20260601T020000Z\nDURATION:2H", wantErr: "invalid duration"},
+		{name: "invalid BYDAY", event: "DTSTART:20260601T020000Z\nRRULE:FREQ=WEEKLY;BYDAY=XX", wantErr: "invalid BYDAY"},
+		{name: "invalid BYMONTH", event: "DTSTART:20260601T020000Z\nRRULE:FREQ=YEARLY;BYMONTH=13", wantErr: "invalid BYMONTH"},
+		{name: "missing FREQ", event: "DTSTART:20260601T020000Z\nRRULE:COUNT=2", wantErr: "missing FREQ"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ics := "BEGIN:VCALENDAR\nBEGIN:VEVENT\n" + tt.event + "\nEND:VEVENT\nEND:VCALENDAR\n"
+			_, err := parseICS(strings.NewReader(ics))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseICS error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseICSSkipsUnsupportedRules(t *testing.T) {
+	events := parseEvents(t,
+		"SUMMARY:Last workday\nDTSTART:20260601T020000Z\nRRULE:FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1",
+		"SUMMARY:Hourly\nDTSTART:20260601T020000Z\nRRULE:FREQ=HOURLY",
+		"SUMMARY:Backup\nDTSTART:20260601T020000Z\nRRULE:FREQ=DAILY",
+	)
+	if len(events) != 1 || events[0].Summary != "Backup" {
+		t.Fatalf("events = %+v, want only the supported one", events)
+	}
+}
+
+func TestEventOccurrences(t *testing.T) {
+	rome(t)
+	tests := []struct {
+		name  string
+		event string
+		from  time.Time
+		to    time.Time
+		want  []string // Starts, in UTC
+	}{
+		{
+			name:  "single event",
+			event: "DTSTART:20260601T020000Z\nDTEND:20260601T040000Z",
+			from:  utc("2026-06-01T00:00:00Z"), to: utc("2026-06-02T00:00:00Z"),
+			want: []string{"2026-06-01T02:00:00Z"},
+		},
+		{
+			name:  "daily with COUNT",
+			event: "DTSTART:20260601T020000Z\nRRULE:FREQ=DAILY;COUNT=3",
+			from:  utc("2026-05-01T00:00:00Z"), to: utc("2026-07-01T00:00:00Z"),
+			want: []string{"2026-06-01T02:00:00Z", "2026-06-02T02:00:00Z", "2026-06-03T02:00:00Z"},
+		},
+		{
+			name:  "daily with UNTIL and EXDATE",
+			event: "DTSTART:20260601T020000Z\nRRULE:FREQ=DAILY;UNTIL=20260604T020000Z\nEXDATE:20260602T020000Z,20260603T020000Z",
+			from:  utc("2026-05-01T00:00:00Z"), to: utc("2026-07-01T00:00:00Z"),
+			want: []string{"2026-06-01T02:00:00Z", "2026-06-04T02:00:00Z"},
+		},
+		{
+			name:  "every other week",
+			event: "DTSTART:20260601T020000Z\nRRULE:FREQ=WEEKLY;INTERVAL=2;COUNT=3",
+			from:  utc("2026-05-01T00:00:00Z"), to: utc("2026-08-01T00:00:00Z"),
+			want: []string{"2026-06-01T02:00:00Z", "2026-06-15T02:00:00Z", "2026-06-29T02:00:00Z"},
+		},
+		{
+			name:  "weekly on several days",
+			event: "DTSTART:20260603T020000Z\nRRULE:FREQ=WEEKLY;BYDAY=MO,WE,FR;COUNT=4",
+			from:  utc("2026-05-01T00:00:00Z"), to: utc("2026-08-01T00:00:00Z"),
+			// Monday 2026-06-01 is before DTSTART and does not count
+			want: []string{"2026-06-03T02:00:00Z", "2026-06-05T02:00:00Z", "2026-06-08T02:00:00Z", "2026-06-10T02:00:00Z"},
+		},
+		{
+			name:  "daily on weekdays only",
+			event: "DTSTART:20260605T020000Z\nRRULE:FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR;COUNT=3",
+			from:  utc("2026-05-01T00:00:00Z"), to: utc("2026-08-01T00:00:00Z"),
+			want: []string{"2026-06-05T02:00:00Z", "2026-06-08T02:00:00Z", "2026-06-09T02:00:00Z"},
+		},
+		{
+			name:  "monthly on the 31st skips short months",
+			event: "DTSTART:20260131T020000Z\nRRULE:FREQ=MONTHLY;COUNT=3",
+			from:  utc("2026-01-01T00:00:00Z"), to: utc("2027-01-01T00:00:00Z"),
+			want: []string{"2026-01-31T02:00:00Z", "2026-03-31T02:00:00Z", "2026-05-31T02:00:00Z"},
+		},
+		{
+			name:  "monthly on the last day",
+			event: "DTSTART:20260131T020000Z\nRRULE:FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3",
+			from:  utc("2026-01-01T00:00:00Z"), to: utc("2027-01-01T00:00:00Z"),
+			want: []string{"2026-01-31T02:00:00Z", "2026-02-28T02:00:00Z", "2026-03-31T02:00:00Z"},
+		},
+		{
+			name:  "monthly on the 1st and 15th",
+			event: "DTSTART:20260601T020000Z\nRRULE:FREQ=MONTHLY;BYMONTHDAY=1,15;COUNT=3",
+			from:  utc("2026-01-01T00:00:00Z"), to: utc("2027-01-01T00:00:00Z"),
+			want: []string{"2026-06-01T02:00:00Z", "2026-06-15T02:00:00Z", "2026-07-01T02:00:00Z"},
+		},
+		{
+			name:  "monthly on the first Monday and last Friday",
+			event: "DTSTART:20260601T020000Z\nRRULE:FREQ=MONTHLY;BYDAY=1MO,-1FR;COUNT=4",
+			from:  utc("2026-01-01T00:00:00Z"), to: utc("2027-01-01T00:00:00Z"),
+			want: []string{"2026-06-01T02:00:00Z", "2026-06-26T02:00:00Z", "2026-07-06T02:00:00Z", "2026-07-31T02:00:00Z"},
+		},
+		{
+			name:  "monthly on Friday the 13th",
+			event: "DTSTART:20260313T020000Z\nRRULE:FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13;COUNT=2",
+			from:  utc("2026-01-01T00:00:00Z"), to: utc("2028-01-01T00:00:00Z"),
+			want: []string{"2026-03-13T02:00:00Z", "2026-11-13T02:00:00Z"},
+		},
+		{
+			name:  "monthly in summer only",
+			event: "DTSTART:20260610T020000Z\nRRULE:FREQ=MONTHLY;BYMONTH=6,7;COUNT=3",
+			from:  utc("2026-01-01T00:00:00Z"), to: utc("2028-01-01T00:00:00Z"),
+			want: []string{"2026-06-10T02:00:00Z", "2026-07-10T02:00:00Z", "2027-06-10T02:00:00Z"},
+		},
+		{
+			name:  "yearly on the last Sunday of March and October",
+			event: "DTSTART:20260329T020000Z\nRRULE:FREQ=YEARLY;BYMONTH=3,10;BYDAY=-1SU;COUNT=3",
+			from:  utc("2026-01-01T00:00:00Z"), to: utc("2028-01-01T00:00:00Z"),
+			want: []string{"2026-03-29T02:00:00Z", "2026-10-25T02:00:00Z", "2027-03-28T02:00:00Z"},
+		},
+		{
+			name:  "yearly on February 29th",
+			event: "DTSTART:20280229T020000Z\nRRULE:FREQ=YEARLY;COUNT=2",
+			from:  utc("2028-01-01T00:00:00Z"), to: utc("2033-01-01T00:00:00Z"),
+			want: []string{"2028-02-29T02:00:00Z", "2032-02-29T02:00:00Z"},
+		},
+		{
+			name:  "only occurrences in range",
+			event: "DTSTART:20260601T020000Z\nDTEND:20260601T040000Z\nRRULE:FREQ=DAILY",
+			from:  utc("2026-06-10T03:00:00Z"), to: utc("2026-06-12T00:00:00Z"),
+			want: []string{"2026-06-10T02:00:00Z", "2026-06-11T02:00:00Z"},
+		},
+		{
+			name:  "all-day weekly",
+			event: "DTSTART;VALUE=DATE:20260606\nDTEND;VALUE=DATE:20260608\nRRULE:FREQ=WEEKLY;COUNT=2",
+			from:  utc("2026-06-01T00:00:00Z"), to: utc("2026-07-01T00:00:00Z"),
+			want: []string{"2026-06-06T00:00:00Z", "2026-06-13T00:00:00Z"},
+		},
+		{
+			name:  "TZID keeps the wall-clock time across DST",
+			event: "DTSTART;TZID=Europe/Rome:20260327T020000\nRRULE:FREQ=DAILY;COUNT=3\nEXDATE;TZID=Europe/Rome:20260328T020000",
+			from:  utc("2026-03-01T00:00:00Z"), to: utc("2026-04-01T00:00:00Z"),
+			// 02:00 does not exist on March 29 and becomes 03:00 CEST
+			want: []string{"2026-03-27T01:00:00Z", "2026-03-29T01:00:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := parseEvents(t, "SUMMARY:"+tt.name+"\n"+tt.event)
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			got := events[0].occurrences(tt.from, tt.to)
+			var starts []string
+			for _, o := range got {
+				starts = append(starts, o.Start.UTC().Format(time.RFC3339))
+			}
+			if strings.Join(starts, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("occurrences = %v, want %v", starts, tt.want)
+			}
+			for _, o := range got {
+				if o.End.Sub(o.Start) != events[0].End.Sub(events[0].Start) && !o.AllDay {
+					t.Errorf("occurrence %s lasts %s, want %s", o.Start, o.End.Sub(o.Start), events[0].End.Sub(events[0].Start))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// IdleConfig lists the checks telling whether a target is busy. Windows with
+// the idle shutdown mode power the target off once none of them has reported
+// anything for the idle timeout.
+type IdleConfig struct {
+	Ports         []int    `yaml:"ports" json:"ports,omitempty"`                 // Established TCP connections to one of these local ports (ss)
+	Sessions      bool     `yaml:"sessions" json:"sessions"`                     // Someone is logged in (who)
+	MaxLoad       float64  `yaml:"maxLoad" json:"maxLoad,omitempty"`             // The 1-minute load average is above this, 0 disables
+	Commands      []string `yaml:"commands" json:"commands,omitempty"`           // One of these commands exits non-zero
+	Timeout       string   `yaml:"timeout" json:"timeout,omitempty"`             // Go duration the target has to be idle for
+	CheckInterval string   `yaml:"checkInterval" json:"checkInterval,omitempty"` // Go duration between two checks
+}
+
+// Defaults of the idle shutdown
+const (
+	defaultIdleTimeout       = 30 * time.Minute
+	defaultIdleCheckInterval = time.Minute
+)
+
+// Enabled reports whether any check is configured
+func (c IdleConfig) Enabled() bool {
+	return len(c.Ports) > 0 || c.Sessions || c.MaxLoad > 0 || len(c.Commands) > 0
+}
+
+// timeout returns how long the target has to be idle before it is shut down
+func (c IdleConfig) timeout() time.Duration {
+	d, err := time.ParseDuration(c.Timeout)
+	if err != nil || d <= 0 {
+		return defaultIdleTimeout
+	}
+	return d
+}
+
+// checkInterval returns the time between two idle checks
+func (c IdleConfig) checkInterval() time.Duration {
+	d, err := time.ParseDuration(c.CheckInterval)
+	if err != nil || d <= 0 {
+		return defaultIdleCheckInterval
+	}
+	return d
+}
+
+// script returns the shell script run on the target. It prints one line per
+// activity found and nothing if the target is idle.
+func (c IdleConfig) script() string {
+	var lines []string
+	for _, port := range c.Ports {
+		lines = append(lines, fmt.Sprintf(`ss -Htn state established '( sport = :%d )' | grep -q . && echo 'connections on port %d'`, port, port))
+	}
+	if c.Sessions {
+		lines = append(lines, sessionCheck)
+	}
+	if c.MaxLoad > 0 {
+		lines = append(lines, loadCheck(c.MaxLoad))
+	}
+	for _, command := range c.Commands {
+		lines = append(lines, commandCheck(command))
+	}
+	return checkScript(lines)
+}
+
+// validateIdle checks the idle configuration of a target
+func validateIdle(c IdleConfig) []string {
+	var problems []string
+	for i, port := range c.Ports {
+		if port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("ports[%d]: must be between 1 and 65535, got %d", i, port))
+		}
+	}
+	if c.MaxLoad < 0 {
+		problems = append(problems, fmt.Sprintf("maxLoad: must not be negative, got %g", c.MaxLoad))
+	}
+	for i, command := range c.Commands {
+		if strings.TrimSpace(command) == "" {
+			problems = append(problems, fmt.Sprintf("commands[%d]: must not be empty", i))
+		}
+	}
+	if c.Timeout != "" {
+		if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("timeout: invalid duration %q", c.Timeout))
+		}
+	}
+	if c.CheckInterval != "" {
+		if d, err := time.ParseDuration(c.CheckInterval); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("checkInterval: invalid duration %q", c.CheckInterval))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LeaseConfig sets where keep-awake leases are kept and how long they may last
+type LeaseConfig struct {
+	File   string `yaml:"file" json:"file"`
+	MaxTTL string `yaml:"maxTTL" json:"maxTTL"` // Go duration, the longest a lease may be acquired or renewed for
+}
+
+// Lease keeps the server from being shut down until it expires or is
+// released. Times are RFC3339.
+type Lease struct {
+	Name     string `json:"name"`
+	Reason   string `json:"reason,omitempty"`
+	TTL      string `json:"ttl"` // Duration a renewal extends the lease by
+	Acquired string `json:"acquired"`
+	Renewed  string `json:"renewed,omitempty"`
+	Expires  string `json:"expires"`
+}
+
+// Description summarizes the lease for logs, the UI and safety check reasons
+func (l Lease) Description() string {
+	description := fmt.Sprintf("lease %q held until %s", l.Name, l.Expires)
+	if l.Reason != "" {
+		description += ": " + l.Reason
+	}
+	return description
+}
+
+// activeAt reports whether the lease has not expired at now
+func (l Lease) activeAt(now time.Time) bool {
+	expires, err := time.Parse(time.RFC3339, l.Expires)
+	return err == nil && now.Before(expires)
+}
+
+// LeaseStore keeps the keep-awake leases and persists them, so a restart of
+// wol-server does not drop them
+type LeaseStore struct {
+	mu     sync.RWMutex
+	path   string
+	leases []Lease
+}
+
+var leaseStore = NewLeaseStore("leases.json")
+
+// NewLeaseStore creates a store backed by the file at path. With an empty
+// path the leases are only kept in memory.
+func NewLeaseStore(path string) *LeaseStore {
+	return &LeaseStore{path: path}
+}
+
+// Load reads the leases from disk, a missing file means no leases
+func (s *LeaseStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.leases = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read leases file: %v", err)
+	}
+
+	var leases []Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("failed to parse leases %s: %v", s.path, err)
+	}
+	s.leases = leases
+	return nil
+}
+
+// Active returns the leases that have not expired at now, soonest to expire first
+func (s *LeaseStore) Active(now time.Time) []Lease {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var active []Lease
+	for _, lease := range s.leases {
+		if lease.activeAt(now) {
+			active = append(active, lease)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Expires < active[j].Expires })
+	return active
+}
+
+// Held reports whether any lease is active at now
+func (s *LeaseStore) Held(now time.Time) bool {
+	return len(s.Active(now)) > 0
+}
+
+// Reasons describes the active leases, nil if none is held
+func (s *LeaseStore) Reasons(now time.Time) []string {
+	var reasons []string
+	for _, lease := range s.Active(now) {
+		reasons = append(reasons, lease.Description())
+	}
+	return reasons
+}
+
+// Acquire takes the lease of that name for ttl, or extends it if it is already
+// held. A zero ttl renews with the TTL the lease was acquired with. With
+// renewOnly an expired or unknown lease is an error instead of being acquired.
+func (s *LeaseStore) Acquire(name, reason string, ttl time.Duration, renewOnly bool, now time.Time) (Lease, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropExpiredLocked(now)
+
+	var lease *Lease
+	for i := range s.leases {
+		if s.leases[i].Name == name {
+			lease = &s.leases[i]
+		}
+	}
+	renewed := lease != nil
+	switch {
+	case lease == nil && renewOnly:
+		return Lease{}, false, fmt.Errorf("no active lease named %q", name)
+	case lease == nil && ttl == 0:
+		return Lease{}, false, fmt.Errorf("a TTL is required to acquire lease %q", name)
+	case lease == nil:
+		s.leases = append(s.leases, Lease{Name: name, Acquired: now.Format(time.RFC3339)})
+		lease = &s.leases[len(s.leases)-1]
+	default:
+		lease.Renewed = now.Format(time.RFC3339)
+	}
+
+	if ttl == 0 {
+		ttl, _ = time.ParseDuration(lease.TTL)
+	}
+	lease.TTL = ttl.String()
+	lease.Expires = now.Add(ttl).Format(time.RFC3339)
+	if reason != "" {
+		lease.Reason = reason
+	}
+
+	acquired := *lease
+	return acquired, renewed, s.saveLocked()
+}
+
+// Release drops the lease of that name and returns it, or nil if it was not held
+func (s *LeaseStore) Release(name string, now time.Time) (*Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropExpiredLocked(now)
+
+	var released *Lease
+	var kept []Lease
+	for _, lease := range s.leases {
+		if lease.Name == name {
+			lease := lease
+			released = &lease
+			continue
+		}
+		kept = append(kept, lease)
+	}
+	if released == nil {
+		return nil, nil
+	}
+	s.leases = kept
+	return released, s.saveLocked()
+}
+
+// dropExpiredLocked forgets the expired leases; the caller must hold the lock
+func (s *LeaseStore) dropExpiredLocked(now time.Time) {
+	var kept []Lease
+	for _, lease := range s.leases {
+		if lease.activeAt(now) {
+			kept = append(kept, lease)
+		}
+	}
+	s.leases = kept
+}
+
+// saveLocked writes the leases to disk; the caller must hold the lock
+func (s *LeaseStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	leases := s.leases
+	if leases == nil {
+		leases = []Lease{}
+	}
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal leases: %v", err)
+	}
+	if err := writeFileAtomic(s.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save leases: %v", err)
+	}
+	return nil
+}
+
+// parseLeaseTTL reads the TTL of a lease request; empty means the TTL the
+// lease was acquired with
+func parseLeaseTTL(value string, max time.Duration) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TTL %q, use a duration such as 2h", value)
+	}
+	if ttl <= 0 || ttl > max {
+		return 0, fmt.Errorf("TTL must be between 0 and %s, got %s", max, ttl)
+	}
+	return ttl, nil
+}
+
+// Load the keep-awake leases from file
+func loadLeases(path string) error {
+	leaseStore = NewLeaseStore(path)
+	return leaseStore.Load()
+}
@@ -1,92 +1,138 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
-
-	"github.com/joho/godotenv"
-)
-
-// Default values
-var (
-	serverName      = "server"            // Server to ping
-	serverUser      = "root"              // SSH username
-	macAddress      = "aa:aa:aa:aa:aa:aa" // MAC address of the server
-	port            = "8080"              // Port to listen on
-	refreshInterval = 60                  // UI refresh interval in seconds
 )
 
-func loadEnvVariables() {
-	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found, using default values")
+func main() {
+	// The first argument selects the subcommand; without one we run the web server
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
 	}
 
-	// Override defaults with environment variables if they exist
-	if envServerName := os.Getenv("SERVER_NAME"); envServerName != "" {
-		serverName = envServerName
+	switch command {
+	case "serve":
+		runServe()
+	case "ctl":
+		// The ctl subcommand talks to an already running wol-server over HTTP
+		os.Exit(runCtl(args))
+	case "wake":
+		os.Exit(runWakeCommand(args))
+	case "shutdown":
+		os.Exit(runShutdownCommand(args))
+	case "probe":
+		os.Exit(runProbeCommand(args))
+	case "check-config":
+		os.Exit(runCheckConfigCommand(args))
+	case "help":
+		fmt.Print(mainUsage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		fmt.Fprint(os.Stderr, mainUsage)
+		os.Exit(exitUsage)
 	}
+}
 
-	if envServerUser := os.Getenv("SERVER_USER"); envServerUser != "" {
-		serverUser = envServerUser
-	}
+// Start the web interface and the schedule checker
+func runServe() {
+	// Load environment variables
+	loadEnvVariables()
 
-	if envMacAddress := os.Getenv("MAC_ADDRESS"); envMacAddress != "" {
-		macAddress = envMacAddress
+	// Setup template
+	if err := setupTemplate(); err != nil {
+		log.Fatalf("Failed to setup template: %v", err)
 	}
 
-	if envPort := os.Getenv("PORT"); envPort != "" {
-		port = envPort
+	// Load schedule config
+	if err := loadScheduleConfig(); err != nil {
+		log.Printf("Warning: Failed to load schedule config: %v", err)
+		// Continue with default (empty) schedule config
 	}
 
-	// Load refresh interval if set
-	if envRefresh := os.Getenv("REFRESH_INTERVAL"); envRefresh != "" {
-		if val, err := strconv.Atoi(envRefresh); err == nil && val > 0 {
-			refreshInterval = val
-		}
+	// Load the blackout and events calendars
+	if cal, err := loadCalendars(currentConfig()); err != nil {
+		log.Printf("Warning: Failed to load calendars: %v", err)
+		// Continue without calendars until the file is fixed and reloaded
+	} else {
+		applyCalendars(cal)
+		log.Printf("Loaded calendars: %d blackout event(s), %d event(s)", len(cal.Blackout), len(cal.Events))
 	}
 
-	log.Printf("Configuration loaded: SERVER_NAME=%s, SERVER_USER=%s, MAC_ADDRESS=%s, PORT=%s, REFRESH=%d",
-		serverName, serverUser, macAddress, port, refreshInterval)
-}
-
-func main() {
-	// Load environment variables
-	loadEnvVariables()
+	// Load the run history of the schedule windows
+	if err := loadHistory(currentConfig().Schedule.History); err != nil {
+		log.Printf("Warning: Failed to load run history: %v", err)
+		// Continue with an empty history, it is rewritten on the next run
+	}
 
-	// Setup template
-	if err := setupTemplate(); err != nil {
-		log.Fatalf("Failed to setup template: %v", err)
+	// Load the keep-awake leases
+	if err := loadLeases(currentConfig().Leases.File); err != nil {
+		log.Printf("Warning: Failed to load leases: %v", err)
+		// Continue without leases, they are rewritten on the next change
 	}
 
+	// Check for required system tools
+	checkRequiredTools()
+
 	// Verify schedule configuration and clean up stale schedule data if needed
 	verifyScheduleConfig()
 
 	// Setup a ticker to check schedule and perform actions
 	go runScheduleChecker()
 
+	// Reload configuration on SIGHUP or when the files change
+	go watchConfiguration()
+
+	// Forward the proxy ports, waking the server when a client connects
+	startProxies(currentConfig().Proxy)
+
 	// Register route handlers
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/boot", bootHandler)
 	http.HandleFunc("/confirm-shutdown", confirmShutdownHandler)
 	// Password is now taken directly from .env file
 	http.HandleFunc("/shutdown", shutdownHandler)
+	http.HandleFunc("/cancel-shutdown", cancelShutdownHandler)
+	http.HandleFunc("/group", groupHandler)
+	http.HandleFunc("/maintenance", maintenanceHandler)
 
 	// Schedule API endpoints
 	http.HandleFunc("/api/schedule", scheduleHandler)
+	http.HandleFunc("/api/schedule/preview", schedulePreviewHandler)
+	http.HandleFunc("/api/schedule/overrides", overridesHandler)
+	http.HandleFunc("/api/schedule/simulate", simulateHandler)
+	http.HandleFunc("/api/history", historyHandler)
+	http.HandleFunc("/api/calendar/preview", calendarPreviewHandler)
 	// API shutdown endpoint
 	http.HandleFunc("/api/shutdown", apiShutdownHandler)
+	http.HandleFunc("/api/shutdown/pending", apiPendingShutdownHandler)
+	// API power actions (shutdown, reboot, suspend, hibernate)
+	http.HandleFunc("/api/actions", apiActionsHandler)
+	// API status and wake endpoints (used by the ctl subcommand)
+	http.HandleFunc("/api/status", apiStatusHandler)
+	http.HandleFunc("/api/wake", apiWakeHandler)
+	// Keep-awake leases blocking shutdowns
+	http.HandleFunc("/api/leases", apiLeasesHandler)
+	// Groups woken and shut down in dependency order
+	http.HandleFunc("/api/groups", apiGroupsHandler)
+	// Maintenance mode suspending the automatic power actions
+	http.HandleFunc("/api/maintenance", apiMaintenanceHandler)
+	// Effective configuration with secrets masked
+	http.HandleFunc("/api/admin/config", requireAPIToken(adminConfigHandler))
 
 	// Start the server
-	listenAddr := fmt.Sprintf(":%s", port)
+	listenAddr := fmt.Sprintf(":%d", currentConfig().Server.Port)
 	log.Printf("Starting WOL Server on http://localhost%s", listenAddr)
 
 	if runtime.GOOS == "darwin" {
@@ -98,7 +144,9 @@ func main() {
 	}
 }
 
-// API Shutdown handler - shuts down the server with password from environment
+// API Shutdown handler - shuts down the server with password from environment.
+// {"force": true} or ?force=true shuts down even if the safety checks fail,
+// {"delay": "5m", "wall": true} starts a countdown and warns logged-in users.
 func apiShutdownHandler(w http.ResponseWriter, r *http.Request) {
 	// Add cache control headers to prevent caching
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -117,8 +165,134 @@ func apiShutdownHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if shutdown password is available in environment
-	if shutdownPassword == "" {
+	// The body is optional
+	var req actionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Failed to parse request body: %v", err),
+		})
+		return
+	}
+	req.Action = actionShutdown
+	req.Force = req.Force || r.URL.Query().Get("force") == "true"
+
+	performAPIAction(w, req)
+}
+
+// actionRequest is the body of the shutdown and power action endpoints
+type actionRequest struct {
+	Action string `json:"action"`
+	Force  bool   `json:"force"` // Run even if the safety checks fail
+	Delay  string `json:"delay"` // Countdown before the action runs, e.g. "5m"
+	Wall   bool   `json:"wall"`  // Warn the users logged in on the target about the countdown
+}
+
+// API pending shutdown handler - GET returns the delayed shutdown waiting for
+// its countdown, DELETE cancels it
+func apiPendingShutdownHandler(w http.ResponseWriter, r *http.Request) {
+	// Add cache control headers to prevent caching
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		response := map[string]interface{}{"success": true, "pending": nil}
+		if pending := countdown.Pending(); pending != nil {
+			response["pending"] = pending
+			response["remaining"] = pending.Remaining(clock.Now()).Round(time.Second).String()
+		}
+		json.NewEncoder(w).Encode(response)
+	case "DELETE":
+		cancelled := countdown.Cancel()
+		if cancelled == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "No delayed shutdown is pending",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"message":   fmt.Sprintf("Delayed %s cancelled", cancelled.Action),
+			"cancelled": cancelled,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Method not allowed. Use GET or DELETE.",
+		})
+	}
+}
+
+// API Actions handler - GET lists the power actions of the server, POST with
+// {"action": "reboot"} runs one with the password from environment, adding
+// "force": true runs it even if the safety checks fail and "delay" starts a
+// countdown like for /api/shutdown
+func apiActionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Add cache control headers to prevent caching
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"actions": currentTarget().ActionNames(),
+		})
+	case "POST":
+		var req actionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to parse request body: %v", err),
+			})
+			return
+		}
+		if _, ok := currentTarget().Action(req.Action); !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Action %q is not configured, available: %s", req.Action, strings.Join(currentTarget().ActionNames(), ", ")),
+			})
+			return
+		}
+		req.Force = req.Force || r.URL.Query().Get("force") == "true"
+		performAPIAction(w, req)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Method not allowed. Use GET or POST.",
+		})
+	}
+}
+
+// performAPIAction runs a power action on the online server, or starts its
+// countdown, and writes the JSON result. Unless force is set, failed safety
+// checks refuse the action.
+func performAPIAction(w http.ResponseWriter, req actionRequest) {
+	action := req.Action
+	delay, err := parseShutdownDelay(req.Delay)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	// Check if shutdown password is available in environment, when the action needs it
+	if currentConfig().passwordMissing("", action) {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
@@ -138,26 +312,550 @@ func apiShutdownHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Try to shut down the server using the password from environment
-	err := shutdownServer(shutdownPassword)
+	if !req.Force {
+		if reasons := checkGuards(); len(reasons) > 0 {
+			log.Printf("API %s refused by the safety checks: %s", action, strings.Join(reasons, "; "))
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Safety checks failed, force to %s anyway: %s", action, strings.Join(reasons, "; ")),
+				"reasons": reasons,
+			})
+			return
+		}
+	}
+
+	if delay > 0 {
+		pending, err := countdown.Start(action, delay, req.Wall, req.Force)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to schedule %s: %v", action, err),
+			})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": fmt.Sprintf("Server %s scheduled at %s", action, pending.At),
+			"pending": pending,
+		})
+		return
+	}
+
+	// Try to run the action using the password from environment
+	err = runPowerAction(action, currentConfig().Auth.ShutdownPassword)
 	if err != nil {
-		// Shutdown command failed
+		// Action command failed
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"success": false,
-			"error":   "Failed to shutdown server: " + err.Error(),
+			"error":   fmt.Sprintf("Failed to %s server: %v", action, err),
 		})
-		log.Printf("API shutdown failed: %v", err)
+		log.Printf("API %s failed: %v", action, err)
 		return
 	}
 
-	// Shutdown initiated successfully
+	// Action initiated successfully
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
-		"message": "Server shutdown initiated",
+		"message": fmt.Sprintf("Server %s initiated", action),
+	})
+	log.Printf("API %s successful", action)
+}
+
+// API Status handler - reports whether the server is reachable
+func apiStatusHandler(w http.ResponseWriter, r *http.Request) {
+	// Add cache control headers to prevent caching
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Method not allowed. Use GET.",
+		})
+		return
+	}
+
+	online := isServerOnline()
+	status := "Online"
+	if !online {
+		status = "Offline"
+	}
+
+	response := map[string]interface{}{
+		"success":     true,
+		"server":      currentTarget().Host,
+		"online":      online,
+		"status":      status,
+		"driver":      currentTarget().DriverName(),
+		"lastUpdated": clock.Now().Format(time.RFC3339),
+	}
+	if state := powerState(); state != "" {
+		response["powerState"] = state
+	}
+	if pending := countdown.Pending(); pending != nil {
+		response["pendingShutdown"] = pending
+	}
+	if statuses := proxyStatuses(); len(statuses) > 0 {
+		response["proxies"] = statuses
+	}
+	if leases := leaseStore.Active(clock.Now()); len(leases) > 0 {
+		response["leases"] = leases
+	}
+	if maintenance := GetScheduleConfig().maintenanceAt(clock.Now()); maintenance != nil {
+		response["maintenance"] = maintenance
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// API Wake handler - runs the wake workflow. POST starts it and answers once the
+// first packet is sent, or when the server is online with {"wait": true} or
+// ?wait=true; GET returns the result of the last wake.
+func apiWakeHandler(w http.ResponseWriter, r *http.Request) {
+	// Add cache control headers to prevent caching
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "GET" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"wake":    wakes.Last(),
+		})
+		return
+	}
+
+	// Only allow POST requests
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Method not allowed. Use POST.",
+		})
+		return
+	}
+
+	// The body is optional
+	var req struct {
+		Wait bool `json:"wait"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   fmt.Sprintf("Failed to parse request body: %v", err),
+		})
+		return
+	}
+	wait := req.Wait || r.URL.Query().Get("wait") == "true"
+
+	workflow := newWakeWorkflow(clock, power, currentConfig())
+	var result WakeResult
+	if wait {
+		result = wakes.run(workflow, wakeSourceAPI, nil)
+	} else {
+		result = wakes.start(workflow, wakeSourceAPI)
+	}
+
+	status, message := http.StatusOK, result.Summary()
+	switch {
+	case result.Outcome == wakeAlreadyOnline:
+		message = "Server is already online"
+	case result.Outcome == wakeFailed || (result.Outcome == wakePending && result.Packets == 0):
+		status = http.StatusInternalServerError
+		message = "Failed to send Wake-on-LAN packet: " + result.Error
+	case result.Outcome == wakeTimedOut:
+		status = http.StatusGatewayTimeout
+	case result.Outcome == wakePending:
+		message = "Wake-on-LAN packet sent"
+	}
+
+	w.WriteHeader(status)
+	response := map[string]interface{}{
+		"success": status == http.StatusOK,
+		"wake":    result,
+	}
+	if status == http.StatusOK {
+		response["message"] = message
+	} else {
+		response["error"] = message
+	}
+	json.NewEncoder(w).Encode(response)
+	log.Printf("API wake: %s", message)
+}
+
+// API Leases handler - GET lists the active keep-awake leases, POST with
+// {"name": "ci", "ttl": "2h"} acquires or renews one, adding "renew": true only
+// renews a held lease and "wake": true wakes the server if it is offline and
+// maintenance mode is off.
+// DELETE ?name=ci releases it.
+func apiLeasesHandler(w http.ResponseWriter, r *http.Request) {
+	// Add cache control headers to prevent caching
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		leases := leaseStore.Active(clock.Now())
+		if leases == nil {
+			leases = []Lease{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"leases":  leases,
+		})
+	case "POST":
+		var req struct {
+			Name   string `json:"name"`
+			TTL    string `json:"ttl"`
+			Reason string `json:"reason"`
+			Renew  bool   `json:"renew"`
+			Wake   bool   `json:"wake"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to parse request body: %v", err),
+			})
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		ttl, err := parseLeaseTTL(req.TTL, currentConfig().LeaseMaxTTL())
+		if err == nil && req.Name == "" {
+			err = fmt.Errorf("a lease name is required")
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		verb := "acquire"
+		if req.Renew {
+			verb = "renew"
+		}
+		lease, renewed, err := leaseStore.Acquire(req.Name, req.Reason, ttl, req.Renew, clock.Now())
+		if err != nil {
+			status := http.StatusBadRequest
+			switch {
+			case lease.Name != "":
+				// The lease is held, only saving it failed
+				status = http.StatusInternalServerError
+			case req.Renew:
+				status = http.StatusNotFound
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to %s lease: %v", verb, err),
+			})
+			return
+		}
+
+		message := fmt.Sprintf("Lease %q acquired until %s", lease.Name, lease.Expires)
+		if renewed {
+			message = fmt.Sprintf("Lease %q renewed until %s", lease.Name, lease.Expires)
+		}
+		log.Printf("API leases: %s", message)
+		response := map[string]interface{}{
+			"success": true,
+			"message": message,
+			"lease":   lease,
+		}
+		if req.Wake && inMaintenance() {
+			response["message"] = message + ", not waking the server in maintenance mode"
+		} else if req.Wake && !isServerOnline() {
+			result := wakes.start(newWakeWorkflow(clock, power, currentConfig()), wakeSourceLease)
+			response["wake"] = result
+			if result.Outcome == wakeFailed {
+				log.Printf("API leases: failed to wake the server for lease %q: %s", lease.Name, result.Error)
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		released, err := leaseStore.Release(name, clock.Now())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to release lease: %v", err),
+			})
+			return
+		}
+		if released == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("No active lease named %q", name),
+			})
+			return
+		}
+		log.Printf("API leases: lease %q released", released.Name)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"message":  fmt.Sprintf("Lease %q released", released.Name),
+			"released": released,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Method not allowed. Use GET, POST or DELETE.",
+		})
+	}
+}
+
+// API Groups handler - GET lists the groups with their members in wake order
+// and the last run; POST with {"group": "lab", "action": "wake"} or "shutdown"
+// starts a run, adding "wait": true answers once it is over and "force": true
+// skips the safety checks of the members.
+func apiGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	// Add cache control headers to prevent caching
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		groups := groupStatuses()
+		if groups == nil {
+			groups = []GroupStatus{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"groups":  groups,
+		})
+	case "POST":
+		var req struct {
+			Group  string `json:"group"`
+			Action string `json:"action"`
+			Force  bool   `json:"force"`
+			Wait   bool   `json:"wait"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to parse request body: %v", err),
+			})
+			return
+		}
+		group, ok := currentConfig().Group(req.Group)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Unknown group %q", req.Group),
+			})
+			return
+		}
+		if req.Action != groupActionWake && req.Action != groupActionShutdown {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Invalid action %q, use %q or %q", req.Action, groupActionWake, groupActionShutdown),
+			})
+			return
+		}
+		if req.Action == groupActionShutdown && currentConfig().groupPasswordMissing(group) {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "SHUTDOWN_PASSWORD not set in environment",
+			})
+			return
+		}
+
+		result, err := runGroup(group, req.Action, wakeSourceAPI, req.Force, req.Wait)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+
+		status := http.StatusOK
+		switch {
+		case result.Outcome == groupOutcomeRunning:
+		case result.Blocked():
+			status = http.StatusConflict
+		case !result.Success:
+			status = http.StatusInternalServerError
+		}
+		w.WriteHeader(status)
+		response := map[string]interface{}{
+			"success": status == http.StatusOK,
+			"run":     result,
+		}
+		message := result.Summary()
+		if result.Outcome == groupOutcomeRunning {
+			message = fmt.Sprintf("Group %s %s started", group.Name, req.Action)
+		}
+		if status == http.StatusOK {
+			response["message"] = message
+		} else {
+			response["error"] = message
+		}
+		json.NewEncoder(w).Encode(response)
+		log.Printf("API groups: %s", message)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Method not allowed. Use GET or POST.",
+		})
+	}
+}
+
+// API Maintenance handler - GET reports whether maintenance mode is on, POST
+// with {"for": "2h"} or {"until": "2026-10-20T18:00"} and an optional "reason"
+// turns it on, without either until it is turned off. DELETE turns it off.
+func apiMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	// Add cache control headers to prevent caching
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Expires", "0")
+	w.Header().Set("Content-Type", "application/json")
+
+	now := clock.Now()
+	switch r.Method {
+	case "GET":
+		maintenance := GetScheduleConfig().maintenanceAt(now)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"enabled":     maintenance != nil,
+			"maintenance": maintenance,
+		})
+	case "POST":
+		// The body is optional
+		var req struct {
+			For    string `json:"for"`
+			Until  string `json:"until"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to parse request body: %v", err),
+			})
+			return
+		}
+		end, err := parseMaintenanceEnd(req.For, req.Until, now)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+			})
+			return
+		}
+		maintenance, err := startMaintenance(end, req.Reason, now)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to turn maintenance mode on: %v", err),
+			})
+			return
+		}
+		log.Printf("API maintenance: %s", maintenance.Description())
+		message := "Maintenance mode on until turned off, automatic power actions are suspended"
+		if maintenance.Until != "" {
+			message = fmt.Sprintf("Maintenance mode on until %s, automatic power actions are suspended", maintenance.Until)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"message":     message,
+			"enabled":     true,
+			"maintenance": maintenance,
+		})
+	case "DELETE":
+		stopped, err := stopMaintenance(now)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   fmt.Sprintf("Failed to turn maintenance mode off: %v", err),
+			})
+			return
+		}
+		message := "Maintenance mode was not on"
+		if stopped != nil {
+			message = "Maintenance mode off, automatic power actions resume"
+			log.Printf("API maintenance: turned off")
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": message,
+			"enabled": false,
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Method not allowed. Use GET, POST or DELETE.",
+		})
+	}
+}
+
+// requireAPIToken protects a handler with the auth.apiToken bearer token, if one is configured
+func requireAPIToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().Auth.APIToken
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   "Missing or invalid API token",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Admin config handler - shows the effective configuration with secrets masked
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Method not allowed. Use GET.",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"configFile": configPath,
+		"config":     currentConfig().Masked(),
+		"lastReload": getLastReload(),
 	})
-	log.Printf("API shutdown successful")
 }
 
 // Handle schedule API requests
@@ -185,79 +883,67 @@ func scheduleHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Validate the schedule data
-		if newConfig.Enabled {
-			// Validate time format (HH:MM)
-			_, err = time.Parse("15:04", newConfig.StartTime)
-			if err != nil {
-				http.Error(w, `{"error": "Invalid start time format. Use 24-hour format (HH:MM)"}`, http.StatusBadRequest)
-				return
-			}
-
-			_, err = time.Parse("15:04", newConfig.EndTime)
-			if err != nil {
-				http.Error(w, `{"error": "Invalid end time format. Use 24-hour format (HH:MM)"}`, http.StatusBadRequest)
-				return
-			}
+		// Accept the old startTime/endTime/frequency format from existing clients
+		if _, err := migrateLegacySchedule(&newConfig); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
 
-			// Validate frequency
-			validFrequencies := map[string]bool{
-				"daily":      true,
-				"every2days": true,
-				"weekly":     true,
-				"monthly":    true,
-			}
+		if newConfig.Windows == nil {
+			newConfig.Windows = []ScheduleWindow{}
+		}
 
-			if !validFrequencies[newConfig.Frequency] {
-				http.Error(w, `{"error": "Invalid frequency. Use 'daily', 'every2days', 'weekly', or 'monthly'"}`, http.StatusBadRequest)
-				return
-			}
+		// Validate the schedule data
+		if err := validateScheduleConfig(newConfig, currentConfig()); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
 
-			// Reset lastRun if it wasn't set
-			if newConfig.LastRun == "" {
-				newConfig.LastRun = ""
+		// If auto shutdown is enabled over SSH, make sure we have a password in env
+		autoShutdown := false
+		for _, window := range newConfig.Windows {
+			if !window.Enabled || !window.AutoShutdown {
+				continue
 			}
-
-			// If auto shutdown is enabled, make sure we have a password in env
-			if newConfig.AutoShutdown && shutdownPassword == "" {
+			if currentConfig().windowPasswordMissing(window) {
 				http.Error(w, `{"error": "SHUTDOWN_PASSWORD not set in environment. Please set it before enabling auto-shutdown"}`, http.StatusBadRequest)
 				return
 			}
+			autoShutdown = autoShutdown || (window.Group == "" && currentTarget().NeedsPassword(actionShutdown))
+		}
 
-			// Check if SSH connection can be established with the password
-			if newConfig.AutoShutdown && shutdownPassword != "" {
-				log.Printf("Testing SSH connection to %s with provided password", serverName)
+		// Check if SSH connection can be established with the password
+		if autoShutdown {
+			log.Printf("Testing SSH connection to %s with provided password", currentTarget().Host)
 
-				// We'll just check if the server is reachable first
-				if !isServerOnline() {
-					log.Printf("Server %s is not online, can't test SSH connection", serverName)
+			// We'll just check if the server is reachable first
+			if !isServerOnline() {
+				log.Printf("Server %s is not online, can't test SSH connection", currentTarget().Host)
+			} else {
+				// Try to run a harmless command to test SSH connection
+				_, stderr, err := runner.Run("", "sshpass", "-p", currentConfig().Auth.ShutdownPassword, "ssh",
+					"-o", "StrictHostKeyChecking=no",
+					"-o", "UserKnownHostsFile=/dev/null",
+					"-o", "LogLevel=ERROR",
+					"-o", "ConnectTimeout=5",
+					fmt.Sprintf("%s@%s", currentTarget().User, currentTarget().Host),
+					"echo", "SSH connection test successful")
+				if err != nil {
+					log.Printf("SSH connection test failed: %v - %s", err, stderr)
+					// We don't prevent saving the config even if test fails
+					// Just log a warning for now
+					log.Printf("WARNING: Auto shutdown may not work with the provided password")
 				} else {
-					// Try to run a harmless command to test SSH connection
-					cmd := exec.Command("sshpass", "-p", shutdownPassword, "ssh",
-						"-o", "StrictHostKeyChecking=no",
-						"-o", "UserKnownHostsFile=/dev/null",
-						"-o", "LogLevel=ERROR",
-						"-o", "ConnectTimeout=5",
-						fmt.Sprintf("%s@%s", serverUser, serverName),
-						"echo", "SSH connection test successful")
-
-					var stderr bytes.Buffer
-					cmd.Stderr = &stderr
-
-					if err := cmd.Run(); err != nil {
-						log.Printf("SSH connection test failed: %v - %s", err, stderr.String())
-						// We don't prevent saving the config even if test fails
-						// Just log a warning for now
-						log.Printf("WARNING: Auto shutdown may not work with the provided password")
-					} else {
-						log.Printf("SSH connection test successful")
-					}
+					log.Printf("SSH connection test successful")
 				}
 			}
 		}
 
-		// Save the new configuration
-		err = UpdateScheduleConfig(newConfig)
+		// Save the new window list, keeping the state of the scheduler
+		err = scheduleStore.Update(func(c *ScheduleConfig) {
+			newConfig.keepRunState(*c)
+			*c = newConfig
+		})
 		if err != nil {
 			http.Error(w, fmt.Sprintf(`{"error": "Failed to save schedule config: %v"}`, err), http.StatusInternalServerError)
 			return
@@ -277,184 +963,286 @@ func scheduleHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
 }
 
-// Verify and clean up schedule configuration
-func verifyScheduleConfig() {
-	// If schedule is enabled, validate all required fields
-	if scheduleConfig.Enabled {
-		log.Println("Verifying schedule configuration...")
-		log.Printf("Current config: StartTime=%s, EndTime=%s, Frequency=%s, AutoShutdown=%v",
-			scheduleConfig.StartTime, scheduleConfig.EndTime, scheduleConfig.Frequency, scheduleConfig.AutoShutdown)
+// Handle schedule preview requests - lists the next occurrences of a cron expression,
+// optionally restricted by comma separated weekdays and monthDays lists and
+// evaluated in the timeZone given
+func schedulePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-		// Check for valid time formats
-		_, startErr := time.Parse("15:04", scheduleConfig.StartTime)
-		_, endErr := time.Parse("15:04", scheduleConfig.EndTime)
+	if r.Method != "GET" {
+		http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
 
-		if startErr != nil || endErr != nil || scheduleConfig.StartTime == "" || scheduleConfig.EndTime == "" {
-			log.Println("Warning: Invalid time format in schedule configuration, disabling schedule")
-			scheduleConfig.Enabled = false
-			UpdateScheduleConfig(scheduleConfig)
-			return
-		}
+	expr := r.URL.Query().Get("cron")
+	count := nextWakeCount
+	if n, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && n > 0 && n <= 50 {
+		count = n
+	}
 
-		// Immediately check if we need to boot ONLY at exact start time
-		now := time.Now()
-		currentTimeStr := now.Format("15:04")
+	window := ScheduleWindow{
+		WakeCron:  expr,
+		Weekdays:  splitList(r.URL.Query().Get("weekdays")),
+		MonthDays: splitList(r.URL.Query().Get("monthDays")),
+		TimeZone:  r.URL.Query().Get("timeZone"),
+	}
+	schedule, err := window.wakeSchedule()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
 
-		// Check ONLY if current time EXACTLY matches start time
-		if currentTimeStr == scheduleConfig.StartTime && ShouldRunToday(now) {
-			log.Printf("STARTUP MATCH: Current time %s matches start time EXACTLY, attempting boot", currentTimeStr)
-			if !isServerOnline() {
-				sendWakeOnLAN()
-				// Mark that the server was started by the scheduler
-				scheduleConfig.StartedBySchedule = true
-				scheduleConfig.LastRun = now.Format(time.RFC3339)
-				UpdateScheduleConfig(scheduleConfig)
-			}
+	var next []string
+	for _, t := range schedule.NextN(clock.Now(), count) {
+		next = append(next, t.Format(time.RFC3339))
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cron": expr,
+		"next": next,
+	})
+}
+
+// overrideView adds the human readable summary to an override in API responses
+type overrideView struct {
+	ScheduleOverride
+	Description string `json:"description"`
+}
+
+// Handle the schedule overrides: list, add and cancel
+func overridesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		views := []overrideView{}
+		for _, o := range GetScheduleConfig().Overrides {
+			views = append(views, overrideView{o, o.Description()})
 		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":   true,
+			"overrides": views,
+		})
 
-		// Check for valid frequency
-		validFrequencies := map[string]bool{
-			"daily":      true,
-			"every2days": true,
-			"weekly":     true,
-			"monthly":    true,
+	case "POST":
+		var req struct {
+			Type         string `json:"type"`
+			Window       string `json:"window"`
+			Name         string `json:"name"`
+			Start        string `json:"start"`
+			End          string `json:"end"`
+			AutoShutdown bool   `json:"autoShutdown"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "Failed to parse request body: %v"}`, err), http.StatusBadRequest)
+			return
 		}
 
-		if !validFrequencies[scheduleConfig.Frequency] {
-			log.Println("Warning: Invalid frequency in schedule configuration, setting to daily")
-			scheduleConfig.Frequency = "daily"
-			UpdateScheduleConfig(scheduleConfig)
+		now := clock.Now()
+		override, err := buildOverride(req.Type, req.Window, req.Name, req.Start, req.End, req.AutoShutdown, now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		if override.AutoShutdown && currentConfig().passwordMissing("", actionShutdown) {
+			http.Error(w, `{"error": "SHUTDOWN_PASSWORD not set in environment. Please set it before enabling auto-shutdown"}`, http.StatusBadRequest)
+			return
 		}
 
-		log.Printf("Schedule configuration verified: Start=%s, End=%s, Frequency=%s",
-			scheduleConfig.StartTime, scheduleConfig.EndTime, scheduleConfig.Frequency)
-	}
-}
+		// Validate against the schedule it is added to, under the store lock
+		var validationErr error
+		err = scheduleStore.Update(func(c *ScheduleConfig) {
+			candidate := *c
+			candidate.Overrides = append(append([]ScheduleOverride{}, c.Overrides...), override)
+			if validationErr = validateScheduleConfig(candidate, currentConfig()); validationErr == nil {
+				c.Overrides = candidate.Overrides
+			}
+		})
+		if validationErr != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, validationErr.Error()), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "Failed to save override: %v"}`, err), http.StatusInternalServerError)
+			return
+		}
 
-// Run a periodic check of schedule and take appropriate actions
-func runScheduleChecker() {
-	// Define the checkScheduleOnce function
-	checkScheduleOnce := func() {
-		// Only check exact times for schedule actions, don't use window logic
-		now := time.Now()
-		currentTimeStr := now.Format("15:04")
-		serverIsOn := isServerOnline()
-
-		// Log schedule status (debug level)
-		if scheduleConfig.Enabled {
-			log.Printf("Schedule check: Current=%s, Start=%s, End=%s, LastRun=%s",
-				currentTimeStr, scheduleConfig.StartTime, scheduleConfig.EndTime, scheduleConfig.LastRun)
-
-			// Only act at exact start or end times
-			// EXACT START TIME MATCH - Try to boot server
-			if currentTimeStr == scheduleConfig.StartTime && !serverIsOn && ShouldRunToday(now) {
-				log.Println("EXACT START TIME: Initiating boot sequence...")
-
-				// Try multiple times to boot with small delays between attempts
-				for attempt := 1; attempt <= 3; attempt++ {
-					log.Printf("Boot attempt %d/3", attempt)
-					err := sendWakeOnLAN()
-					if err != nil {
-						log.Printf("Error booting server from schedule: %v", err)
-					} else {
-						log.Println("Schedule: Boot command sent successfully")
-						// Mark that server was started by scheduler
-						scheduleConfig.StartedBySchedule = true
-						scheduleConfig.LastRun = now.Format(time.RFC3339)
-						UpdateScheduleConfig(scheduleConfig)
-					}
-
-					// Check if server came online
-					time.Sleep(3 * time.Second) // Extended wait time for boot check
-					if isServerOnline() {
-						log.Println("Server successfully booted!")
-						break
-					}
-
-					// Short delay before next attempt
-					if attempt < 3 {
-						time.Sleep(1 * time.Second)
-					}
-				}
-				// EXACT END TIME MATCH - Try to shutdown server
-			} else if currentTimeStr == scheduleConfig.EndTime && serverIsOn {
-				// Check if auto-shutdown is enabled
-				if scheduleConfig.AutoShutdown && shutdownPassword != "" && scheduleConfig.StartedBySchedule {
-					log.Println("EXACT END TIME: Attempting auto-shutdown")
-
-					// Try multiple times to shut down the server
-					var shutdownSuccessful bool
-					for attempt := 1; attempt <= 3; attempt++ {
-						log.Printf("Auto shutdown attempt %d/3", attempt)
-						err := shutdownServer(shutdownPassword)
-						if err != nil {
-							log.Printf("Auto shutdown attempt %d failed: %v", attempt, err)
-							if attempt < 3 {
-								time.Sleep(3 * time.Second)
-							}
-						} else {
-							log.Printf("Auto shutdown initiated successfully on attempt %d", attempt)
-							shutdownSuccessful = true
-							break
-						}
-					}
-
-					if !shutdownSuccessful {
-						log.Printf("All auto shutdown attempts failed")
-					}
-				}
-			} else {
-				// No action at non-exact times, just log status
-				if serverIsOn && scheduleConfig.StartedBySchedule && currentTimeStr > scheduleConfig.EndTime {
-					log.Printf("Server is still online after end time %s - waiting for next exact end time match", scheduleConfig.EndTime)
-				}
+		log.Printf("Schedule override added: %s", override.Description())
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"override": overrideView{override, override.Description()},
+		})
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		var found *ScheduleOverride
+		for _, o := range GetScheduleConfig().Overrides {
+			if o.ID == id {
+				o := o
+				found = &o
+				break
 			}
 		}
+		if found == nil {
+			http.Error(w, fmt.Sprintf(`{"error": "No override with id %q"}`, id), http.StatusNotFound)
+			return
+		}
+		// Calendar windows would come back on the next check
+		if found.Source == overrideSourceCalendar {
+			http.Error(w, `{"error": "This window comes from the events calendar, remove the event from the calendar file instead"}`, http.StatusBadRequest)
+			return
+		}
 
-		// Update last run timestamp if we've passed the end time
-		// This helps track when the schedule was last active
-		currentConfig := GetScheduleConfig()
-		nowTime := time.Now()
-		currentTimeString := nowTime.Format("15:04")
-		if currentConfig.Enabled && currentTimeString > currentConfig.EndTime && currentConfig.LastRun != "" {
-			lastRun, err := time.Parse(time.RFC3339, currentConfig.LastRun)
-			if err == nil {
-				// If it's been more than a day since the last update, reset the timestamp
-				// This allows the schedule to run again based on frequency
-				if time.Since(lastRun) > 24*time.Hour {
-					log.Println("Schedule: Resetting last run timestamp for next scheduled run")
-					currentConfig.LastRun = ""
-					UpdateScheduleConfig(currentConfig)
+		// It may have expired or been removed since, only write when it is still there
+		var removed *ScheduleOverride
+		err := scheduleStore.UpdateIf(func(c *ScheduleConfig) bool {
+			var kept []ScheduleOverride
+			for _, o := range c.Overrides {
+				if o.ID == id && o.Source != overrideSourceCalendar {
+					o := o
+					removed = &o
+					continue
 				}
+				kept = append(kept, o)
+			}
+			if removed == nil {
+				return false
+			}
+			c.Overrides = kept
+
+			// A cancelled one-time window no longer manages the server it started
+			if removed.Type == overrideOnce && c.ActiveWindow == removed.Name {
+				c.releaseServer()
 			}
+			return true
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": "Failed to save schedule: %v"}`, err), http.StatusInternalServerError)
+			return
+		}
+		if removed == nil {
+			http.Error(w, fmt.Sprintf(`{"error": "No override with id %q"}`, id), http.StatusNotFound)
+			return
 		}
+
+		log.Printf("Schedule override cancelled: %s", removed.Description())
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+		})
+
+	default:
+		http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
 	}
+}
 
-	// Use a slightly shorter interval for more responsive scheduling
-	// First check immediately at startup
-	checkScheduleOnce()
+// Handle the preview of the days and wake times affected by the calendars
+func calendarPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-	// Then set up regular checks
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	if r.Method != "GET" {
+		http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
 
-	log.Println("Schedule checker started - checking every 5 seconds")
-	log.Printf("Current schedule: enabled=%v, startTime=%s, endTime=%s, frequency=%s, autoShutdown=%v",
-		scheduleConfig.Enabled, scheduleConfig.StartTime, scheduleConfig.EndTime, scheduleConfig.Frequency, scheduleConfig.AutoShutdown)
+	days := calendarPreviewDays
+	if n, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && n > 0 && n <= 366 {
+		days = n
+	}
 
-	for {
-		func() {
-			// Recover from any panics that might occur in the schedule checker
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("Recovered from panic in schedule checker: %v", r)
-				}
-			}()
+	preview := GetScheduleConfig().calendarPreview(currentCalendars(), clock.Now(), days)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":        true,
+		"days":           days,
+		"blackouts":      preview.Blackouts,
+		"cancelledWakes": preview.CancelledWakes,
+		"events":         preview.Events,
+	})
+}
+
+// Handle schedule simulations - runs the scheduler over a time range against the
+// current schedule, or the one in the request, without touching the server
+func simulateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
 
-			checkScheduleOnce()
-		}()
+	var req struct {
+		From     string          `json:"from"`
+		To       string          `json:"to"`
+		Online   bool            `json:"online"`
+		Schedule *ScheduleConfig `json:"schedule"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": "Failed to parse request body: %v"}`, err), http.StatusBadRequest)
+		return
+	}
 
-		// Wait for next tick
-		<-ticker.C
+	from := clock.Now()
+	if req.From != "" {
+		t, err := parseOverrideTime(req.From)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, "Simulation start: "+err.Error()), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	to := from.AddDate(0, 0, simulationDefaultDays)
+	if req.To != "" {
+		t, err := parseOverrideTime(req.To)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, "Simulation end: "+err.Error()), http.StatusBadRequest)
+			return
+		}
+		to = t
 	}
+
+	// A schedule in the request is simulated as if it was saved now
+	cfg := GetScheduleConfig()
+	if req.Schedule != nil {
+		newConfig := *req.Schedule
+		if _, err := migrateLegacySchedule(&newConfig); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		if err := validateScheduleConfig(newConfig, currentConfig()); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		newConfig.keepRunState(cfg)
+		cfg = newConfig
+	}
+
+	actions, err := simulateSchedule(cfg, from, to, req.Online)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"from":    from.Format(time.RFC3339),
+		"to":      to.Format(time.RFC3339),
+		"actions": actions,
+	})
+}
+
+// Handle the run history of the schedule windows
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := historyPageSize
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= maxHistoryRecords {
+		limit = n
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"runs":    historyStore.Recent(r.URL.Query().Get("window"), limit),
+	})
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaintenanceMode suspends every automatic power action while someone works
+// on the server: the scheduler, idle shutdowns, the wake-on-demand proxy and
+// lease wakes. The server is still monitored. Times are RFC3339.
+type MaintenanceMode struct {
+	Since  string `json:"since"`
+	Until  string `json:"until,omitempty"` // Empty until turned off
+	Reason string `json:"reason,omitempty"`
+}
+
+// Description returns the maintenance mode as a line of text, used by the UI and ctl
+func (m MaintenanceMode) Description() string {
+	description := "maintenance mode since " + m.Since
+	if m.Until != "" {
+		description += " until " + m.Until
+	}
+	if m.Reason != "" {
+		description += ": " + m.Reason
+	}
+	return description
+}
+
+// activeAt reports whether the maintenance mode has not expired at now
+func (m MaintenanceMode) activeAt(now time.Time) bool {
+	if m.Until == "" {
+		return true
+	}
+	until, err := time.Parse(time.RFC3339, m.Until)
+	return err == nil && now.Before(until)
+}
+
+// maintenanceAt returns the maintenance mode active at now, or nil
+func (c ScheduleConfig) maintenanceAt(now time.Time) *MaintenanceMode {
+	if c.Maintenance == nil || !c.Maintenance.activeAt(now) {
+		return nil
+	}
+	m := *c.Maintenance
+	return &m
+}
+
+// inMaintenance reports whether automatic power actions are suspended now
+func inMaintenance() bool {
+	return scheduleStore.Get().maintenanceAt(clock.Now()) != nil
+}
+
+// parseMaintenanceEnd returns when a maintenance mode started at now ends,
+// given either a duration such as 2h or a time accepted by the overrides. With
+// neither it lasts until it is turned off and the zero time is returned.
+func parseMaintenanceEnd(duration, until string, now time.Time) (time.Time, error) {
+	duration, until = strings.TrimSpace(duration), strings.TrimSpace(until)
+	switch {
+	case duration != "" && until != "":
+		return time.Time{}, fmt.Errorf("give either a duration or an end time, not both")
+	case duration != "":
+		d, err := time.ParseDuration(duration)
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("invalid duration %q, use a duration such as 2h", duration)
+		}
+		return now.Add(d), nil
+	case until != "":
+		end, err := parseOverrideTime(until)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !end.After(now) {
+			return time.Time{}, fmt.Errorf("end time %s is in the past", end.Format(time.RFC3339))
+		}
+		return end, nil
+	}
+	return time.Time{}, nil
+}
+
+// startMaintenance turns the maintenance mode on until end, or until it is
+// turned off for the zero time. A running maintenance mode is replaced but
+// keeps its start time.
+func startMaintenance(end time.Time, reason string, now time.Time) (MaintenanceMode, error) {
+	m := MaintenanceMode{Since: now.Format(time.RFC3339), Reason: strings.TrimSpace(reason)}
+	if !end.IsZero() {
+		m.Until = end.Format(time.RFC3339)
+	}
+	err := scheduleStore.Update(func(c *ScheduleConfig) {
+		if running := c.maintenanceAt(now); running != nil {
+			m.Since = running.Since
+		}
+		c.Maintenance = &m
+	})
+	return m, err
+}
+
+// stopMaintenance turns the maintenance mode off and returns it, or nil if it
+// was not on
+func stopMaintenance(now time.Time) (*MaintenanceMode, error) {
+	var stopped *MaintenanceMode
+	err := scheduleStore.Update(func(c *ScheduleConfig) {
+		stopped = c.maintenanceAt(now)
+		c.Maintenance = nil
+	})
+	return stopped, err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// notify posts an event to the configured webhook. It never blocks the caller.
+func notify(event, message string) {
+	cfg := currentConfig().Notifications
+	if cfg.WebhookURL == "" {
+		return
+	}
+	if len(cfg.Events) > 0 && !containsString(cfg.Events, event) {
+		return
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":   event,
+		"server":  currentTarget().Host,
+		"message": message,
+		"time":    time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("Failed to encode notification: %v", err)
+		return
+	}
+
+	go func() {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(cfg.WebhookURL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Printf("Failed to send %s notification: %v", event, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Notification webhook returned HTTP %d for %s event", resp.StatusCode, event)
+		}
+	}()
+}
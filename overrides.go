@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of schedule overrides
+const (
+	overrideSkip  = "skip"  // Skip the next occurrence of a window
+	overridePause = "pause" // Do not wake for any occurrence planned before a date
+	overrideOnce  = "once"  // Extra one-time window
+)
+
+// ScheduleOverride changes the schedule temporarily without touching the
+// recurring windows. Overrides are removed automatically once they expire.
+type ScheduleOverride struct {
+	ID           string `json:"id"`
+	Type         string `json:"type"`                   // skip, pause or once
+	Window       string `json:"window,omitempty"`       // skip and pause: affected window, empty pauses all windows
+	Name         string `json:"name,omitempty"`         // once: name of the one-time window
+	Start        string `json:"start,omitempty"`        // skip: wake time skipped; once: wake time (RFC3339)
+	End          string `json:"end"`                    // pause: paused until; once: shutdown time; skip: end of the skipped occurrence
+	AutoShutdown bool   `json:"autoShutdown,omitempty"` // once: shut down at the end time
+	LastRun      string `json:"lastRun,omitempty"`      // once: when the window woke the server or found it running
+	Created      string `json:"created"`
+	Source       string `json:"source,omitempty"` // "calendar" for one-time windows created from the events calendar
+}
+
+// How many already cancelled occurrences skipNextOverride looks past
+const maxSkipSearch = 1000
+
+// Layouts accepted for override times, besides RFC3339, in the server's time zone
+var overrideTimeLayouts = []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// parseOverrideTime parses an RFC3339 time, or a local date with an optional time
+// of day; a date alone means the start of that day
+func parseOverrideTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range overrideTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use YYYY-MM-DD, YYYY-MM-DDTHH:MM or RFC3339", value)
+}
+
+// times returns the parsed start (zero for pauses) and end of the override
+func (o ScheduleOverride) times() (start, end time.Time, err error) {
+	if o.Start != "" {
+		if start, err = time.Parse(time.RFC3339, o.Start); err != nil {
+			return start, end, fmt.Errorf("invalid start time %q", o.Start)
+		}
+	}
+	if end, err = time.Parse(time.RFC3339, o.End); err != nil {
+		return start, end, fmt.Errorf("invalid end time %q", o.End)
+	}
+	return start, end, nil
+}
+
+// onceWindow returns the one-time window described by a "once" override and its
+// wake and shutdown schedules, which match only the start and end time
+func (o ScheduleOverride) onceWindow() (ScheduleWindow, *CronSchedule, *CronSchedule, error) {
+	start, end, err := o.times()
+	if err != nil {
+		return ScheduleWindow{}, nil, nil, err
+	}
+	window := ScheduleWindow{
+		Name:         o.Name,
+		Enabled:      true,
+		AutoShutdown: o.AutoShutdown,
+		LastRun:      o.LastRun,
+	}
+	return window, onceSchedule(start), onceSchedule(end), nil
+}
+
+// Description returns a short human readable summary, used by the UI and ctl
+func (o ScheduleOverride) Description() string {
+	start, end, err := o.times()
+	if err != nil {
+		return fmt.Sprintf("Invalid %s override: %v", o.Type, err)
+	}
+	const layout = "Mon 2006-01-02 15:04 MST"
+	switch o.Type {
+	case overrideSkip:
+		return fmt.Sprintf("Skip %s at %s", o.Window, start.Format(layout))
+	case overridePause:
+		if o.Window == "" {
+			return fmt.Sprintf("All windows paused until %s", end.Format(layout))
+		}
+		return fmt.Sprintf("%s paused until %s", o.Window, end.Format(layout))
+	case overrideOnce:
+		shutdown := ""
+		if o.AutoShutdown {
+			shutdown = ", auto shutdown"
+		}
+		return fmt.Sprintf("One-time window %s from %s to %s%s", o.Name, start.Format(layout), end.Format(layout), shutdown)
+	}
+	return o.Type
+}
+
+// validateOverride checks an override against the schedule it is added to
+func validateOverride(o ScheduleOverride, cfg ScheduleConfig) error {
+	start, end, err := o.times()
+	if err != nil {
+		return err
+	}
+
+	switch o.Type {
+	case overrideSkip:
+		if cfg.Window(o.Window) == nil {
+			return fmt.Errorf("No schedule window named %q", o.Window)
+		}
+		if start.IsZero() {
+			return fmt.Errorf("The skipped wake time is required")
+		}
+	case overridePause:
+		if o.Window != "" && cfg.Window(o.Window) == nil && cfg.onceOverride(o.Window) == nil {
+			return fmt.Errorf("No schedule window named %q", o.Window)
+		}
+	case overrideOnce:
+		if strings.TrimSpace(o.Name) == "" {
+			return fmt.Errorf("A name is required for a one-time window")
+		}
+		if start.IsZero() {
+			return fmt.Errorf("The wake time of a one-time window is required")
+		}
+		if !end.After(start) {
+			return fmt.Errorf("The end of a one-time window must be after its start")
+		}
+	default:
+		return fmt.Errorf("Unknown override type %q: use skip, pause or once", o.Type)
+	}
+	return nil
+}
+
+// buildOverride creates an override from user input: skip needs the window,
+// pause the end time and optionally the window, once a name, start and end
+func buildOverride(kind, window, name, start, end string, autoShutdown bool, now time.Time) (ScheduleOverride, error) {
+	var o ScheduleOverride
+	switch kind {
+	case overrideSkip:
+		cfg := GetScheduleConfig()
+		w := cfg.Window(window)
+		if w == nil {
+			return o, fmt.Errorf("No schedule window named %q", window)
+		}
+		var err error
+		if o, err = skipNextOverride(*w, cfg, now); err != nil {
+			return o, err
+		}
+	case overridePause:
+		until, err := parseOverrideTime(end)
+		if err != nil {
+			return o, fmt.Errorf("Pause end: %v", err)
+		}
+		if !until.After(now) {
+			return o, fmt.Errorf("Pause end must be in the future")
+		}
+		o = ScheduleOverride{Type: overridePause, Window: window, End: until.Format(time.RFC3339)}
+	case overrideOnce:
+		from, err := parseOverrideTime(start)
+		if err != nil {
+			return o, fmt.Errorf("One-time window start: %v", err)
+		}
+		to, err := parseOverrideTime(end)
+		if err != nil {
+			return o, fmt.Errorf("One-time window end: %v", err)
+		}
+		if !to.After(now) {
+			return o, fmt.Errorf("One-time window end must be in the future")
+		}
+		o = ScheduleOverride{
+			Type:         overrideOnce,
+			Name:         strings.TrimSpace(name),
+			Start:        from.Format(time.RFC3339),
+			End:          to.Format(time.RFC3339),
+			AutoShutdown: autoShutdown,
+		}
+	default:
+		return o, fmt.Errorf("Unknown override type %q: use skip, pause or once", kind)
+	}
+
+	o.ID = newOverrideID(now)
+	o.Created = now.Format(time.RFC3339)
+	return o, nil
+}
+
+// newOverrideID returns a short unique identifier for a new override
+func newOverrideID(now time.Time) string {
+	return strconv.FormatInt(now.UnixNano(), 36)
+}
+
+// onceOverride returns the one-time window override with the given name, or nil
+func (c *ScheduleConfig) onceOverride(name string) *ScheduleOverride {
+	for i := range c.Overrides {
+		if c.Overrides[i].Type == overrideOnce && c.Overrides[i].Name == name {
+			return &c.Overrides[i]
+		}
+	}
+	return nil
+}
+
+// suppressedBy returns the skip or pause override that cancels the occurrence
+// of a window planned at wake, or nil
+func (c ScheduleConfig) suppressedBy(name string, wake time.Time) *ScheduleOverride {
+	for i, o := range c.Overrides {
+		start, end, err := o.times()
+		if err != nil {
+			continue
+		}
+		switch o.Type {
+		case overrideSkip:
+			if o.Window == name && start.Equal(wake) {
+				return &c.Overrides[i]
+			}
+		case overridePause:
+			if (o.Window == "" || o.Window == name) && wake.Before(end) {
+				return &c.Overrides[i]
+			}
+		}
+	}
+	return nil
+}
+
+// cancelReason explains why the occurrence of a window planned at wake does not
+// run: a skip or pause override or a blackout day. It is empty if it runs.
+func (c ScheduleConfig) cancelReason(name string, wake time.Time) string {
+	if o := c.suppressedBy(name, wake); o != nil {
+		return o.Description()
+	}
+	if event := currentCalendars().blackoutOn(wake); event != nil {
+		return fmt.Sprintf("Blackout day %s (%s)", wake.Format("2006-01-02"), event.Summary)
+	}
+	return ""
+}
+
+// expireOverrides removes and returns the overrides that ended before now. A
+// one-time window is kept while it still owns the server, so the scheduler can
+// shut it down.
+func (c *ScheduleConfig) expireOverrides(now time.Time) []ScheduleOverride {
+	var kept, expired []ScheduleOverride
+	for _, o := range c.Overrides {
+		_, end, err := o.times()
+		over := err == nil && !now.Before(end)
+		if over && o.Type == overrideOnce && c.StartedBySchedule && c.ActiveWindow == o.Name {
+			over = false
+		}
+		if over {
+			expired = append(expired, o)
+		} else {
+			kept = append(kept, o)
+		}
+	}
+	c.Overrides = kept
+	return expired
+}
+
+// setLastRun records when a window, or a one-time window, last ran
+func (c *ScheduleConfig) setLastRun(name string, now time.Time) {
+	if w := c.Window(name); w != nil {
+		w.LastRun = now.Format(time.RFC3339)
+	} else if o := c.onceOverride(name); o != nil {
+		o.LastRun = now.Format(time.RFC3339)
+	}
+}
+
+// skipNextOverride builds the override skipping the next occurrence of a
+// window after now that is not cancelled already. It lasts until the end of
+// that occurrence, or until the following wake time when the window has no
+// shutdown schedule.
+func skipNextOverride(window ScheduleWindow, cfg ScheduleConfig, now time.Time) (ScheduleOverride, error) {
+	wake, err := window.wakeSchedule()
+	if err != nil {
+		return ScheduleOverride{}, err
+	}
+	shutdown, err := window.shutdownSchedule()
+	if err != nil {
+		return ScheduleOverride{}, err
+	}
+
+	next := wake.Next(now)
+	for i := 0; i < maxSkipSearch && !next.IsZero() && cfg.cancelReason(window.Name, next) != ""; i++ {
+		next = wake.Next(next)
+	}
+	if next.IsZero() || cfg.cancelReason(window.Name, next) != "" {
+		return ScheduleOverride{}, fmt.Errorf("Window %q has no upcoming wake time", window.Name)
+	}
+	end := wake.Next(next)
+	if shutdown != nil {
+		end = windowEnd(shutdown, next)
+	}
+	if end.IsZero() || end.Equal(next) {
+		end = next.Add(time.Minute)
+	}
+
+	return ScheduleOverride{
+		Type:   overrideSkip,
+		Window: window.Name,
+		Start:  next.Format(time.RFC3339),
+		End:    end.Format(time.RFC3339),
+	}, nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clock abstracts the current time and waiting, so schedule decisions can be
+// driven by a fake clock
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// systemClock is the Clock backed by the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// CommandRunner runs external programs
+type CommandRunner interface {
+	// LookPath reports whether the program is installed
+	LookPath(name string) error
+	// Run executes the program, feeding stdin if it is not empty
+	Run(stdin string, name string, args ...string) (stdout, stderr string, err error)
+}
+
+// execRunner is the CommandRunner backed by os/exec
+type execRunner struct{}
+
+func (execRunner) LookPath(name string) error {
+	_, err := exec.LookPath(name)
+	return err
+}
+
+func (execRunner) Run(stdin string, name string, args ...string) (string, string, error) {
+	cmd := exec.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// PowerDriver wakes, shuts down and probes the target
+type PowerDriver interface {
+	Online() bool
+	Wake() error
+	Shutdown(password string) error
+	Action(name, password string) error // Runs a power action such as reboot or suspend
+	CheckGuards() ([]string, error)     // Returns why the target must not be powered off now
+	CheckIdle() ([]string, error)       // Returns what keeps the target busy, nothing when it is idle
+	Message(text string) error          // Tells the users logged in on the target
+}
+
+// wolSSHDriver wakes the target with the Wake-on-LAN tools, probes it with
+// ping or a TCP connection and shuts it down over SSH
+type wolSSHDriver struct {
+	runner CommandRunner
+	target string // Name of the target, empty for the primary one
+}
+
+// configuredDriver uses the power driver chosen in the configuration of the
+// target. It looks the driver up on every call, so a reloaded configuration
+// applies at once.
+type configuredDriver struct {
+	runner CommandRunner
+	target string // Name of the target, empty for the primary one
+}
+
+// The clock, command runner and power driver used by the scheduler and handlers
+var (
+	clock  Clock         = systemClock{}
+	runner CommandRunner = execRunner{}
+	power  PowerDriver   = configuredDriver{runner: runner}
+)
+
+// powerFor returns the power driver of the named target. The primary target
+// uses the shared driver, so a replaced driver applies to it everywhere.
+func powerFor(name string) PowerDriver {
+	if name == "" || name == currentTarget().Name {
+		return power
+	}
+	return configuredDriver{runner: runner, target: name}
+}
+
+// driver returns the driver of the target
+func (d configuredDriver) driver() PowerDriver {
+	ssh := &wolSSHDriver{runner: d.runner, target: d.target}
+	if ssh.targetConfig().DriverName() == driverRedfish {
+		return &redfishDriver{ssh: ssh}
+	}
+	return ssh
+}
+
+func (d configuredDriver) Online() bool                   { return d.driver().Online() }
+func (d configuredDriver) Wake() error                    { return d.driver().Wake() }
+func (d configuredDriver) Shutdown(password string) error { return d.driver().Shutdown(password) }
+func (d configuredDriver) Action(name, password string) error {
+	return d.driver().Action(name, password)
+}
+func (d configuredDriver) CheckGuards() ([]string, error) { return d.driver().CheckGuards() }
+func (d configuredDriver) CheckIdle() ([]string, error)   { return d.driver().CheckIdle() }
+func (d configuredDriver) Message(text string) error      { return d.driver().Message(text) }
+
+// PowerState returns the power state reported by the hardware, or nothing if
+// the driver of the target cannot tell
+func (d configuredDriver) PowerState() (string, error) {
+	if reader, ok := d.driver().(powerStateReader); ok {
+		return reader.PowerState()
+	}
+	return "", nil
+}
+
+// powerState returns the power state of the primary target reported by the
+// hardware, or nothing if it is unknown
+func powerState() string {
+	reader, ok := power.(powerStateReader)
+	if !ok {
+		return ""
+	}
+	state, err := reader.PowerState()
+	if err != nil {
+		log.Printf("Failed to read the power state: %v", err)
+		return ""
+	}
+	return state
+}
+
+// Check if server is online
+func isServerOnline() bool {
+	return power.Online()
+}
+
+// Send WOL packet
+func sendWakeOnLAN() error {
+	return power.Wake()
+}
+
+// Shutdown server with password
+func shutdownServer(password string) error {
+	return power.Shutdown(password)
+}
+
+// Run a power action on the server with password
+func runPowerAction(name, password string) error {
+	return power.Action(name, password)
+}
+
+// targetConfig returns the configuration of the target the driver controls
+func (d *wolSSHDriver) targetConfig() TargetConfig {
+	if target, ok := currentConfig().Target(d.target); ok {
+		return target
+	}
+	return currentTarget()
+}
+
+// Online checks if the target answers the configured probe
+func (d *wolSSHDriver) Online() bool {
+	target := d.targetConfig()
+	// A TCP probe works where ICMP is blocked and tells us a service is actually up
+	if currentConfig().Probes.Method == "tcp" {
+		address := net.JoinHostPort(target.Host, strconv.Itoa(currentConfig().Probes.Port))
+		log.Printf("Checking if server %s is online (tcp %s)...", target.Host, address)
+
+		conn, err := net.DialTimeout("tcp", address, currentConfig().ProbeTimeout())
+		if err != nil {
+			log.Printf("Server %s is offline: %v", target.Host, err)
+			return false
+		}
+		conn.Close()
+
+		log.Printf("Server %s is online", target.Host)
+		return true
+	}
+
+	// macOS and Linux have slightly different ping commands
+	var args []string
+	timeout := currentConfig().ProbeTimeout()
+	if runtime.GOOS == "darwin" {
+		args = []string{"-c", "1", "-W", strconv.FormatInt(timeout.Milliseconds(), 10), target.Host}
+	} else {
+		seconds := int(timeout.Round(time.Second) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		args = []string{"-c", "1", "-W", strconv.Itoa(seconds), target.Host}
+	}
+
+	log.Printf("Checking if server %s is online...", target.Host)
+	_, stderr, err := d.runner.Run("", "ping", args...)
+
+	if err != nil {
+		// Only log the full error in debug mode to avoid spamming the logs
+		if stderr != "" {
+			log.Printf("Server %s is offline: %v - %s", target.Host, err, stderr)
+		} else {
+			log.Printf("Server %s is offline", target.Host)
+		}
+		return false
+	}
+
+	log.Printf("Server %s is online", target.Host)
+	return true
+}
+
+// Wake sends the magic packet with the first Wake-on-LAN tool installed
+func (d *wolSSHDriver) Wake() error {
+	target := d.targetConfig()
+	log.Printf("Sending WOL packet to %s (%s)", target.Host, target.MAC)
+
+	// Check if wakeonlan command exists
+	if err := d.runner.LookPath("wakeonlan"); err == nil {
+		stdout, stderr, err := d.runner.Run("", "wakeonlan", target.MAC)
+
+		// Log the result
+		if err != nil {
+			log.Printf("WOL command failed: %v - stderr: %s", err, stderr)
+			return fmt.Errorf("WOL command failed: %v - %s", err, stderr)
+		}
+
+		if stdout != "" {
+			log.Printf("WOL command output: %s", stdout)
+		}
+
+		log.Printf("WOL packet sent successfully to %s", target.MAC)
+		return nil
+	}
+
+	// wakeonlan command not found, try etherwake and wol
+	for _, tool := range []string{"etherwake", "wol"} {
+		if err := d.runner.LookPath(tool); err != nil {
+			continue
+		}
+
+		log.Printf("Using %s as wakeonlan alternative", tool)
+		_, stderr, err := d.runner.Run("", tool, target.MAC)
+		if err != nil {
+			log.Printf("%s command failed: %v - stderr: %s", tool, err, stderr)
+			return fmt.Errorf("%s command failed: %v - %s", tool, err, stderr)
+		}
+
+		log.Printf("WOL packet sent successfully via %s to %s", tool, target.MAC)
+		return nil
+	}
+
+	log.Printf("No WOL tools found. Please install wakeonlan, etherwake, or wol package.")
+	log.Printf("Installation instructions:")
+	log.Printf("  - For Debian/Ubuntu: sudo apt-get install wakeonlan")
+	log.Printf("  - For macOS: brew install wakeonlan")
+	log.Printf("  - For Windows: Download from https://www.depicus.com/wake-on-lan/wake-on-lan-cmd")
+
+	return fmt.Errorf("wakeonlan command not found in PATH. Please install wakeonlan tool")
+}
+
+// Shutdown runs the shutdown action of the target
+func (d *wolSSHDriver) Shutdown(password string) error {
+	return d.Action(actionShutdown, password)
+}
+
+// Action runs the command of a power action on the target over SSH, trying
+// sshpass first. With sudo the password is fed to "sudo -S" on stdin.
+func (d *wolSSHDriver) Action(name, password string) error {
+	target := d.targetConfig()
+	action, ok := target.Action(name)
+	if !ok {
+		return fmt.Errorf("action %q is not configured for %s", name, target.Name)
+	}
+	command, err := action.remoteCommand(target)
+	if err != nil {
+		return err
+	}
+	stdin := ""
+	if action.Sudo {
+		stdin = password + "\n"
+	}
+
+	log.Printf("Sending %s command to %s: %s", name, target.Host, command)
+
+	if _, err := d.ssh(command, stdin, password); err != nil {
+		log.Printf("All %s attempts failed: %v", name, err)
+		return err
+	}
+	return nil
+}
+
+// CheckGuards runs the guard checks of the target in a single SSH session
+func (d *wolSSHDriver) CheckGuards() ([]string, error) {
+	target := d.targetConfig()
+	guards := target.Guards
+	if !guards.Enabled() {
+		return nil, nil
+	}
+
+	log.Printf("Running shutdown guard checks on %s", target.Host)
+	return d.runChecks(guards.script())
+}
+
+// CheckIdle runs the idle checks of the target in a single SSH session
+func (d *wolSSHDriver) CheckIdle() ([]string, error) {
+	target := d.targetConfig()
+	idle := target.Idle
+	if !idle.Enabled() {
+		return nil, nil
+	}
+
+	log.Printf("Running idle checks on %s", target.Host)
+	return d.runChecks(idle.script())
+}
+
+// runChecks runs a check script on the target and returns the lines it printed
+func (d *wolSSHDriver) runChecks(script string) ([]string, error) {
+	stdout, err := d.ssh(script, "", currentConfig().Auth.ShutdownPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	var reasons []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			reasons = append(reasons, line)
+		}
+	}
+	return reasons, nil
+}
+
+// Message sends text to the users logged in on the target with wall
+func (d *wolSSHDriver) Message(text string) error {
+	target := d.targetConfig()
+	log.Printf("Sending wall message to %s: %s", target.Host, text)
+	_, err := d.ssh("printf '%s\\n' "+shellQuote(text)+" | wall", "", currentConfig().Auth.ShutdownPassword)
+	return err
+}
+
+// ssh runs a command on the target and returns its output, trying sshpass
+// with the password first and then plain ssh relying on keys or an agent
+func (d *wolSSHDriver) ssh(command, stdin, password string) (string, error) {
+	target := d.targetConfig()
+	login := fmt.Sprintf("%s@%s", target.User, target.Host)
+	sshArgs := []string{
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+		"-o", "ConnectTimeout=10",
+		login,
+		command,
+	}
+
+	// First try using sshpass with password
+	if err := d.runner.LookPath("sshpass"); err == nil {
+		log.Println("Using sshpass for authentication")
+
+		stdout, stderr, err := d.runner.Run(stdin, "sshpass", append([]string{"-p", password, "ssh"}, sshArgs...)...)
+		if err == nil {
+			log.Println("SSH command executed successfully using sshpass")
+			return stdout, nil
+		}
+
+		log.Printf("sshpass method failed: %v - %s", err, stderr)
+	}
+
+	// Try direct SSH, relying on keys or an agent
+	log.Println("Trying direct SSH")
+
+	stdout, stderr, err := d.runner.Run(stdin, "ssh", sshArgs...)
+	if err != nil {
+		return stdout, fmt.Errorf("SSH command failed: %v - %s", err, stderr)
+	}
+
+	log.Println("SSH command executed successfully using direct SSH")
+	return stdout, nil
+}
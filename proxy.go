@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyConfig forwards local ports to the target and wakes it when a client
+// connects while it is offline
+type ProxyConfig struct {
+	Ports        []ProxyPort `yaml:"ports" json:"ports,omitempty"`
+	IdleShutdown bool        `yaml:"idleShutdown" json:"idleShutdown"` // Shut a server woken by the proxy down once idle
+}
+
+// ProxyPort is one forwarded port
+type ProxyPort struct {
+	Listen string `yaml:"listen" json:"listen"` // Local address, e.g. ":445" or "0.0.0.0:8445"
+	Port   int    `yaml:"port" json:"port"`     // Port on the target
+}
+
+// Name of the run history entries of wakes by the proxy, and of the window
+// owning the server they woke
+const onDemandWindow = "on-demand"
+
+// How long a single connection attempt to the target may take
+const proxyDialTimeout = 3 * time.Second
+
+// ProxyStatus describes a forwarded port for the status page and the API
+type ProxyStatus struct {
+	Listen  string `json:"listen"`
+	Port    int    `json:"port"`
+	Active  int64  `json:"active"`          // Connections being forwarded
+	Waiting int64  `json:"waiting"`         // Connections held while the server wakes
+	Total   int64  `json:"total"`           // Connections accepted since the start
+	Error   string `json:"error,omitempty"` // Why the port is not listening
+}
+
+// proxyListener accepts the connections of a forwarded port
+type proxyListener struct {
+	port    ProxyPort
+	err     string
+	active  atomic.Int64
+	waiting atomic.Int64
+	total   atomic.Int64
+}
+
+// The forwarded ports, set up once at startup
+var proxies []*proxyListener
+
+// startProxies listens on the configured ports and forwards their connections
+// in the background. A port that cannot be opened is logged and reported in
+// the status, the others keep working.
+func startProxies(cfg ProxyConfig) {
+	for _, port := range cfg.Ports {
+		p := &proxyListener{port: port}
+		proxies = append(proxies, p)
+
+		ln, err := net.Listen("tcp", port.Listen)
+		if err != nil {
+			p.err = err.Error()
+			log.Printf("Proxy %s: failed to listen: %v", port.Listen, err)
+			continue
+		}
+		log.Printf("Proxy: forwarding %s to port %d of the server, waking it on demand", port.Listen, port.Port)
+		go p.serve(ln)
+	}
+}
+
+// proxyStatuses returns the state of the forwarded ports
+func proxyStatuses() []ProxyStatus {
+	var statuses []ProxyStatus
+	for _, p := range proxies {
+		statuses = append(statuses, ProxyStatus{
+			Listen:  p.port.Listen,
+			Port:    p.port.Port,
+			Active:  p.active.Load(),
+			Waiting: p.waiting.Load(),
+			Total:   p.total.Load(),
+			Error:   p.err,
+		})
+	}
+	return statuses
+}
+
+// serve accepts connections until the listener is closed
+func (p *proxyListener) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Proxy %s: accept failed: %v", p.port.Listen, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		p.total.Add(1)
+		go p.handle(conn)
+	}
+}
+
+// handle forwards a client connection to the target, waking it first if needed
+func (p *proxyListener) handle(client net.Conn) {
+	defer client.Close()
+
+	addr := net.JoinHostPort(currentTarget().Host, strconv.Itoa(p.port.Port))
+	upstream, err := net.DialTimeout("tcp", addr, proxyDialTimeout)
+	if err != nil {
+		p.waiting.Add(1)
+		upstream, err = p.wakeAndDial(client.RemoteAddr().String(), addr)
+		p.waiting.Add(-1)
+		if err != nil {
+			log.Printf("Proxy %s: dropping connection from %s: %v", p.port.Listen, client.RemoteAddr(), err)
+			return
+		}
+	}
+	defer upstream.Close()
+
+	p.active.Add(1)
+	defer p.active.Add(-1)
+	splice(client, upstream)
+}
+
+// wakeAndDial wakes the server if it is offline and connects to addr once the
+// port accepts connections, which can be a while after the server answers the
+// probe
+func (p *proxyListener) wakeAndDial(clientAddr, addr string) (net.Conn, error) {
+	if !isServerOnline() {
+		if inMaintenance() {
+			return nil, fmt.Errorf("the server is offline and maintenance mode is on, not waking it")
+		}
+		log.Printf("Proxy %s: connection from %s while the server is offline, waking it", p.port.Listen, clientAddr)
+		if result := wakeOnDemand(); !result.Success {
+			return nil, fmt.Errorf("wake %s: %s", result.Outcome, result.Error)
+		}
+	}
+
+	cfg := currentConfig()
+	deadline := clock.Now().Add(cfg.WakeTimeout())
+	for {
+		conn, err := net.DialTimeout("tcp", addr, proxyDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		if !clock.Now().Before(deadline) {
+			return nil, fmt.Errorf("%s does not accept connections after %s: %v", addr, cfg.WakeTimeout(), err)
+		}
+		clock.Sleep(cfg.WakePollInterval())
+	}
+}
+
+// wakeOnDemand wakes the server for a proxied connection. Connections arriving
+// meanwhile wait for the same wake. With proxy.idleShutdown the proxy owns the
+// server it woke like a schedule window, so the scheduler shuts it down once idle.
+func wakeOnDemand() WakeResult {
+	claim := currentConfig().Proxy.IdleShutdown
+	var planned time.Time
+	result := wakes.run(newWakeWorkflow(clock, power, currentConfig()), wakeSourceProxy, func(r WakeResult) {
+		if !claim || !planned.IsZero() || r.Packets == 0 {
+			return
+		}
+		planned = clock.Now()
+		scheduleStore.Update(func(c *ScheduleConfig) {
+			c.releaseServer()
+			c.StartedBySchedule = true
+			c.ActiveWindow = onDemandWindow
+			c.OnDemandSince = planned.Format(time.RFC3339)
+		})
+		recordOnDemand(planned, func(r *RunRecord) { setRunTime(&r.WakeSent, planned) })
+	})
+
+	if !planned.IsZero() && result.Outcome == wakeOnline {
+		recordOnDemand(planned, func(r *RunRecord) {
+			setRunTime(&r.Online, clock.Now())
+			r.BootSeconds = result.BootSeconds
+		})
+	}
+	return result
+}
+
+// recordOnDemand updates the run history of a wake by the proxy
+func recordOnDemand(planned time.Time, fn func(*RunRecord)) {
+	if err := historyStore.Record(onDemandWindow, planned, fn); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// splice copies data both ways until both sides are done
+func splice(client, upstream net.Conn) {
+	done := make(chan struct{}, 2)
+	forward := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Let the other side see the end of the stream, the reverse direction may go on
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go forward(upstream, client)
+	go forward(client, upstream)
+	<-done
+	<-done
+}
+
+// validateProxy checks the proxy configuration
+func validateProxy(cfg ProxyConfig) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	for i, port := range cfg.Ports {
+		if _, _, err := net.SplitHostPort(port.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("ports[%d].listen: invalid address %q, use host:port or :port", i, port.Listen))
+		} else if seen[port.Listen] {
+			problems = append(problems, fmt.Sprintf("ports[%d].listen: %q is used more than once", i, port.Listen))
+		}
+		seen[port.Listen] = true
+		if port.Port < 1 || port.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("ports[%d].port: must be between 1 and 65535, got %d", i, port.Port))
+		}
+	}
+	return problems
+}
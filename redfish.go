@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Power drivers a target can use
+const (
+	driverWOLSSH  = "wol-ssh" // Wake-on-LAN packets, probes and SSH commands (default)
+	driverRedfish = "redfish" // Power control through the Redfish API of the BMC
+)
+
+// Power states reported by Redfish
+const (
+	redfishOn          = "On"
+	redfishOff         = "Off"
+	redfishPoweringOn  = "PoweringOn"
+	redfishPoweringOff = "PoweringOff"
+)
+
+// Default time limit of a request to the BMC
+const defaultRedfishTimeout = 10 * time.Second
+
+// RedfishConfig points at the BMC of a target using the redfish driver
+type RedfishConfig struct {
+	URL      string `yaml:"url" json:"url"`                 // Base URL of the BMC, e.g. https://10.0.0.20
+	System   string `yaml:"system" json:"system,omitempty"` // System id or path, default: the first of /redfish/v1/Systems
+	User     string `yaml:"user" json:"user"`
+	Password string `yaml:"password" json:"password"`
+	Insecure bool   `yaml:"insecure" json:"insecure"` // Accept the self-signed certificates most BMCs use
+	Timeout  string `yaml:"timeout" json:"timeout"`   // Go duration per request, default 10s
+}
+
+// The Redfish reset types of the power actions the BMC carries out. The other
+// actions of a target using the redfish driver still run over SSH.
+var redfishResetTypes = map[string]string{
+	actionShutdown: "GracefulShutdown",
+	actionReboot:   "GracefulRestart",
+	actionForceOff: "ForceOff",
+}
+
+// DriverName returns the power driver of the target
+func (t TargetConfig) DriverName() string {
+	if t.Driver == "" {
+		return driverWOLSSH
+	}
+	return t.Driver
+}
+
+// NeedsPassword reports whether the power action runs over SSH with sudo and
+// so needs the shutdown password; the BMC carries out the Redfish ones
+func (t TargetConfig) NeedsPassword(action string) bool {
+	if t.DriverName() != driverRedfish {
+		return true
+	}
+	_, bmc := redfishResetTypes[action]
+	return !bmc
+}
+
+// timeout returns the time limit of a request to the BMC
+func (r RedfishConfig) timeout() time.Duration {
+	if d, err := time.ParseDuration(r.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultRedfishTimeout
+}
+
+// validateRedfish checks the BMC settings of a target using the redfish driver
+func validateRedfish(cfg RedfishConfig) []string {
+	var problems []string
+	if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("url: must be an http(s) URL, got %q", cfg.URL))
+	}
+	if cfg.Timeout != "" {
+		if d, err := time.ParseDuration(cfg.Timeout); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("timeout: invalid duration %q", cfg.Timeout))
+		}
+	}
+	return problems
+}
+
+// powerStateReader is implemented by drivers that can ask the hardware for
+// its power state, an empty state meaning the driver cannot tell
+type powerStateReader interface {
+	PowerState() (string, error)
+}
+
+// redfishDriver powers the target on and off through the Redfish API of its
+// BMC, which works when Wake-on-LAN does not, such as after a power cut. The
+// target counts as online once the BMC reports it powered on and it answers
+// the probe; checks and wall messages still run over SSH.
+type redfishDriver struct {
+	ssh *wolSSHDriver
+}
+
+// The system path found for every BMC, so it is only looked up once
+var redfishSystems = struct {
+	sync.Mutex
+	paths map[string]string
+}{paths: make(map[string]string)}
+
+// The HTTP client of every BMC configuration, so connections are reused across
+// requests; a changed configuration gets a client of its own
+var redfishClients = struct {
+	sync.Mutex
+	clients map[redfishClientKey]*http.Client
+}{clients: make(map[redfishClientKey]*http.Client)}
+
+// redfishClientKey is the part of a BMC configuration its client depends on
+type redfishClientKey struct {
+	url      string
+	insecure bool
+	timeout  time.Duration
+}
+
+// client returns the HTTP client of the BMC, created on first use
+func (r RedfishConfig) client() *http.Client {
+	key := redfishClientKey{url: r.URL, insecure: r.Insecure, timeout: r.timeout()}
+	redfishClients.Lock()
+	defer redfishClients.Unlock()
+	if client, ok := redfishClients.clients[key]; ok {
+		return client
+	}
+
+	client := &http.Client{Timeout: key.timeout}
+	if r.Insecure {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client.Transport = transport
+	}
+	redfishClients.clients[key] = client
+	return client
+}
+
+// redfishSystem is the part of a Redfish ComputerSystem the driver uses
+type redfishSystem struct {
+	PowerState string `json:"PowerState"`
+	Actions    struct {
+		Reset struct {
+			Target string `json:"target"`
+		} `json:"#ComputerSystem.Reset"`
+	} `json:"Actions"`
+}
+
+// Online checks the power state on the BMC first and then the probe, so a
+// powered off target is known to be offline without waiting for the probe
+func (d *redfishDriver) Online() bool {
+	state, err := d.PowerState()
+	if err != nil {
+		log.Printf("Redfish: %v, falling back to the probe", err)
+	} else if state != redfishOn {
+		log.Printf("Server %s is offline: power state %s", d.ssh.targetConfig().Host, state)
+		return false
+	}
+	return d.ssh.Online()
+}
+
+// Wake powers the system on. A system already on, waiting for its operating
+// system, is left alone, so resent wakes are harmless.
+func (d *redfishDriver) Wake() error {
+	system, path, err := d.system()
+	if err != nil {
+		return err
+	}
+	if system.PowerState == redfishOn || system.PowerState == redfishPoweringOn {
+		log.Printf("Redfish: %s is already %s", d.ssh.targetConfig().Name, system.PowerState)
+		return nil
+	}
+	return d.reset(system, path, "On")
+}
+
+// Shutdown asks the BMC for a graceful shutdown of the operating system
+func (d *redfishDriver) Shutdown(password string) error {
+	return d.Action(actionShutdown, password)
+}
+
+// Action resets the system through the BMC for the actions it carries out
+// and runs the other ones over SSH
+func (d *redfishDriver) Action(name, password string) error {
+	resetType, ok := redfishResetTypes[name]
+	if !ok {
+		return d.ssh.Action(name, password)
+	}
+	system, path, err := d.system()
+	if err != nil {
+		return err
+	}
+	return d.reset(system, path, resetType)
+}
+
+func (d *redfishDriver) CheckGuards() ([]string, error) { return d.ssh.CheckGuards() }
+func (d *redfishDriver) CheckIdle() ([]string, error)   { return d.ssh.CheckIdle() }
+func (d *redfishDriver) Message(text string) error      { return d.ssh.Message(text) }
+
+// PowerState returns the power state reported by the BMC
+func (d *redfishDriver) PowerState() (string, error) {
+	system, _, err := d.system()
+	if err != nil {
+		return "", err
+	}
+	return system.PowerState, nil
+}
+
+// system returns the computer system of the target and its path, finding the
+// path in the Systems collection unless it is configured
+func (d *redfishDriver) system() (redfishSystem, string, error) {
+	cfg := d.ssh.targetConfig().Redfish
+	path := cfg.System
+	switch {
+	case strings.HasPrefix(path, "/"):
+	case path != "":
+		path = "/redfish/v1/Systems/" + path
+	default:
+		redfishSystems.Lock()
+		path = redfishSystems.paths[cfg.URL]
+		redfishSystems.Unlock()
+	}
+
+	if path == "" {
+		var collection struct {
+			Members []struct {
+				ID string `json:"@odata.id"`
+			} `json:"Members"`
+		}
+		if err := d.request("GET", "/redfish/v1/Systems", nil, &collection); err != nil {
+			return redfishSystem{}, "", err
+		}
+		if len(collection.Members) == 0 {
+			return redfishSystem{}, "", fmt.Errorf("redfish: the BMC at %s lists no systems", cfg.URL)
+		}
+		path = collection.Members[0].ID
+		redfishSystems.Lock()
+		redfishSystems.paths[cfg.URL] = path
+		redfishSystems.Unlock()
+	}
+
+	var system redfishSystem
+	err := d.request("GET", path, nil, &system)
+	return system, path, err
+}
+
+// reset runs the ComputerSystem.Reset action of the system
+func (d *redfishDriver) reset(system redfishSystem, path, resetType string) error {
+	target := system.Actions.Reset.Target
+	if target == "" {
+		target = strings.TrimSuffix(path, "/") + "/Actions/ComputerSystem.Reset"
+	}
+	log.Printf("Redfish: resetting %s (%s) with %s", d.ssh.targetConfig().Name, path, resetType)
+	if err := d.request("POST", target, map[string]string{"ResetType": resetType}, nil); err != nil {
+		log.Printf("Redfish: %s failed: %v", resetType, err)
+		return err
+	}
+	log.Printf("Redfish: %s accepted for %s", resetType, d.ssh.targetConfig().Name)
+	return nil
+}
+
+// request sends a request to the BMC and decodes the JSON answer into out,
+// turning Redfish error messages into errors
+func (d *redfishDriver) request(method, path string, body, out interface{}) error {
+	cfg := d.ssh.targetConfig().Redfish
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(cfg.URL, "/")+path, reader)
+	if err != nil {
+		return fmt.Errorf("redfish %s %s: %v", method, path, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cfg.User != "" {
+		req.SetBasicAuth(cfg.User, cfg.Password)
+	}
+
+	resp, err := cfg.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("redfish %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("redfish %s %s: %v", method, path, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("redfish %s %s: %s%s", method, path, resp.Status, redfishErrorMessage(data))
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("redfish %s %s: invalid answer: %v", method, path, err)
+		}
+	}
+	return nil
+}
+
+// redfishErrorMessage extracts the message of a Redfish error answer
+func redfishErrorMessage(data []byte) string {
+	var answer struct {
+		Error struct {
+			Message      string `json:"message"`
+			ExtendedInfo []struct {
+				Message string `json:"Message"`
+			} `json:"@Message.ExtendedInfo"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &answer) != nil {
+		return ""
+	}
+	for _, info := range answer.Error.ExtendedInfo {
+		if info.Message != "" {
+			return ": " + info.Message
+		}
+	}
+	if answer.Error.Message != "" {
+		return ": " + answer.Error.Message
+	}
+	return ""
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Paths served by the mock BMC, which has a single computer system
+const (
+	mockBMCSystems = "/redfish/v1/Systems"
+	mockBMCSystem  = mockBMCSystems + "/1"
+	mockBMCReset   = mockBMCSystem + "/Actions/ComputerSystem.Reset"
+)
+
+// mockBMC is a minimal Redfish service with one computer system. Powering on
+// and shutting down leave the system in a transitional state until settle.
+type mockBMC struct {
+	mu       sync.Mutex
+	state    string
+	final    string   // State reached by settle, empty when not in transition
+	resets   []string // Reset types received
+	lookups  int      // Requests for the systems collection
+	user     string
+	password string
+}
+
+// newMockBMC serves a mock BMC and makes it the BMC of the primary target
+func newMockBMC(t *testing.T, state string) (*mockBMC, *httptest.Server) {
+	t.Helper()
+	bmc := &mockBMC{state: state, user: "wol", password: "secret"}
+	server := httptest.NewServer(bmc)
+	t.Cleanup(server.Close)
+
+	cfg := testConfig()
+	cfg.Targets[0].Driver = driverRedfish
+	cfg.Targets[0].Redfish = RedfishConfig{URL: server.URL, User: "wol", Password: "secret"}
+	useConfig(t, cfg)
+	return bmc, server
+}
+
+// ServeHTTP answers the systems collection, the system and its reset action
+func (m *mockBMC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if user, password, ok := r.BasicAuth(); !ok || user != m.user || password != m.password {
+		mockBMCError(w, http.StatusUnauthorized, "Invalid user name or password.")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == mockBMCSystems:
+		m.lookups++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Members": []map[string]string{{"@odata.id": mockBMCSystem}},
+		})
+	case r.Method == "GET" && r.URL.Path == mockBMCSystem:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"@odata.id":  mockBMCSystem,
+			"PowerState": m.state,
+			"Actions": map[string]interface{}{
+				"#ComputerSystem.Reset": map[string]string{"target": mockBMCReset},
+			},
+		})
+	case r.Method == "POST" && r.URL.Path == mockBMCReset:
+		var req struct {
+			ResetType string `json:"ResetType"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			mockBMCError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse request body: %v", err))
+			return
+		}
+		if err := m.reset(req.ResetType); err != nil {
+			mockBMCError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		mockBMCError(w, http.StatusNotFound, fmt.Sprintf("Resource %s not found.", r.URL.Path))
+	}
+}
+
+// reset carries out a reset type as a BMC would; the caller holds the lock
+func (m *mockBMC) reset(resetType string) error {
+	m.resets = append(m.resets, resetType)
+	switch resetType {
+	case "On":
+		if m.state == redfishOff {
+			m.state, m.final = redfishPoweringOn, redfishOn
+		}
+	case "GracefulShutdown":
+		if m.state == redfishOn {
+			m.state, m.final = redfishPoweringOff, redfishOff
+		}
+	case "GracefulRestart":
+		if m.state != redfishOn {
+			return fmt.Errorf("The system is %s and cannot be restarted.", m.state)
+		}
+		m.state, m.final = redfishPoweringOn, redfishOn
+	case "ForceOff":
+		m.state, m.final = redfishOff, ""
+	default:
+		return fmt.Errorf("The value %q for the property ResetType is not in the list of acceptable values.", resetType)
+	}
+	return nil
+}
+
+// settle ends the running power transition
+func (m *mockBMC) settle() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.final != "" {
+		m.state, m.final = m.final, ""
+	}
+}
+
+// snapshot returns the power state and the reset types received so far
+func (m *mockBMC) snapshot() (string, []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, append([]string(nil), m.resets...)
+}
+
+// mockBMCError writes a Redfish error answer
+func mockBMCError(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":                  "Base.1.8.GeneralError",
+			"message":               message,
+			"@Message.ExtendedInfo": []map[string]string{{"Message": message}},
+		},
+	})
+}
+
+// testRedfishDriver returns the redfish driver of the primary target
+func testRedfishDriver() *redfishDriver {
+	return &redfishDriver{ssh: &wolSSHDriver{}}
+}
+
+func TestRedfishDriverPower(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      string
+		run        func(d *redfishDriver) error
+		wantResets []string
+		wantState  string // After the transition settled
+	}{
+		{name: "power on", state: redfishOff, run: (*redfishDriver).Wake,
+			wantResets: []string{"On"}, wantState: redfishOn},
+		{name: "power on while on", state: redfishOn, run: (*redfishDriver).Wake,
+			wantState: redfishOn},
+		{name: "power on while powering on", state: redfishPoweringOn, run: (*redfishDriver).Wake,
+			wantState: redfishPoweringOn},
+		{name: "graceful shutdown", state: redfishOn, run: func(d *redfishDriver) error { return d.Shutdown("") },
+			wantResets: []string{"GracefulShutdown"}, wantState: redfishOff},
+		{name: "reboot", state: redfishOn, run: func(d *redfishDriver) error { return d.Action(actionReboot, "") },
+			wantResets: []string{"GracefulRestart"}, wantState: redfishOn},
+		{name: "force off", state: redfishOn, run: func(d *redfishDriver) error { return d.Action(actionForceOff, "") },
+			wantResets: []string{"ForceOff"}, wantState: redfishOff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bmc, _ := newMockBMC(t, tt.state)
+			if err := tt.run(testRedfishDriver()); err != nil {
+				t.Fatalf("driver error: %v", err)
+			}
+			bmc.settle()
+			state, resets := bmc.snapshot()
+			if strings.Join(resets, ",") != strings.Join(tt.wantResets, ",") {
+				t.Errorf("resets = %v, want %v", resets, tt.wantResets)
+			}
+			if state != tt.wantState {
+				t.Errorf("power state = %s, want %s", state, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestRedfishDriverPowerState(t *testing.T) {
+	bmc, _ := newMockBMC(t, redfishOff)
+	d := testRedfishDriver()
+
+	steps := []struct {
+		do   func()
+		want string
+	}{
+		{do: func() {}, want: redfishOff},
+		{do: func() { d.Wake() }, want: redfishPoweringOn},
+		{do: bmc.settle, want: redfishOn},
+		{do: func() { d.Shutdown("") }, want: redfishPoweringOff},
+		{do: bmc.settle, want: redfishOff},
+	}
+	for i, step := range steps {
+		step.do()
+		state, err := d.PowerState()
+		if err != nil || state != step.want {
+			t.Errorf("step %d: PowerState = %q, %v; want %q", i, state, err, step.want)
+		}
+	}
+
+	// The system path is looked up once per BMC
+	bmc.mu.Lock()
+	defer bmc.mu.Unlock()
+	if bmc.lookups != 1 {
+		t.Errorf("systems collection requested %d times, want once", bmc.lookups)
+	}
+}
+
+func TestRedfishDriverErrors(t *testing.T) {
+	_, server := newMockBMC(t, redfishOn)
+
+	cfg := testConfig()
+	cfg.Targets[0].Driver = driverRedfish
+	cfg.Targets[0].Redfish = RedfishConfig{URL: server.URL, User: "wol", Password: "wrong"}
+	useConfig(t, cfg)
+	if _, err := testRedfishDriver().PowerState(); err == nil || !strings.Contains(err.Error(), "Invalid user name or password") {
+		t.Errorf("PowerState with a wrong password = %v, want the BMC's message", err)
+	}
+
+	cfg.Targets[0].Redfish = RedfishConfig{URL: server.URL, User: "wol", Password: "secret", System: "2"}
+	if _, err := testRedfishDriver().PowerState(); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("PowerState of an unknown system = %v, want not found", err)
+	}
+
+	cfg.Targets[0].Redfish.System = ""
+	if err := testRedfishDriver().Action(actionReboot, ""); err != nil {
+		t.Fatalf("reboot: %v", err)
+	}
+	if err := testRedfishDriver().Action(actionReboot, ""); err == nil || !strings.Contains(err.Error(), "cannot be restarted") {
+		t.Errorf("reboot while restarting = %v, want the BMC's message", err)
+	}
+}
+
+func TestRedfishClientReuse(t *testing.T) {
+	bmc := RedfishConfig{URL: "https://bmc.test", Insecure: true}
+	client := bmc.client()
+	if bmc.client() != client {
+		t.Error("a second request to the BMC got a new client")
+	}
+	if client.Transport == nil {
+		t.Error("insecure BMC client uses the default transport")
+	}
+
+	changed := []RedfishConfig{
+		{URL: "https://other.test", Insecure: true},
+		{URL: "https://bmc.test"},
+		{URL: "https://bmc.test", Insecure: true, Timeout: "30s"},
+	}
+	for _, cfg := range changed {
+		if cfg.client() == client {
+			t.Errorf("%+v shares the client of %+v", cfg, bmc)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ReloadStatus describes the outcome of the last configuration reload
+type ReloadStatus struct {
+	Time    string `json:"time"`    // When the reload happened
+	Trigger string `json:"trigger"` // "SIGHUP" or the file that changed
+	Success bool   `json:"success"` // Whether the new configuration was applied
+	Message string `json:"message"` // Summary or the validation errors
+}
+
+var lastReload *ReloadStatus
+var reloadMu sync.Mutex
+
+// Interval at which the config files are checked for changes
+const configWatchInterval = 2 * time.Second
+
+// getLastReload returns the outcome of the last reload, or nil if none happened yet
+func getLastReload() *ReloadStatus {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if lastReload == nil {
+		return nil
+	}
+	status := *lastReload
+	return &status
+}
+
+// reloadConfiguration re-reads .env, the config file, schedule.json and the calendars.
+// Everything is validated first; on any error the previous configuration is kept.
+func reloadConfiguration(trigger string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	record := func(success bool, message string) {
+		lastReload = &ReloadStatus{
+			Time:    time.Now().Format("2006-01-02 15:04:05"),
+			Trigger: trigger,
+			Success: success,
+			Message: message,
+		}
+		if success {
+			log.Printf("Configuration reload (%s): %s", trigger, message)
+		} else {
+			log.Printf("Configuration reload (%s) rejected, keeping previous configuration: %s", trigger, message)
+		}
+	}
+
+	loadDotEnv()
+
+	cfg, problems, err := loadConfig(configPath)
+	if err != nil {
+		record(false, err.Error())
+		return
+	}
+	if len(problems) > 0 {
+		record(false, strings.Join(problems, "; "))
+		return
+	}
+
+	newCalendars, err := loadCalendars(cfg)
+	if err != nil {
+		record(false, err.Error())
+		return
+	}
+	calendarsChanged := !reflect.DeepEqual(newCalendars, currentCalendars())
+
+	// Checked last, as a changed schedule is swapped in right away
+	scheduleChanged, err := reloadSchedule(cfg)
+	if err != nil {
+		record(false, err.Error())
+		return
+	}
+
+	// The listener and the schedule file location are only read at startup
+	old := currentConfig()
+	var notes []string
+	if cfg.Server.Port != old.Server.Port {
+		notes = append(notes, fmt.Sprintf("server.port change to %d requires a restart", cfg.Server.Port))
+		cfg.Server.Port = old.Server.Port
+	}
+	if cfg.Schedule.File != old.Schedule.File {
+		notes = append(notes, "schedule.file change requires a restart")
+		cfg.Schedule.File = old.Schedule.File
+	}
+	if cfg.Schedule.History != old.Schedule.History {
+		notes = append(notes, "schedule.history change requires a restart")
+		cfg.Schedule.History = old.Schedule.History
+	}
+	if cfg.Leases.File != old.Leases.File {
+		notes = append(notes, "leases.file change requires a restart")
+		cfg.Leases.File = old.Leases.File
+	}
+	if !reflect.DeepEqual(cfg.Proxy.Ports, old.Proxy.Ports) {
+		notes = append(notes, "proxy.ports change requires a restart")
+		cfg.Proxy.Ports = old.Proxy.Ports
+	}
+
+	configChanged := !reflect.DeepEqual(cfg, old)
+	if !configChanged && !scheduleChanged && !calendarsChanged && len(notes) == 0 {
+		// Our own writes to schedule.json also trigger the watcher; stay quiet for those
+		if trigger == "SIGHUP" {
+			record(true, "no changes")
+		}
+		return
+	}
+
+	if configChanged {
+		applyConfig(cfg)
+		notes = append([]string{"configuration applied"}, notes...)
+	}
+	if scheduleChanged {
+		notes = append(notes, "schedule reloaded")
+	}
+	if calendarsChanged {
+		applyCalendars(newCalendars)
+		notes = append(notes, "calendars reloaded")
+	}
+	record(true, strings.Join(notes, ", "))
+}
+
+// reloadSchedule validates schedule.json against the configuration being
+// loaded and swaps it in if it differs from the schedule in memory
+func reloadSchedule(cfg *Config) (bool, error) {
+	return scheduleStore.Reload(func(schedule *ScheduleConfig) error {
+		if _, err := migrateLegacySchedule(schedule); err != nil {
+			return fmt.Errorf("%s: %v", scheduleConfigPath, err)
+		}
+		if err := validateScheduleConfig(*schedule, cfg); err != nil {
+			return fmt.Errorf("%s: %v", scheduleConfigPath, err)
+		}
+		return nil
+	})
+}
+
+// watchConfiguration reloads the configuration on SIGHUP and whenever one of
+// the configuration files changes on disk
+func watchConfiguration() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// The calendar files may change with the configuration
+	files := func() []string {
+		list := []string{configPath, ".env", scheduleConfigPath}
+		for _, file := range []string{currentConfig().Calendar.Blackout, currentConfig().Calendar.Events} {
+			if file != "" && !containsString(list, file) {
+				list = append(list, file)
+			}
+		}
+		return list
+	}
+	seen := map[string]string{}
+	fingerprint := func(path string) string {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "missing"
+		}
+		return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+	}
+	for _, file := range files() {
+		seen[file] = fingerprint(file)
+	}
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	log.Printf("Watching %s for changes (send SIGHUP to reload manually)", strings.Join(files(), ", "))
+
+	for {
+		select {
+		case <-hup:
+			reloadConfiguration("SIGHUP")
+		case <-ticker.C:
+			for _, file := range files() {
+				current := fingerprint(file)
+				if previous, known := seen[file]; !known {
+					// A calendar file added by a reload, it was read by that reload
+					seen[file] = current
+				} else if current != previous {
+					seen[file] = current
+					reloadConfiguration(file + " changed")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// Embedded zone database, so time zones work on systems without one
+	_ "time/tzdata"
+)
+
+// ScheduleWindow is one named wake/shutdown window, e.g. a nightly backup
+type ScheduleWindow struct {
+	Name         string `json:"name"`
+	Enabled      bool   `json:"enabled"`
+	WakeCron     string `json:"wakeCron"`           // Cron expression (5 fields or @daily-style alias) for booting
+	ShutdownCron string `json:"shutdownCron"`       // Cron expression for the automatic shutdown
+	AutoShutdown bool   `json:"autoShutdown"`       // Whether to automatically shut down at the shutdown time
+	LastRun      string `json:"lastRun"`            // ISO8601 format - when the window last woke the server, found it running or skipped an occurrence
+	TimeZone     string `json:"timeZone,omitempty"` // IANA name, e.g. "Europe/Rome"; empty for the server's local time
+
+	// Optional day lists restricting the days the wake expression fires on
+	Weekdays  []string `json:"weekdays,omitempty"`  // e.g. ["mon", "wed", "fri"]
+	MonthDays []string `json:"monthDays,omitempty"` // e.g. ["1", "15", "last"]
+
+	// When the automatic shutdown happens: "" or "time" at the shutdown time,
+	// "idle" once the server has been idle for the idle timeout of the target
+	ShutdownMode string `json:"shutdownMode,omitempty"`
+
+	// Group woken and shut down in dependency order instead of the primary target
+	Group string `json:"group,omitempty"`
+}
+
+// ScheduleConfig holds the schedule windows and the scheduler state
+type ScheduleConfig struct {
+	Windows           []ScheduleWindow `json:"windows"`
+	StartedBySchedule bool             `json:"startedBySchedule"`      // Whether server was started by scheduler
+	ActiveWindow      string           `json:"activeWindow,omitempty"` // Name of the window that started the server
+
+	// Automatic shutdown of the active window postponed by a guard check
+	ShutdownPostponed *ShutdownDeferral `json:"shutdownPostponed,omitempty"`
+
+	// Since when the server started by an idle shutdown window is idle (RFC3339)
+	IdleSince string `json:"idleSince,omitempty"`
+
+	// When the wake-on-demand proxy woke the server it owns (RFC3339)
+	OnDemandSince string `json:"onDemandSince,omitempty"`
+
+	// Temporary changes: skipped occurrences, pauses and one-time windows
+	Overrides []ScheduleOverride `json:"overrides,omitempty"`
+
+	// Automatic power actions suspended while someone works on the server
+	Maintenance *MaintenanceMode `json:"maintenance,omitempty"`
+
+	// Deprecated: single window format written by older versions, migrated into Windows
+	Enabled      bool   `json:"enabled,omitempty"`
+	WakeCron     string `json:"wakeCron,omitempty"`
+	ShutdownCron string `json:"shutdownCron,omitempty"`
+	AutoShutdown bool   `json:"autoShutdown,omitempty"`
+	LastRun      string `json:"lastRun,omitempty"`
+	StartTime    string `json:"startTime,omitempty"` // "HH:MM", migrated to WakeCron
+	EndTime      string `json:"endTime,omitempty"`   // "HH:MM", migrated to ShutdownCron
+	Frequency    string `json:"frequency,omitempty"` // "daily", "every2days", "weekly", "monthly"
+}
+
+// Name given to the window created from a single window schedule
+const legacyWindowName = "Backup"
+
+// Automatic shutdown modes of a window
+const (
+	shutdownModeTime = "time" // At the shutdown time, the default
+	shutdownModeIdle = "idle" // Once the server has been idle for the idle timeout
+)
+
+// Window returns the window with the given name, or nil
+func (c *ScheduleConfig) Window(name string) *ScheduleWindow {
+	for i := range c.Windows {
+		if c.Windows[i].Name == name {
+			return &c.Windows[i]
+		}
+	}
+	return nil
+}
+
+// HasEnabledWindows reports whether at least one window is enabled
+func (c ScheduleConfig) HasEnabledWindows() bool {
+	for _, window := range c.Windows {
+		if window.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// keepRunState carries the scheduler state and the overrides over from the schedule
+// being replaced, so saving the window list from the UI does not forget what the
+// scheduler did
+func (c *ScheduleConfig) keepRunState(old ScheduleConfig) {
+	c.StartedBySchedule = old.StartedBySchedule
+	c.Maintenance = old.Maintenance
+	c.ActiveWindow = ""
+	c.ShutdownPostponed = nil
+	c.IdleSince = ""
+	c.OnDemandSince = ""
+	if c.Window(old.ActiveWindow) != nil || old.onceOverride(old.ActiveWindow) != nil || old.ActiveWindow == onDemandWindow {
+		c.ActiveWindow = old.ActiveWindow
+		c.ShutdownPostponed = old.ShutdownPostponed
+		c.IdleSince = old.IdleSince
+		c.OnDemandSince = old.OnDemandSince
+	}
+	for i := range c.Windows {
+		if previous := old.Window(c.Windows[i].Name); previous != nil && c.Windows[i].LastRun == "" {
+			c.Windows[i].LastRun = previous.LastRun
+		}
+	}
+
+	// Overrides of windows that were removed go with them
+	c.Overrides = nil
+	for _, o := range old.Overrides {
+		if o.Type == overrideOnce || o.Window == "" || c.Window(o.Window) != nil || old.onceOverride(o.Window) != nil {
+			c.Overrides = append(c.Overrides, o)
+		}
+	}
+}
+
+// releaseServer forgets which window started the server, so it is no longer
+// shut down automatically
+func (c *ScheduleConfig) releaseServer() {
+	c.StartedBySchedule = false
+	c.ActiveWindow = ""
+	c.ShutdownPostponed = nil
+	c.IdleSince = ""
+	c.OnDemandSince = ""
+}
+
+// validateScheduleConfig checks the window list against the configuration conf:
+// names must be set and unique and every enabled window must have valid expressions
+func validateScheduleConfig(cfg ScheduleConfig, conf *Config) error {
+	seen := make(map[string]bool)
+	for i, window := range cfg.Windows {
+		if strings.TrimSpace(window.Name) == "" {
+			return fmt.Errorf("Window %d: name is required", i+1)
+		}
+		if seen[window.Name] {
+			return fmt.Errorf("Window %q: name is used more than once", window.Name)
+		}
+		if window.Name == onDemandWindow {
+			return fmt.Errorf("Window %q: name is reserved for wakes by the proxy", window.Name)
+		}
+		seen[window.Name] = true
+
+		if err := validateScheduleWindow(window, conf); err != nil {
+			return fmt.Errorf("Window %q: %v", window.Name, err)
+		}
+	}
+
+	for _, o := range cfg.Overrides {
+		if err := validateOverride(o, cfg); err != nil {
+			return fmt.Errorf("Override %s: %v", o.ID, err)
+		}
+		if o.Type == overrideOnce {
+			if seen[o.Name] {
+				return fmt.Errorf("Window %q: name is used more than once", o.Name)
+			}
+			if o.Name == onDemandWindow {
+				return fmt.Errorf("Window %q: name is reserved for wakes by the proxy", o.Name)
+			}
+			seen[o.Name] = true
+		}
+	}
+	return nil
+}
+
+// validateScheduleWindow checks the fields of an enabled window, the groups and
+// idle checks it uses against cfg
+func validateScheduleWindow(window ScheduleWindow, cfg *Config) error {
+	if !window.Enabled {
+		return nil
+	}
+
+	if window.WakeCron == "" {
+		return fmt.Errorf("Wake schedule is required. Use a cron expression such as '0 2 * * *' or '@daily'")
+	}
+	if _, err := ParseCron(window.WakeCron); err != nil {
+		return fmt.Errorf("Invalid wake schedule: %v", err)
+	}
+	if _, err := window.wakeSchedule(); err != nil {
+		return err
+	}
+
+	switch window.ShutdownMode {
+	case "", shutdownModeTime, shutdownModeIdle:
+	default:
+		return fmt.Errorf("Invalid shutdown mode %q, use %q or %q", window.ShutdownMode, shutdownModeTime, shutdownModeIdle)
+	}
+
+	if window.ShutdownCron != "" {
+		if _, err := ParseCron(window.ShutdownCron); err != nil {
+			return fmt.Errorf("Invalid shutdown schedule: %v", err)
+		}
+	} else if window.AutoShutdown && !window.idleShutdown() {
+		return fmt.Errorf("Shutdown schedule is required when auto shutdown is enabled")
+	}
+
+	if window.idleShutdown() && !cfg.Targets[0].Idle.Enabled() {
+		return fmt.Errorf("Idle shutdown needs idle checks in the target configuration (idle: ports, sessions, maxLoad or commands)")
+	}
+
+	if window.Group != "" {
+		if _, ok := cfg.Group(window.Group); !ok {
+			return fmt.Errorf("Unknown group %q", window.Group)
+		}
+		if window.idleShutdown() {
+			return fmt.Errorf("Idle shutdown is not supported for group windows, use a shutdown schedule")
+		}
+	}
+
+	return nil
+}
+
+// idleShutdown reports whether the window shuts the server down once it is idle
+func (w ScheduleWindow) idleShutdown() bool {
+	return w.AutoShutdown && w.ShutdownMode == shutdownModeIdle
+}
+
+// location returns the time zone the window is evaluated in
+func (w ScheduleWindow) location() (*time.Location, error) {
+	if w.TimeZone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid time zone %q: use an IANA name such as Europe/Rome", w.TimeZone)
+	}
+	return loc, nil
+}
+
+// wakeSchedule parses the wake expression in the window's time zone and
+// applies the weekday and day-of-month lists of the window
+func (w ScheduleWindow) wakeSchedule() (*CronSchedule, error) {
+	wake, err := ParseCron(w.WakeCron)
+	if err != nil {
+		return nil, err
+	}
+	if wake.loc, err = w.location(); err != nil {
+		return nil, err
+	}
+	if len(w.Weekdays) == 0 && len(w.MonthDays) == 0 {
+		return wake, nil
+	}
+
+	days, err := parseDaySelection(w.Weekdays, w.MonthDays)
+	if err != nil {
+		return nil, err
+	}
+	wake.dayFilter = days.matches
+	return wake, nil
+}
+
+// shutdownSchedule parses the shutdown expression in the window's time zone.
+// It returns nil if the window has no shutdown schedule.
+func (w ScheduleWindow) shutdownSchedule() (*CronSchedule, error) {
+	if w.ShutdownCron == "" {
+		return nil, nil
+	}
+	shutdown, err := ParseCron(w.ShutdownCron)
+	if err != nil {
+		return nil, err
+	}
+	if shutdown.loc, err = w.location(); err != nil {
+		return nil, err
+	}
+	return shutdown, nil
+}
+
+// windowEnd returns when the occurrence woken at wake ends: the first shutdown
+// time at or after it. It is the same instant as wake only when both fall into
+// an hour skipped by a daylight saving change, the window is then empty.
+func windowEnd(shutdown *CronSchedule, wake time.Time) time.Time {
+	return shutdown.Next(wake.Add(-time.Minute))
+}
+
+// daySelection is a parsed set of weekdays and days of the month
+type daySelection struct {
+	weekdays  uint64 // bits 0-6, Sunday = 0; zero means any weekday
+	monthDays uint64 // bits 1-31; zero with lastDay unset means any day
+	lastDay   bool   // the last day of the month
+}
+
+// parseDaySelection parses weekday names (or 0-7) and day numbers or "last"
+func parseDaySelection(weekdays, monthDays []string) (daySelection, error) {
+	var days daySelection
+	for _, value := range weekdays {
+		day, err := parseCronValue(strings.TrimSpace(value), cronDayNames)
+		if err != nil || day < 0 || day > 7 {
+			return days, fmt.Errorf("Invalid weekday %q: use mon, tue, wed, thu, fri, sat or sun", value)
+		}
+		days.weekdays |= 1 << uint(day%7)
+	}
+	for _, value := range monthDays {
+		value = strings.TrimSpace(value)
+		if strings.EqualFold(value, "last") || strings.EqualFold(value, "L") {
+			days.lastDay = true
+			continue
+		}
+		day, err := strconv.Atoi(value)
+		if err != nil || day < 1 || day > 31 {
+			return days, fmt.Errorf("Invalid day of month %q: use 1-31 or last", value)
+		}
+		days.monthDays |= 1 << uint(day)
+	}
+	return days, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// matches reports whether t falls on a selected day. When both lists are set
+// a day has to be in both.
+func (d daySelection) matches(t time.Time) bool {
+	if d.weekdays != 0 && d.weekdays&(1<<uint(t.Weekday())) == 0 {
+		return false
+	}
+	if d.monthDays == 0 && !d.lastDay {
+		return true
+	}
+	if d.monthDays&(1<<uint(t.Day())) != 0 {
+		return true
+	}
+	return d.lastDay && t.AddDate(0, 0, 1).Day() == 1
+}
+
+// migrateLegacySchedule converts schedules written by older versions - a single
+// window with StartTime/EndTime/Frequency or with cron expressions - into the
+// window list. It reports whether anything was migrated.
+func migrateLegacySchedule(cfg *ScheduleConfig) (bool, error) {
+	hasLegacy := cfg.Enabled || cfg.WakeCron != "" || cfg.ShutdownCron != "" || cfg.AutoShutdown ||
+		cfg.LastRun != "" || cfg.StartTime != "" || cfg.EndTime != "" || cfg.Frequency != ""
+	if !hasLegacy {
+		return false, nil
+	}
+
+	if len(cfg.Windows) == 0 && (cfg.WakeCron != "" || cfg.StartTime != "") {
+		window := ScheduleWindow{
+			Name:         legacyWindowName,
+			Enabled:      cfg.Enabled,
+			WakeCron:     cfg.WakeCron,
+			ShutdownCron: cfg.ShutdownCron,
+			AutoShutdown: cfg.AutoShutdown,
+			LastRun:      cfg.LastRun,
+		}
+		if cfg.WakeCron == "" {
+			if err := migrateLegacyTimes(&window, cfg.StartTime, cfg.EndTime, cfg.Frequency); err != nil {
+				return false, err
+			}
+		}
+		cfg.Windows = []ScheduleWindow{window}
+		if cfg.StartedBySchedule {
+			cfg.ActiveWindow = window.Name
+		}
+		log.Printf("Migrated single schedule to window %q: wake=%q shutdown=%q",
+			window.Name, window.WakeCron, window.ShutdownCron)
+	}
+
+	// Drop the old fields so the file is only in the new format
+	cfg.Enabled, cfg.WakeCron, cfg.ShutdownCron, cfg.AutoShutdown, cfg.LastRun = false, "", "", false, ""
+	cfg.StartTime, cfg.EndTime, cfg.Frequency = "", "", ""
+	return true, nil
+}
+
+// migrateLegacyTimes converts the old StartTime/EndTime/Frequency fields into cron expressions
+func migrateLegacyTimes(window *ScheduleWindow, startTime, endTime, frequency string) error {
+	// Anchor weekly and monthly schedules on the day they last ran
+	ref := clock.Now()
+	if lastRun, err := time.Parse(time.RFC3339, window.LastRun); err == nil {
+		ref = lastRun
+	}
+
+	wake, err := legacyFrequencyToCron(startTime, frequency, ref)
+	if err != nil {
+		return fmt.Errorf("cannot migrate start time: %v", err)
+	}
+
+	// The shutdown applies to the window opened by the last wake, so a daily
+	// expression at the old end time is equivalent for every frequency
+	shutdown := window.ShutdownCron
+	if endTime != "" {
+		if shutdown, err = legacyFrequencyToCron(endTime, "daily", ref); err != nil {
+			return fmt.Errorf("cannot migrate end time: %v", err)
+		}
+	}
+
+	log.Printf("Migrated schedule start=%s end=%s frequency=%s to wake=%q shutdown=%q",
+		startTime, endTime, frequency, wake, shutdown)
+	if frequency == "every2days" {
+		// The odd days of the month are not every 48 hours, let the user confirm
+		log.Printf("Warning: frequency every2days has no exact cron equivalent, window %q is disabled with wake=%q (odd days of the month): check the expression and enable the window",
+			window.Name, wake)
+		window.Enabled = false
+	}
+	window.WakeCron = wake
+	window.ShutdownCron = shutdown
+	return nil
+}
+
+// ScheduledWake is an upcoming wake time and the window it belongs to
+type ScheduledWake struct {
+	Time   time.Time
+	Window string
+}
+
+// NextWakes returns the next n wake times of all enabled windows and one-time
+// windows after now, leaving out the occurrences cancelled by an override
+func (c ScheduleConfig) NextWakes(now time.Time, n int) []ScheduledWake {
+	var wakes []ScheduledWake
+	add := func(name string, wake *CronSchedule) {
+		// Look further ahead so skipped occurrences do not shorten the list
+		for _, t := range wake.NextN(now, n+len(c.Overrides)) {
+			if c.cancelReason(name, t) == "" {
+				wakes = append(wakes, ScheduledWake{Time: t, Window: name})
+			}
+		}
+	}
+	for _, window := range c.Windows {
+		if !window.Enabled {
+			continue
+		}
+		wake, err := window.wakeSchedule()
+		if err != nil {
+			continue
+		}
+		add(window.Name, wake)
+	}
+	for _, o := range c.Overrides {
+		if o.Type != overrideOnce {
+			continue
+		}
+		if window, wake, _, err := o.onceWindow(); err == nil {
+			add(window.Name, wake)
+		}
+	}
+
+	sort.Slice(wakes, func(i, j int) bool { return wakes[i].Time.Before(wakes[j].Time) })
+	if len(wakes) > n {
+		wakes = wakes[:n]
+	}
+	return wakes
+}
+
+// GetScheduleConfig returns the current schedule config
+func GetScheduleConfig() ScheduleConfig {
+	return scheduleStore.Get()
+}
+
+// UpdateScheduleConfig updates the schedule configuration
+func UpdateScheduleConfig(newConfig ScheduleConfig) error {
+	return scheduleStore.Set(newConfig)
+}
+
+// CheckSchedule checks if server should be on/off based on schedule: it should be on
+// while any enabled window is open
+func CheckSchedule() (shouldBeOn bool) {
+	now := clock.Now()
+	for _, window := range GetScheduleConfig().Windows {
+		if window.Enabled && window.isOpen(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOpen reports whether now is between the latest wake time of the window
+// and the first shutdown time that follows it
+func (w ScheduleWindow) isOpen(now time.Time) bool {
+	wake, err := w.wakeSchedule()
+	if err != nil {
+		log.Printf("Schedule window %q invalid: %v", w.Name, err)
+		return false
+	}
+
+	lastWake := wake.Prev(now)
+	if lastWake.IsZero() {
+		return false
+	}
+
+	shutdown, err := w.shutdownSchedule()
+	if err != nil {
+		log.Printf("Schedule window %q invalid: %v", w.Name, err)
+		return false
+	}
+	// Without a shutdown time the server stays on until shut down manually
+	if shutdown == nil {
+		return true
+	}
+
+	open := now.Before(windowEnd(shutdown, lastWake))
+	log.Printf("Schedule window check: Window=%q, LastWake=%s, Open=%v", w.Name, lastWake.Format(time.RFC3339), open)
+	return open
+}
+
+// ShouldRunToday checks if any enabled window has a wake time on the day of now,
+// taking the day in the window's time zone. Wake times cancelled by an override
+// or a blackout day do not count.
+func ShouldRunToday(now time.Time) bool {
+	cfg := GetScheduleConfig()
+	for _, window := range cfg.Windows {
+		if !window.Enabled {
+			continue
+		}
+		wake, err := window.wakeSchedule()
+		if err != nil {
+			log.Printf("Error parsing wake schedule '%s': %v", window.WakeCron, err)
+			continue
+		}
+		local := now.In(wake.loc)
+		startOfDay := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, wake.loc)
+		endOfDay := startOfDay.AddDate(0, 0, 1)
+		for next := wake.Next(startOfDay.Add(-time.Minute)); !next.IsZero() && next.Before(endOfDay); next = wake.Next(next) {
+			if cfg.cancelReason(window.Name, next) == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ScheduleStore guards the schedule configuration shared by the HTTP handlers
+// and the scheduler, and persists every change to disk atomically
+type ScheduleStore struct {
+	mu     sync.RWMutex
+	path   string
+	config ScheduleConfig
+}
+
+var scheduleStore = NewScheduleStore(scheduleConfigPath)
+
+// NewScheduleStore creates a store backed by the file at path. With an empty
+// path the schedule is only kept in memory.
+func NewScheduleStore(path string) *ScheduleStore {
+	return &ScheduleStore{
+		path:   path,
+		config: defaultScheduleConfig(),
+	}
+}
+
+// defaultScheduleConfig is the schedule used when no file exists yet
+func defaultScheduleConfig() ScheduleConfig {
+	return ScheduleConfig{
+		Windows:           []ScheduleWindow{},
+		StartedBySchedule: false,
+	}
+}
+
+// backupPath is where the previous version of the schedule file is kept
+func (s *ScheduleStore) backupPath() string {
+	return s.path + ".bak"
+}
+
+// legacyPath is where a schedule written by an older version is kept when it
+// is migrated; unlike the backup it is written once and never rotated
+func (s *ScheduleStore) legacyPath() string {
+	return s.path + ".legacy"
+}
+
+// Load reads the schedule from disk. If the file is corrupt the backup copy is used.
+func (s *ScheduleStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check if config file exists
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		// Create and save the default config
+		s.config = defaultScheduleConfig()
+		return s.saveLocked()
+	}
+
+	source := s.path
+	config, err := readScheduleFile(s.path)
+	restored := false
+	if err != nil {
+		backup, backupErr := readScheduleFile(s.backupPath())
+		if backupErr != nil {
+			return err
+		}
+		log.Printf("Warning: %v - restored schedule from backup %s", err, s.backupPath())
+		config = backup
+		source = s.backupPath()
+		restored = true
+	}
+
+	s.config = config
+
+	// Convert schedules written by older versions to the window list
+	migrated, err := migrateLegacySchedule(&s.config)
+	if migrated || err != nil {
+		s.keepLegacyLocked(source)
+	}
+	if err != nil {
+		log.Printf("Warning: %v - dropping the old schedule, the previous file is kept in %s", err, s.legacyPath())
+		s.config = defaultScheduleConfig()
+		migrated = true
+	}
+	if migrated || restored {
+		return s.saveLocked()
+	}
+	return nil
+}
+
+// keepLegacyLocked copies the schedule file about to be migrated to the legacy
+// path, unless an earlier migration already did; the caller holds the lock
+func (s *ScheduleStore) keepLegacyLocked(source string) {
+	if s.path == "" {
+		return
+	}
+	if _, err := os.Stat(s.legacyPath()); err == nil {
+		return
+	}
+	data, err := os.ReadFile(source)
+	if err == nil {
+		err = writeFileAtomic(s.legacyPath(), data, 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to keep the old schedule in %s: %v", s.legacyPath(), err)
+	}
+}
+
+// Get returns a copy of the current schedule
+func (s *ScheduleStore) Get() ScheduleConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// Set replaces the schedule and persists it
+func (s *ScheduleStore) Set(config ScheduleConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	return s.saveLocked()
+}
+
+// Update applies fn to the schedule under the lock and persists the result.
+// Use it for read-modify-write changes so concurrent updates are not lost.
+func (s *ScheduleStore) Update(fn func(*ScheduleConfig)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.config)
+	return s.saveLocked()
+}
+
+// UpdateIf applies fn to the schedule under the lock and writes it only when
+// fn reports a change
+func (s *ScheduleStore) UpdateIf(fn func(*ScheduleConfig) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !fn(&s.config) {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+// Replace swaps the in-memory schedule without writing it
+func (s *ScheduleStore) Replace(config ScheduleConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+}
+
+// Reload reads the file again and swaps it in without writing it when it
+// differs from the schedule in memory, used when the file was changed on disk.
+// check validates the schedule read. Reading, comparing and swapping happen
+// under the lock, so a concurrent Update is never overwritten by a stale read.
+func (s *ScheduleStore) Reload(check func(*ScheduleConfig) error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return false, nil
+	}
+	config, err := readScheduleFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	if err := check(&config); err != nil {
+		return false, err
+	}
+
+	// Compare the JSON encodings: decoding turns an empty list into nil
+	current, err := json.Marshal(s.config)
+	if err != nil {
+		return false, err
+	}
+	reloaded, err := json.Marshal(config)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(current, reloaded) {
+		return false, nil
+	}
+	s.config = config
+	return true, nil
+}
+
+// saveLocked writes the schedule to disk; the caller must hold the lock
+func (s *ScheduleStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal schedule config: %v", err)
+	}
+
+	// Keep the last good version around in case the new one gets damaged
+	if previous, err := os.ReadFile(s.path); err == nil && json.Valid(previous) {
+		if err := writeFileAtomic(s.backupPath(), previous, 0644); err != nil {
+			log.Printf("Warning: failed to update schedule backup: %v", err)
+		}
+	}
+
+	if err := writeFileAtomic(s.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save schedule config: %v", err)
+	}
+
+	return nil
+}
+
+// readScheduleFile parses a schedule file
+func readScheduleFile(path string) (ScheduleConfig, error) {
+	var config ScheduleConfig
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read schedule config file: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse schedule config %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// writeFileAtomic writes data to a temporary file, syncs it and renames it over
+// path, so a crash never leaves a partially written file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	// Clean up the temporary file on any failure
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	success = true
+
+	// Sync the directory so the rename itself survives a power loss
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
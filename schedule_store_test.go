@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestStore returns a store backed by schedule.json in a temporary directory
+func newTestStore(t *testing.T) *ScheduleStore {
+	t.Helper()
+	return NewScheduleStore(filepath.Join(t.TempDir(), "schedule.json"))
+}
+
+func TestScheduleStoreConcurrentUpdates(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	const writers, updates = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				err := store.Update(func(c *ScheduleConfig) {
+					c.Windows = append(c.Windows, ScheduleWindow{Name: fmt.Sprintf("w%d-%d", i, j)})
+				})
+				if err != nil {
+					t.Errorf("Update: %v", err)
+				}
+			}
+		}(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				_ = len(store.Get().Windows)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(store.Get().Windows); got != writers*updates {
+		t.Fatalf("got %d windows in memory, want %d", got, writers*updates)
+	}
+	saved, err := readScheduleFile(store.path)
+	if err != nil {
+		t.Fatalf("readScheduleFile: %v", err)
+	}
+	if got := len(saved.Windows); got != writers*updates {
+		t.Fatalf("got %d windows on disk, want %d", got, writers*updates)
+	}
+}
+
+func TestScheduleStoreAtomicWrite(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Set(ScheduleConfig{Windows: []ScheduleWindow{{Name: "first"}}}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := store.Set(ScheduleConfig{Windows: []ScheduleWindow{{Name: "second"}}}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	current, err := readScheduleFile(store.path)
+	if err != nil || len(current.Windows) != 1 || current.Windows[0].Name != "second" {
+		t.Fatalf("schedule file = %+v, %v; want the second window", current, err)
+	}
+	backup, err := readScheduleFile(store.backupPath())
+	if err != nil || len(backup.Windows) != 1 || backup.Windows[0].Name != "first" {
+		t.Fatalf("backup file = %+v, %v; want the first window", backup, err)
+	}
+
+	// No temporary file is left behind
+	entries, err := os.ReadDir(filepath.Dir(store.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp-") {
+			t.Errorf("temporary file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestScheduleStoreRestoresBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		backup  string
+		wantErr bool
+	}{
+		{name: "valid backup", backup: `{"windows":[{"name":"saved","enabled":false}]}`},
+		{name: "missing backup", wantErr: true},
+		{name: "corrupt backup", backup: `{"windows":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			if err := os.WriteFile(store.path, []byte(`{"windows": [`), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.backup != "" {
+				if err := os.WriteFile(store.backupPath(), []byte(tt.backup), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := store.Load()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Load succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if w := store.Get().Windows; len(w) != 1 || w[0].Name != "saved" {
+				t.Fatalf("windows = %+v, want the backup", w)
+			}
+
+			// The restored schedule is written back over the corrupt file
+			data, err := os.ReadFile(store.path)
+			if err != nil || !json.Valid(data) {
+				t.Fatalf("schedule file not repaired: %v", err)
+			}
+		})
+	}
+}
+
+func TestScheduleStoreReload(t *testing.T) {
+	accept := func(*ScheduleConfig) error { return nil }
+
+	t.Run("unchanged file with empty lists", func(t *testing.T) {
+		store := newTestStore(t)
+		// Decoding drops the empty weekday list, which must not count as a change
+		if err := store.Set(ScheduleConfig{Windows: []ScheduleWindow{{Name: "w", Weekdays: []string{}}}}); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := store.Reload(accept)
+		if err != nil || changed {
+			t.Fatalf("Reload = %v, %v; want no change", changed, err)
+		}
+	})
+
+	t.Run("changed file", func(t *testing.T) {
+		store := newTestStore(t)
+		if err := store.Set(ScheduleConfig{Windows: []ScheduleWindow{{Name: "old"}}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(store.path, []byte(`{"windows":[{"name":"new"}]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := store.Reload(accept)
+		if err != nil || !changed {
+			t.Fatalf("Reload = %v, %v; want a change", changed, err)
+		}
+		if w := store.Get().Windows; len(w) != 1 || w[0].Name != "new" {
+			t.Fatalf("windows = %+v, want the file", w)
+		}
+	})
+
+	t.Run("rejected file", func(t *testing.T) {
+		store := newTestStore(t)
+		if err := store.Set(ScheduleConfig{Windows: []ScheduleWindow{{Name: "old"}}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(store.path, []byte(`{"windows":[{"name":"new"}]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := store.Reload(func(*ScheduleConfig) error { return fmt.Errorf("invalid") })
+		if err == nil || changed {
+			t.Fatalf("Reload = %v, %v; want an error", changed, err)
+		}
+		if w := store.Get().Windows; w[0].Name != "old" {
+			t.Fatalf("windows = %+v, want the schedule kept", w)
+		}
+	})
+
+	t.Run("concurrent updates are kept", func(t *testing.T) {
+		store := newTestStore(t)
+		if err := store.Set(ScheduleConfig{Windows: []ScheduleWindow{{Name: "w"}}}); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(2)
+			stamp := fmt.Sprintf("run-%d", i)
+			go func() {
+				defer wg.Done()
+				store.Update(func(c *ScheduleConfig) { c.Windows[0].LastRun = stamp })
+			}()
+			go func() {
+				defer wg.Done()
+				if _, err := store.Reload(accept); err != nil {
+					t.Errorf("Reload: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// Whatever the interleaving, memory matches the last write to disk
+		saved, err := readScheduleFile(store.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := store.Get().Windows[0].LastRun, saved.Windows[0].LastRun; got != want {
+			t.Fatalf("LastRun in memory %q, on disk %q", got, want)
+		}
+	})
+}
+
+func TestScheduleStoreUpdateIf(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.UpdateIf(func(c *ScheduleConfig) bool { return false }); err != nil {
+		t.Fatalf("UpdateIf: %v", err)
+	}
+	if _, err := os.Stat(store.path); !os.IsNotExist(err) {
+		t.Fatalf("schedule written without a change: %v", err)
+	}
+
+	err := store.UpdateIf(func(c *ScheduleConfig) bool {
+		c.Windows = append(c.Windows, ScheduleWindow{Name: "w"})
+		return true
+	})
+	if err != nil {
+		t.Fatalf("UpdateIf: %v", err)
+	}
+	saved, err := readScheduleFile(store.path)
+	if err != nil || len(saved.Windows) != 1 {
+		t.Fatalf("schedule file = %+v, %v; want the change written", saved, err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateLegacySchedule(t *testing.T) {
+	// Monday 2026-03-16, anchoring weekly and monthly schedules
+	const lastRun = "2026-03-16T02:00:00Z"
+
+	tests := []struct {
+		name         string
+		frequency    string
+		wantWake     string
+		wantShutdown string
+		wantDisabled bool // Migrated disabled for the user to confirm
+		wantErr      string
+	}{
+		{name: "daily", frequency: "daily", wantWake: "0 2 * * *", wantShutdown: "30 4 * * *"},
+		{name: "empty frequency", frequency: "", wantWake: "0 2 * * *", wantShutdown: "30 4 * * *"},
+		{name: "weekly", frequency: "weekly", wantWake: "0 2 * * 1", wantShutdown: "30 4 * * *"},
+		{name: "monthly", frequency: "monthly", wantWake: "0 2 16 * *", wantShutdown: "30 4 * * *"},
+		{name: "every two days", frequency: "every2days", wantWake: "0 2 */2 * *", wantShutdown: "30 4 * * *", wantDisabled: true},
+		{name: "unknown", frequency: "hourly", wantErr: "invalid frequency"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ScheduleConfig{
+				Enabled:      true,
+				StartTime:    "02:00",
+				EndTime:      "04:30",
+				Frequency:    tt.frequency,
+				AutoShutdown: true,
+				LastRun:      lastRun,
+			}
+			migrated, err := migrateLegacySchedule(&cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("migrateLegacySchedule error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !migrated {
+				t.Fatalf("migrateLegacySchedule = %v, %v", migrated, err)
+			}
+			if len(cfg.Windows) != 1 {
+				t.Fatalf("got %d windows, want 1", len(cfg.Windows))
+			}
+			w := cfg.Windows[0]
+			if w.WakeCron != tt.wantWake || w.ShutdownCron != tt.wantShutdown {
+				t.Errorf("wake=%q shutdown=%q, want wake=%q shutdown=%q", w.WakeCron, w.ShutdownCron, tt.wantWake, tt.wantShutdown)
+			}
+			if w.Enabled == tt.wantDisabled || !w.AutoShutdown || w.LastRun != lastRun {
+				t.Errorf("window %+v lost the legacy settings", w)
+			}
+			if cfg.StartTime != "" || cfg.Frequency != "" || cfg.Enabled {
+				t.Errorf("legacy fields not cleared: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestScheduleStoreMigratesEvery2Days(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedule.json")
+	legacy := `{"enabled": true, "startTime": "02:00", "endTime": "04:30", "frequency": "every2days",
+  "autoShutdown": true, "lastRun": "2026-03-16T02:00:00Z", "startedBySchedule": true}`
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewScheduleStore(path)
+	if err := store.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	cfg := store.Get()
+	if len(cfg.Windows) != 1 {
+		t.Fatalf("got %d windows, want the migrated one", len(cfg.Windows))
+	}
+	if w := cfg.Windows[0]; w.Enabled || w.WakeCron != "0 2 */2 * *" || w.ShutdownCron != "30 4 * * *" {
+		t.Errorf("window = %+v, want it disabled with the odd-days expression", w)
+	}
+	if !cfg.StartedBySchedule || cfg.ActiveWindow != legacyWindowName {
+		t.Errorf("StartedBySchedule = %v, ActiveWindow = %q; want the server still owned by the window", cfg.StartedBySchedule, cfg.ActiveWindow)
+	}
+
+	// Later saves rotate the backup but keep the window and the original file
+	for i := 0; i < 2; i++ {
+		if err := store.Update(func(c *ScheduleConfig) { c.setLastRun(legacyWindowName, time.Now()) }); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	}
+	reloaded := NewScheduleStore(path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load after saving: %v", err)
+	}
+	if w := reloaded.Get().Windows; len(w) != 1 || w[0].WakeCron != "0 2 */2 * *" {
+		t.Errorf("windows after saving = %+v, want the migrated window", w)
+	}
+	kept, err := os.ReadFile(reloaded.legacyPath())
+	if err != nil || string(kept) != legacy {
+		t.Errorf("legacy file = %q, %v; want the original schedule", kept, err)
+	}
+}
@@ -0,0 +1,884 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// How long to wait before retrying a failed automatic shutdown
+const shutdownRetryInterval = time.Minute
+
+// scheduledWake is a wake workflow started for the occurrence of a window
+type scheduledWake struct {
+	window  string
+	planned time.Time
+	result  WakeResult
+	group   *GroupResult // Result of the run of a group window instead
+}
+
+// scheduler keeps what the schedule checker remembers between checks
+type scheduler struct {
+	clock          Clock
+	power          PowerDriver
+	store          *ScheduleStore
+	history        *HistoryStore
+	wakes          *wakeTracker
+	leases         *LeaseStore
+	groups         *groupTracker
+	powerFor       func(target string) PowerDriver // Drivers of the members of group windows
+	startedAt      time.Time                       // Process start, wake times before it are caught up
+	missed         map[string]time.Time            // Wake occurrence already reported as missed, per window
+	held           map[string]time.Time            // Wake occurrence held back by maintenance mode, per window
+	shutdownFailed map[string]time.Time            // Last failed shutdown round, per window
+	booting        map[string]time.Time            // Woken occurrence not seen online yet, per window
+	stopping       map[string]time.Time            // Shut down occurrence not seen offline yet, per window
+	idleChecked    time.Time                       // Last idle check of a server started by an idle shutdown window
+	leaseHeld      map[string]string               // Leases last reported as blocking the shutdown, per window
+	maintenance    bool                            // Whether the last check was in maintenance mode
+	waking         *scheduledWake                  // Wake workflow started by a window, running in the background
+	wakeDone       chan scheduledWake              // Receives the result of that workflow once it ends
+	syncWakes      bool                            // Wait for wake workflows, for a clock that only moves with the checker
+
+	// Where decisions are logged and notifications sent
+	logf   func(format string, v ...interface{})
+	notify func(event, message string)
+}
+
+func newScheduler(clock Clock, power PowerDriver, store *ScheduleStore, history *HistoryStore) *scheduler {
+	s := &scheduler{
+		clock:          clock,
+		power:          power,
+		store:          store,
+		history:        history,
+		wakes:          &wakeTracker{},
+		leases:         NewLeaseStore(""),
+		groups:         &groupTracker{last: make(map[string]*GroupResult), running: make(map[string]bool)},
+		startedAt:      clock.Now(),
+		missed:         make(map[string]time.Time),
+		held:           make(map[string]time.Time),
+		shutdownFailed: make(map[string]time.Time),
+		booting:        make(map[string]time.Time),
+		stopping:       make(map[string]time.Time),
+		leaseHeld:      make(map[string]string),
+		wakeDone:       make(chan scheduledWake, 1),
+		logf:           log.Printf,
+		notify:         notify,
+	}
+	s.powerFor = func(string) PowerDriver { return s.power }
+	return s
+}
+
+// Verify and clean up schedule configuration
+func verifyScheduleConfig() {
+	log.Println("Verifying schedule configuration...")
+
+	// Disable the windows that can't run rather than the whole schedule
+	for _, window := range GetScheduleConfig().Windows {
+		if !window.Enabled {
+			continue
+		}
+		log.Printf("Window %q: Wake=%q, Shutdown=%q, AutoShutdown=%v",
+			window.Name, window.WakeCron, window.ShutdownCron, window.AutoShutdown)
+
+		if err := validateScheduleWindow(window, currentConfig()); err != nil {
+			log.Printf("Warning: window %q: %v - disabling window", window.Name, err)
+			name := window.Name
+			scheduleStore.Update(func(c *ScheduleConfig) {
+				if w := c.Window(name); w != nil {
+					w.Enabled = false
+				}
+			})
+		}
+	}
+}
+
+// Run a periodic check of schedule and take appropriate actions
+func runScheduleChecker() {
+	s := newScheduler(clock, power, scheduleStore, historyStore)
+	s.wakes = wakes
+	s.leases = leaseStore
+	s.groups = groupRuns
+	s.powerFor = powerFor
+
+	// Use a slightly shorter interval for more responsive scheduling
+	// First check immediately at startup
+	s.checkOnce()
+
+	// Then set up regular checks
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("Schedule checker started - checking every 5 seconds")
+	for _, window := range GetScheduleConfig().Windows {
+		log.Printf("Current schedule window %q: enabled=%v, wake=%q, shutdown=%q, autoShutdown=%v",
+			window.Name, window.Enabled, window.WakeCron, window.ShutdownCron, window.AutoShutdown)
+	}
+
+	for {
+		func() {
+			// Recover from any panics that might occur in the schedule checker
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Recovered from panic in schedule checker: %v", r)
+				}
+			}()
+
+			s.checkOnce()
+		}()
+
+		// Wait for next tick
+		<-ticker.C
+	}
+}
+
+// checkOnce evaluates every enabled window against the current time
+func (s *scheduler) checkOnce() {
+	now := s.clock.Now()
+	serverIsOn := s.power.Online()
+	scheduleConfig := s.store.Get()
+
+	// Turn upcoming calendar events into one-time windows
+	desired := currentCalendars().eventOverrides(now, now.Add(calendarHorizon), currentConfig().Calendar.AutoShutdown)
+	if probe := scheduleConfig; len(probe.syncCalendarOverrides(desired, now)) > 0 {
+		s.store.Update(func(c *ScheduleConfig) {
+			for _, change := range c.syncCalendarOverrides(desired, now) {
+				s.logf("Calendar: %s", change)
+			}
+		})
+		scheduleConfig = s.store.Get()
+	}
+
+	// Drop the overrides that are over
+	if probe := scheduleConfig; len(probe.expireOverrides(now)) > 0 {
+		s.store.Update(func(c *ScheduleConfig) {
+			for _, o := range c.expireOverrides(now) {
+				s.logf("Schedule override expired: %s", o.Description())
+			}
+		})
+		scheduleConfig = s.store.Get()
+	}
+
+	// Maintenance mode suspends the automatic actions, the checks go on
+	maintenance := scheduleConfig.maintenanceAt(now)
+	switch {
+	case maintenance != nil && !s.maintenance:
+		s.logf("Schedule: %s, automatic power actions suspended", maintenance.Description())
+	case maintenance == nil && scheduleConfig.Maintenance != nil:
+		s.logf("Schedule: maintenance mode expired at %s, resuming automatic power actions", scheduleConfig.Maintenance.Until)
+		s.store.Update(func(c *ScheduleConfig) {
+			if c.Maintenance != nil && !c.Maintenance.activeAt(now) {
+				c.Maintenance = nil
+			}
+		})
+		scheduleConfig = s.store.Get()
+	case maintenance == nil && s.maintenance:
+		s.logf("Schedule: maintenance mode turned off, resuming automatic power actions")
+	}
+	s.maintenance = maintenance != nil
+
+	// Complete the history of the wake workflow started by an earlier check
+	select {
+	case done := <-s.wakeDone:
+		s.waking = nil
+		if done.group != nil {
+			s.finishGroupWake(done.window, done.planned, *done.group, nil)
+		} else {
+			s.finishWake(done.window, done.planned, done.result)
+		}
+	default:
+	}
+
+	// Complete the history of occurrences waiting for the server to change state
+	for name, planned := range s.booting {
+		if serverIsOn {
+			s.record(name, planned, func(r *RunRecord) { setRunTime(&r.Online, now) })
+			delete(s.booting, name)
+		}
+	}
+	for name, planned := range s.stopping {
+		if !serverIsOn {
+			s.record(name, planned, func(r *RunRecord) { setRunTime(&r.Offline, now) })
+			delete(s.stopping, name)
+		}
+	}
+
+	for _, window := range scheduleConfig.Windows {
+		// A window disabled while it owns the server still shuts it down
+		owner := scheduleConfig.StartedBySchedule && scheduleConfig.ActiveWindow == window.Name
+		if !window.Enabled && !owner {
+			continue
+		}
+		wake, err := window.wakeSchedule()
+		if err != nil {
+			s.logf("Schedule check for window %q skipped: %v", window.Name, err)
+			continue
+		}
+		shutdown, err := window.shutdownSchedule()
+		if err != nil {
+			s.logf("Schedule check for window %q skipped: %v", window.Name, err)
+			continue
+		}
+		s.checkWindow(window, wake, shutdown, scheduleConfig, now, serverIsOn)
+	}
+
+	// One-time windows are checked like the recurring ones
+	for _, o := range scheduleConfig.Overrides {
+		if o.Type != overrideOnce {
+			continue
+		}
+		window, wake, shutdown, err := o.onceWindow()
+		if err != nil {
+			s.logf("Schedule check for one-time window %q skipped: %v", o.Name, err)
+			continue
+		}
+		s.checkWindow(window, wake, shutdown, scheduleConfig, now, serverIsOn)
+	}
+
+	// A server woken by the proxy is shut down once idle, like an idle window
+	if scheduleConfig.StartedBySchedule && scheduleConfig.ActiveWindow == onDemandWindow {
+		s.checkOnDemand(scheduleConfig, now, serverIsOn)
+	}
+}
+
+// checkWindow decides from the state of the window rather than the current minute:
+// inside an occurrence that was not handled yet the server is woken, past the end
+// of the occurrence the scheduler started, the server is shut down
+func (s *scheduler) checkWindow(window ScheduleWindow, wake, shutdown *CronSchedule, scheduleConfig ScheduleConfig, now time.Time, serverIsOn bool) {
+	lastWake := wake.Prev(now)
+	if lastWake.IsZero() {
+		return
+	}
+
+	// The occurrence ends at the first shutdown time after its wake time;
+	// without a shutdown schedule it never ends on its own
+	var end time.Time
+	if shutdown != nil {
+		end = windowEnd(shutdown, lastWake)
+	}
+	inWindow := end.IsZero() || now.Before(end)
+
+	lastRun, lastRunErr := time.Parse(time.RFC3339, window.LastRun)
+	handled := lastRunErr == nil && !lastRun.Before(lastWake)
+
+	// A group is up once all its members are online and down once none is
+	if window.Group != "" {
+		serverIsOn = s.groupOnline(window.Group, inWindow && !handled)
+	}
+
+	// Only the window that booted the server may shut it down
+	ownsServer := scheduleConfig.StartedBySchedule &&
+		(scheduleConfig.ActiveWindow == "" || scheduleConfig.ActiveWindow == window.Name)
+
+	// Log schedule status (debug level)
+	s.logf("Schedule check: Window=%q, Current=%s, LastWake=%s, End=%s, Handled=%v",
+		window.Name, now.In(wake.loc).Format("15:04 MST"), lastWake.Format(time.RFC3339), formatScheduleTime(end), handled)
+
+	// INSIDE AN UNHANDLED OCCURRENCE - Wake the server
+	if inWindow && !handled {
+		// A disabled window is only checked to shut down the server it booted
+		if !window.Enabled {
+			return
+		}
+		// A skip or pause override or a blackout day cancels the occurrence, mark it
+		// handled so it is neither woken nor reported as missed later
+		if reason := scheduleConfig.cancelReason(window.Name, lastWake); reason != "" {
+			s.logf("Schedule: wake of window %q at %s cancelled: %s",
+				window.Name, lastWake.Format(time.RFC3339), reason)
+			s.store.Update(func(c *ScheduleConfig) { c.setLastRun(window.Name, now) })
+			s.record(window.Name, lastWake, func(r *RunRecord) { r.Skipped = reason })
+			return
+		}
+		// The occurrence is left unhandled during maintenance, so it is still
+		// woken if the maintenance ends while the window is open
+		if m := scheduleConfig.maintenanceAt(now); m != nil {
+			if !s.held[window.Name].Equal(lastWake) {
+				s.held[window.Name] = lastWake
+				s.logf("Schedule: wake of window %q at %s held: %s", window.Name, lastWake.Format(time.RFC3339), m.Description())
+			}
+			return
+		}
+
+		late := now.Sub(lastWake)
+		grace := currentConfig().ScheduleGracePeriod()
+
+		// Occurrences missed while wol-server was not running or held by maintenance
+		// mode are caught up as long as the window is still open; open-ended windows
+		// only get the grace period
+		heldBack := lastWake.Before(s.startedAt) || s.held[window.Name].Equal(lastWake)
+		catchUp := currentConfig().Schedule.CatchUp && heldBack && !end.IsZero()
+		if late > grace && !catchUp {
+			if !s.missed[window.Name].Equal(lastWake) {
+				s.missed[window.Name] = lastWake
+				s.logf("Schedule: missed wake of window %q at %s, %s late exceeds the grace period of %s",
+					window.Name, lastWake.Format(time.RFC3339), late.Truncate(time.Second), grace)
+				s.notify("failure", fmt.Sprintf("Missed wake of schedule window %q at %s", window.Name, lastWake.Format("2006-01-02 15:04")))
+				s.recordError(window.Name, lastWake, now, fmt.Errorf("wake missed, %s late exceeds the grace period of %s", late.Truncate(time.Second), grace))
+			}
+			return
+		}
+
+		if serverIsOn {
+			s.markHandled(window.Name, lastWake, now, scheduleConfig.StartedBySchedule && !ownsServer)
+			return
+		}
+
+		if late >= time.Minute {
+			s.logf("WAKE TIME: Catching up wake of window %q scheduled at %s", window.Name, lastWake.Format(time.RFC3339))
+		}
+		s.wake(window, lastWake, now)
+		return
+	}
+
+	// PAST THE END OF THE OCCURRENCE WE STARTED - Shut the server down
+	if !ownsServer || lastRunErr != nil {
+		return
+	}
+	// The occurrence that was open when the server was started
+	startedWake := wake.Prev(lastRun)
+	if startedWake.IsZero() {
+		return
+	}
+
+	// IDLE SHUTDOWN - Until the end of the occurrence, if it has one, the
+	// server is shut down as soon as it has been idle long enough
+	if window.idleShutdown() && (shutdown == nil || now.Before(windowEnd(shutdown, startedWake))) {
+		s.checkIdle(window, startedWake, now, serverIsOn, scheduleConfig)
+		return
+	}
+	if shutdown == nil {
+		return
+	}
+	startedEnd := windowEnd(shutdown, startedWake)
+	if now.Before(startedEnd) {
+		return
+	}
+
+	if !serverIsOn {
+		// The server is already off, the window is over
+		s.logf("Schedule: window %q is over and the server is offline", window.Name)
+		s.record(window.Name, startedWake, func(r *RunRecord) { setRunTime(&r.Offline, now) })
+		delete(s.stopping, window.Name)
+		s.store.Update(func(c *ScheduleConfig) { c.releaseServer() })
+		return
+	}
+
+	// Check if auto-shutdown is enabled
+	if !window.AutoShutdown {
+		return
+	}
+	s.autoShutdown(window, startedWake, startedEnd, now, scheduleConfig)
+}
+
+// autoShutdown shuts the server down for the occurrence of a window that ended
+// at end, unless maintenance mode is on, the last attempt failed recently or a
+// guard check postpones it
+func (s *scheduler) autoShutdown(window ScheduleWindow, planned, end, now time.Time, scheduleConfig ScheduleConfig) {
+	if currentConfig().windowPasswordMissing(window) || scheduleConfig.maintenanceAt(now) != nil {
+		return
+	}
+	if failed, ok := s.shutdownFailed[window.Name]; ok && now.Sub(failed) < shutdownRetryInterval {
+		return
+	}
+	if s.heldByLease(window.Name, planned, now) {
+		return
+	}
+	if s.postponeShutdown(window, planned, end, now, scheduleConfig.ShutdownPostponed) {
+		return
+	}
+	s.shutdown(window, planned, now, end)
+}
+
+// checkIdle runs the idle checks of the target every check interval while an
+// idle shutdown window owns the server, and shuts the server down once nothing
+// was found for the idle timeout
+func (s *scheduler) checkIdle(window ScheduleWindow, planned, now time.Time, serverIsOn bool, scheduleConfig ScheduleConfig) {
+	if _, ok := s.booting[window.Name]; ok {
+		return
+	}
+	if !serverIsOn {
+		// Someone else turned it off, a later manual boot must not be shut down
+		s.logf("Schedule: server started by window %q is offline, idle shutdown is over", window.Name)
+		s.record(window.Name, planned, func(r *RunRecord) { setRunTime(&r.Offline, now) })
+		s.store.Update(func(c *ScheduleConfig) { c.releaseServer() })
+		return
+	}
+
+	// Maintenance counts as activity, the idle timer starts once it is over
+	if scheduleConfig.maintenanceAt(now) != nil {
+		if scheduleConfig.IdleSince != "" {
+			s.store.Update(func(c *ScheduleConfig) { c.IdleSince = "" })
+		}
+		return
+	}
+
+	// A lease counts as activity, the idle timer starts once it is released
+	if s.leases.Held(now) {
+		if scheduleConfig.IdleSince != "" {
+			s.logf("Schedule: server started by window %q is kept awake by a lease", window.Name)
+			s.store.Update(func(c *ScheduleConfig) { c.IdleSince = "" })
+		}
+		return
+	}
+
+	idle := currentTarget().Idle
+	if idleSince, err := time.Parse(time.RFC3339, scheduleConfig.IdleSince); err == nil {
+		if deadline := idleSince.Add(idle.timeout()); !now.Before(deadline) {
+			s.autoShutdown(window, planned, deadline, now, scheduleConfig)
+			return
+		}
+	}
+	if now.Sub(s.idleChecked) < idle.checkInterval() {
+		return
+	}
+	s.idleChecked = now
+	if !idle.Enabled() {
+		s.logf("Schedule: window %q shuts down when idle, but the target has no idle checks", window.Name)
+		return
+	}
+
+	busy, err := s.power.CheckIdle()
+	if err != nil {
+		busy = []string{fmt.Sprintf("idle checks could not run: %v", err)}
+	}
+	switch {
+	case len(busy) > 0 && scheduleConfig.IdleSince != "":
+		s.logf("Schedule: server started by window %q is busy again: %s", window.Name, strings.Join(busy, "; "))
+		s.store.Update(func(c *ScheduleConfig) { c.IdleSince = "" })
+	case len(busy) == 0 && scheduleConfig.IdleSince == "":
+		s.logf("Schedule: server started by window %q is idle, shutting down after %s of inactivity", window.Name, idle.timeout())
+		s.store.Update(func(c *ScheduleConfig) { c.IdleSince = now.Format(time.RFC3339) })
+	}
+}
+
+// checkOnDemand handles the server woken by the proxy with proxy.idleShutdown.
+// It is owned by a pseudo window with the idle shutdown mode until it is idle
+// for the idle timeout, or a schedule window takes it over.
+func (s *scheduler) checkOnDemand(scheduleConfig ScheduleConfig, now time.Time, serverIsOn bool) {
+	if last := s.wakes.Last(); last != nil && last.Outcome == wakePending {
+		return
+	}
+	planned, err := time.Parse(time.RFC3339, scheduleConfig.OnDemandSince)
+	if err != nil || !currentConfig().Proxy.IdleShutdown {
+		s.logf("Schedule: server woken by the proxy is no longer shut down when idle")
+		s.store.Update(func(c *ScheduleConfig) { c.releaseServer() })
+		return
+	}
+	window := ScheduleWindow{Name: onDemandWindow, Enabled: true, AutoShutdown: true, ShutdownMode: shutdownModeIdle}
+	s.checkIdle(window, planned, now, serverIsOn, scheduleConfig)
+}
+
+// markHandled records that the server was already running at a wake time. If
+// another window booted it, this window takes over so the server stays on until
+// this window's shutdown time.
+func (s *scheduler) markHandled(name string, planned, now time.Time, takeOver bool) {
+	if takeOver {
+		s.logf("WAKE TIME: Window %q takes over the running server", name)
+	}
+	s.store.Update(func(c *ScheduleConfig) {
+		if takeOver {
+			c.ActiveWindow = name
+			c.IdleSince = ""
+			c.OnDemandSince = ""
+		}
+		c.setLastRun(name, now)
+	})
+	s.record(name, planned, func(r *RunRecord) { setRunTime(&r.Online, now) })
+}
+
+// wake boots the server for the occurrence of a window planned at the given
+// time. The workflow runs in the background, so waiting for the server does not
+// hold up the checks; a later check records how it ended.
+func (s *scheduler) wake(window ScheduleWindow, planned, now time.Time) {
+	if s.waking != nil {
+		s.logf("Schedule: wake for window %q still running, window %q waits for it", s.waking.window, window.Name)
+		return
+	}
+	s.logf("WAKE TIME: Initiating boot sequence for window %q...", window.Name)
+	if window.Group != "" {
+		s.wakeGroup(window, planned, now)
+		return
+	}
+
+	workflow := newWakeWorkflow(s.clock, s.power, currentConfig())
+	workflow.logf = s.logf
+	packets := 0
+	report := func(r WakeResult) {
+		if r.Packets == packets {
+			s.recordError(window.Name, planned, s.clock.Now(), fmt.Errorf("failed to send Wake-on-LAN packet: %s", r.Error))
+			return
+		}
+		if packets == 0 {
+			// Mark that server was started by scheduler
+			s.store.Update(func(c *ScheduleConfig) {
+				c.StartedBySchedule = true
+				c.ActiveWindow = window.Name
+				c.setLastRun(window.Name, now)
+			})
+			s.record(window.Name, planned, func(r *RunRecord) { setRunTime(&r.WakeSent, s.clock.Now()) })
+		}
+		packets = r.Packets
+	}
+
+	if s.syncWakes {
+		result := s.wakes.run(workflow, wakeSourceSchedule, report)
+		if result.Packets > 0 {
+			s.booting[window.Name] = planned
+		}
+		s.finishWake(window.Name, planned, result)
+		return
+	}
+
+	first, started := s.wakes.startWith(workflow, wakeSourceSchedule, report, func(result WakeResult) {
+		s.wakeDone <- scheduledWake{window: window.Name, planned: planned, result: result}
+	})
+	if !started {
+		// Another wake is running, the next check sees the server running
+		s.logf("Schedule: a %s wake was already running for window %q", first.Source, window.Name)
+		return
+	}
+	s.waking = &scheduledWake{window: window.Name, planned: planned}
+	if first.Packets > 0 {
+		s.booting[window.Name] = planned
+	}
+}
+
+// finishWake records how the wake workflow of a window ended, at the time it ended
+func (s *scheduler) finishWake(name string, planned time.Time, result WakeResult) {
+	finished, err := time.Parse(time.RFC3339, result.Finished)
+	if err != nil {
+		finished = s.clock.Now()
+	}
+	switch {
+	case result.Source != wakeSourceSchedule:
+		// Another wake was running, the next check sees the server running
+		s.logf("Schedule: a %s wake was already running for window %q", result.Source, name)
+	case result.Outcome == wakeOnline:
+		s.record(name, planned, func(r *RunRecord) {
+			setRunTime(&r.Online, finished)
+			r.BootSeconds = result.BootSeconds
+		})
+		delete(s.booting, name)
+		s.notify("wake", fmt.Sprintf("Server booted by schedule window %q in %s", name, formatSeconds(result.BootSeconds)))
+	case result.Outcome == wakeAlreadyOnline:
+		s.markHandled(name, planned, finished, false)
+	case result.Outcome == wakeTimedOut:
+		// The server may still come up, the next checks record when
+		s.booting[name] = planned
+		s.recordError(name, planned, finished, fmt.Errorf("%s", result.Error))
+		s.notify("failure", fmt.Sprintf("Server did not come online for schedule window %q: %s", name, result.Error))
+	default:
+		delete(s.booting, name)
+		s.notify("failure", fmt.Sprintf("Failed to wake the server for schedule window %q: %s", name, result.Error))
+	}
+}
+
+// shutdown turns the server off at the end of the occurrence of a window the
+// scheduler started
+func (s *scheduler) shutdown(window ScheduleWindow, planned, now, end time.Time) {
+	if now.Sub(end) >= time.Minute {
+		s.logf("SHUTDOWN TIME: Window %q ended at %s, catching up auto-shutdown", window.Name, end.Format(time.RFC3339))
+	} else {
+		s.logf("SHUTDOWN TIME: Attempting auto-shutdown for window %q", window.Name)
+	}
+	if window.Group != "" {
+		s.shutdownGroup(window, planned)
+		return
+	}
+
+	// Try multiple times to shut down the server
+	var err error
+	for attempt := 1; attempt <= 3; attempt++ {
+		s.logf("Auto shutdown attempt %d/3", attempt)
+		err = s.power.Shutdown(currentConfig().Auth.ShutdownPassword)
+		if err != nil {
+			s.logf("Auto shutdown attempt %d failed: %v", attempt, err)
+			if attempt < 3 {
+				s.clock.Sleep(3 * time.Second)
+			}
+			continue
+		}
+
+		s.logf("Auto shutdown initiated successfully on attempt %d", attempt)
+		delete(s.shutdownFailed, window.Name)
+		s.record(window.Name, planned, func(r *RunRecord) { setRunTime(&r.ShutdownRequested, s.clock.Now()) })
+		s.stopping[window.Name] = planned
+		// The window is closed, a later manual boot must not be shut down
+		s.store.Update(func(c *ScheduleConfig) { c.releaseServer() })
+		s.notify("shutdown", fmt.Sprintf("Server shut down at the end of schedule window %q", window.Name))
+		return
+	}
+
+	// Only report the first failed round, retries follow every shutdownRetryInterval
+	if _, failedBefore := s.shutdownFailed[window.Name]; !failedBefore {
+		s.notify("failure", fmt.Sprintf("All auto shutdown attempts for schedule window %q failed", window.Name))
+	}
+	s.recordError(window.Name, planned, s.clock.Now(), fmt.Errorf("all auto shutdown attempts failed: %v", err))
+	s.shutdownFailed[window.Name] = s.clock.Now()
+	s.logf("All auto shutdown attempts failed, retrying in %s", shutdownRetryInterval)
+}
+
+// heldByLease reports whether a keep-awake lease blocks the automatic shutdown
+// of a window. Unlike the guard checks, leases have no maximum deferral: they
+// block until they expire or are released.
+func (s *scheduler) heldByLease(name string, planned, now time.Time) bool {
+	reasons := s.leases.Reasons(now)
+	if len(reasons) == 0 {
+		if _, held := s.leaseHeld[name]; held {
+			s.logf("Schedule: leases released, shutting down window %q", name)
+			delete(s.leaseHeld, name)
+		}
+		return false
+	}
+
+	summary := strings.Join(reasons, "; ")
+	if s.leaseHeld[name] != summary {
+		s.leaseHeld[name] = summary
+		s.logf("Schedule: shutdown of window %q blocked: %s", name, summary)
+		s.record(name, planned, func(r *RunRecord) { r.Postponed = summary })
+	}
+	return true
+}
+
+// postponeShutdown runs the guard checks of the target before the automatic
+// shutdown of a window that ended at end, and reports whether the shutdown has
+// to wait. Postponed shutdowns are checked again every retry interval and
+// happen anyway once the maximum deferral is reached.
+func (s *scheduler) postponeShutdown(window ScheduleWindow, planned, end, now time.Time, deferral *ShutdownDeferral) bool {
+	name := window.Name
+	guards, check := s.shutdownGuards(window.Group)
+	if !guards.Enabled() {
+		return false
+	}
+	deadline := end.Add(guards.maxDeferral())
+	if deferral != nil && deferral.Window == name && now.Before(deadline) {
+		if checked, err := time.Parse(time.RFC3339, deferral.Checked); err == nil && now.Sub(checked) < guards.retryInterval() {
+			return true
+		}
+	}
+
+	reasons := check()
+	if len(reasons) == 0 {
+		if deferral != nil {
+			s.logf("Schedule: guard checks passed, shutting down window %q", name)
+			s.store.Update(func(c *ScheduleConfig) { c.ShutdownPostponed = nil })
+		}
+		return false
+	}
+	if !now.Before(deadline) {
+		s.logf("Schedule: shutdown of window %q postponed for the maximum of %s, shutting down anyway: %s",
+			name, guards.maxDeferral(), strings.Join(reasons, "; "))
+		return false
+	}
+
+	s.logf("Schedule: shutdown of window %q postponed until the next check in %s: %s",
+		name, guards.retryInterval(), strings.Join(reasons, "; "))
+	s.store.Update(func(c *ScheduleConfig) {
+		c.ShutdownPostponed = &ShutdownDeferral{
+			Window:  name,
+			Since:   end.Format(time.RFC3339),
+			Until:   deadline.Format(time.RFC3339),
+			Checked: now.Format(time.RFC3339),
+			Reasons: reasons,
+		}
+	})
+	s.record(name, planned, func(r *RunRecord) { r.Postponed = strings.Join(reasons, "; ") })
+	return true
+}
+
+// shutdownGuards returns the guard settings timing the postponement of a
+// shutdown and a function running the guard checks. A group runs the checks
+// of every member with guards, timed by the settings of the first of them.
+func (s *scheduler) shutdownGuards(group string) (GuardConfig, func() []string) {
+	run := func(driver PowerDriver) []string {
+		reasons, err := driver.CheckGuards()
+		if err != nil {
+			return []string{fmt.Sprintf("guard checks could not run: %v", err)}
+		}
+		return reasons
+	}
+	if group == "" {
+		return currentTarget().Guards, func() []string { return run(s.power) }
+	}
+
+	var guards GuardConfig
+	var members []string
+	if g, ok := currentConfig().Group(group); ok {
+		order, _ := g.Order()
+		for _, target := range order {
+			if config, ok := currentConfig().Target(target); ok && config.Guards.Enabled() {
+				if len(members) == 0 {
+					guards = config.Guards
+				}
+				members = append(members, target)
+			}
+		}
+	}
+	return guards, func() []string {
+		var reasons []string
+		for _, target := range members {
+			for _, reason := range run(s.powerFor(target)) {
+				reasons = append(reasons, target+": "+reason)
+			}
+		}
+		return reasons
+	}
+}
+
+// groupOnline probes the members of a group: with all set it reports whether
+// every member is online, otherwise whether any is
+func (s *scheduler) groupOnline(name string, all bool) bool {
+	group, ok := currentConfig().Group(name)
+	if !ok {
+		return false
+	}
+	for _, member := range group.Members {
+		if s.powerFor(member.Target).Online() != all {
+			return !all
+		}
+	}
+	return all
+}
+
+// groupRunner returns a runner using the clock and drivers of the scheduler
+func (s *scheduler) groupRunner() groupRunner {
+	return groupRunner{
+		clock:    s.clock,
+		powerFor: s.powerFor,
+		wakes:    s.wakes,
+		cfg:      currentConfig(),
+		logf:     s.logf,
+	}
+}
+
+// wakeGroup wakes the members of the group of a window in dependency order
+// for the occurrence planned at the given time
+func (s *scheduler) wakeGroup(window ScheduleWindow, planned, now time.Time) {
+	group, ok := currentConfig().Group(window.Group)
+	if !ok {
+		s.recordError(window.Name, planned, now, fmt.Errorf("unknown group %q", window.Group))
+		return
+	}
+
+	// The group is started by the scheduler even if a member fails to come up,
+	// so the members that did are shut down at the end of the window
+	s.store.Update(func(c *ScheduleConfig) {
+		c.StartedBySchedule = true
+		c.ActiveWindow = window.Name
+		c.setLastRun(window.Name, now)
+	})
+	s.record(window.Name, planned, func(r *RunRecord) { setRunTime(&r.WakeSent, now) })
+
+	runner := s.groupRunner()
+	initial := runner.start(group, groupActionWake, wakeSourceSchedule)
+	run := func(report func(GroupResult)) GroupResult {
+		runner.report = report
+		return runner.wake(group, wakeSourceSchedule)
+	}
+	if s.syncWakes {
+		result, err := s.groups.run(initial, run)
+		s.finishGroupWake(window.Name, planned, result, err)
+		return
+	}
+
+	// Like the wake of the server, the run goes on in the background
+	err := s.groups.start(initial, func(report func(GroupResult)) GroupResult {
+		result := run(report)
+		s.wakeDone <- scheduledWake{window: window.Name, planned: planned, group: &result}
+		return result
+	})
+	if err != nil {
+		s.finishGroupWake(window.Name, planned, GroupResult{}, err)
+		return
+	}
+	s.waking = &scheduledWake{window: window.Name, planned: planned}
+}
+
+// finishGroupWake records how the run waking the group of a window ended
+func (s *scheduler) finishGroupWake(name string, planned time.Time, result GroupResult, err error) {
+	finished, parseErr := time.Parse(time.RFC3339, result.Finished)
+	if parseErr != nil {
+		finished = s.clock.Now()
+	}
+	switch {
+	case err != nil:
+		// Someone else is running the group, the next check sees its state
+		s.logf("Schedule: %v for window %q", err, name)
+	case result.Success:
+		s.record(name, planned, func(r *RunRecord) { setRunTime(&r.Online, finished) })
+		s.notify("wake", fmt.Sprintf("Group %s booted by schedule window %q", result.Group, name))
+	default:
+		s.recordError(name, planned, finished, fmt.Errorf("%s", result.Summary()))
+		s.notify("failure", fmt.Sprintf("Failed to wake group %s for schedule window %q: %s", result.Group, name, result.Summary()))
+	}
+}
+
+// shutdownGroup shuts the members of the group of a window down in reverse
+// dependency order. The guard checks already ran in postponeShutdown.
+func (s *scheduler) shutdownGroup(window ScheduleWindow, planned time.Time) {
+	group, ok := currentConfig().Group(window.Group)
+	if !ok {
+		s.recordError(window.Name, planned, s.clock.Now(), fmt.Errorf("unknown group %q", window.Group))
+		return
+	}
+
+	requested := s.clock.Now()
+	runner := s.groupRunner()
+	result, err := s.groups.run(runner.start(group, groupActionShutdown, wakeSourceSchedule), func(report func(GroupResult)) GroupResult {
+		runner.report = report
+		return runner.shutdown(group, currentConfig().Auth.ShutdownPassword, true, wakeSourceSchedule)
+	})
+	if err == nil && result.Success {
+		delete(s.shutdownFailed, window.Name)
+		s.record(window.Name, planned, func(r *RunRecord) {
+			setRunTime(&r.ShutdownRequested, requested)
+			setRunTime(&r.Offline, s.clock.Now())
+		})
+		s.store.Update(func(c *ScheduleConfig) { c.releaseServer() })
+		s.notify("shutdown", fmt.Sprintf("Group %s shut down at the end of schedule window %q", group.Name, window.Name))
+		return
+	}
+
+	if err == nil {
+		err = fmt.Errorf("%s", result.Summary())
+	}
+	if _, failedBefore := s.shutdownFailed[window.Name]; !failedBefore {
+		s.notify("failure", fmt.Sprintf("Auto shutdown of group %s for schedule window %q failed: %v", group.Name, window.Name, err))
+	}
+	s.recordError(window.Name, planned, s.clock.Now(), err)
+	s.shutdownFailed[window.Name] = s.clock.Now()
+	s.logf("Auto shutdown of group %s failed, retrying in %s", group.Name, shutdownRetryInterval)
+}
+
+// record updates the history of an occurrence. Failures are only logged, a
+// broken history file must not stop the scheduler.
+func (s *scheduler) record(name string, planned time.Time, fn func(*RunRecord)) {
+	if err := s.history.Record(name, planned, fn); err != nil {
+		s.logf("Warning: %v", err)
+	}
+}
+
+// recordError adds an error to the history of an occurrence
+func (s *scheduler) recordError(name string, planned, now time.Time, err error) {
+	s.record(name, planned, func(r *RunRecord) {
+		if len(r.Errors) < maxRunErrors {
+			r.Errors = append(r.Errors, fmt.Sprintf("%s: %v", now.Format(time.RFC3339), err))
+		}
+	})
+}
+
+// setRunTime fills in a step of a run the first time it happens
+func setRunTime(field *string, t time.Time) {
+	if *field == "" {
+		*field = t.Format(time.RFC3339)
+	}
+}
+
+// formatScheduleTime formats a time for the logs, the zero time meaning "never"
+func formatScheduleTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
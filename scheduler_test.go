@@ -0,0 +1,557 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock set by the test. Sleeping moves it forward at once,
+// unless gate is set: then every Sleep also waits for a value on gate.
+type fakeClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	gate chan struct{}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	gate := c.gate
+	c.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// fakePower is a PowerDriver for a machine that boots as soon as it is woken,
+// unless it is broken, and whose first shutdownFailures shutdowns fail
+type fakePower struct {
+	mu               sync.Mutex
+	online           bool
+	broken           bool // Never comes online
+	shutdownFailures int
+	wakes            int
+	shutdowns        int
+}
+
+func (p *fakePower) Online() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.online
+}
+
+func (p *fakePower) Wake() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.wakes++
+	p.online = !p.broken
+	return nil
+}
+
+func (p *fakePower) Shutdown(password string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.shutdowns++
+	if p.shutdownFailures > 0 {
+		p.shutdownFailures--
+		return fmt.Errorf("ssh: connection refused")
+	}
+	p.online = false
+	return nil
+}
+
+func (p *fakePower) Action(name, password string) error { return p.Shutdown(password) }
+func (p *fakePower) CheckGuards() ([]string, error)     { return nil, nil }
+func (p *fakePower) CheckIdle() ([]string, error)       { return nil, nil }
+func (p *fakePower) Message(text string) error          { return nil }
+
+func (p *fakePower) counts() (wakes, shutdowns int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wakes, p.shutdowns
+}
+
+// schedulerTest is a scheduler running against a fake clock and machine
+type schedulerTest struct {
+	*scheduler
+	clock *fakeClock
+	power *fakePower
+
+	mu            sync.Mutex
+	notifications []string
+}
+
+// useConfig makes cfg the live configuration for the duration of the test
+func useConfig(t *testing.T, cfg *Config) {
+	t.Helper()
+	previous := currentConfig()
+	activeConfig.Store(cfg)
+	t.Cleanup(func() { activeConfig.Store(previous) })
+}
+
+// testConfig returns the configuration the scheduler tests run with
+func testConfig() *Config {
+	cfg := defaultConfig()
+	cfg.Auth.ShutdownPassword = "secret"
+	cfg.Wake = WakeConfig{Timeout: "2m", PollInterval: "5s", ResendAfter: "30s", Packets: 3}
+	cfg.Schedule.GracePeriod = "15m"
+	cfg.Schedule.CatchUp = true
+	return cfg
+}
+
+// newSchedulerTest creates a scheduler whose process started at started
+func newSchedulerTest(t *testing.T, started time.Time, power *fakePower, schedule ScheduleConfig) *schedulerTest {
+	t.Helper()
+	store := NewScheduleStore("")
+	store.Replace(schedule)
+	clock := &fakeClock{now: started}
+	st := &schedulerTest{clock: clock, power: power}
+	st.scheduler = newScheduler(clock, power, store, NewHistoryStore(""))
+	st.logf = func(string, ...interface{}) {}
+	st.notify = func(event, message string) {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.notifications = append(st.notifications, event+": "+message)
+	}
+	return st
+}
+
+// check runs a check at now and, if it started a wake, a second one once
+// the wake workflow ended, which records how it ended
+func (st *schedulerTest) check(t *testing.T, now time.Time) {
+	t.Helper()
+	st.clock.Set(now)
+	st.checkOnce()
+	if st.waking == nil {
+		return
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(st.wakeDone) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("wake workflow did not end")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	st.checkOnce()
+}
+
+// run returns the history of the occurrence of window planned at planned
+func (st *schedulerTest) run(window string, planned time.Time) (RunRecord, bool) {
+	key := planned.Format(time.RFC3339)
+	for _, r := range st.history.Recent(window, 0) {
+		if r.Planned == key {
+			return r, true
+		}
+	}
+	return RunRecord{}, false
+}
+
+func (st *schedulerTest) notified(event string) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	count := 0
+	for _, n := range st.notifications {
+		if strings.HasPrefix(n, event+": ") {
+			count++
+		}
+	}
+	return count
+}
+
+// at returns a time on the test day, 2026-06-01, in UTC
+func at(hhmm string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04:05", "2026-06-01 "+hhmm)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// nightly is a window open from 02:00 to 04:00 UTC with auto shutdown
+func nightly() ScheduleWindow {
+	return ScheduleWindow{Name: "nightly", Enabled: true, WakeCron: "0 2 * * *", ShutdownCron: "0 4 * * *", AutoShutdown: true, TimeZone: "UTC"}
+}
+
+func TestSchedulerWake(t *testing.T) {
+	planned := at("02:00:00")
+	tests := []struct {
+		name      string
+		started   time.Time // Process start
+		now       time.Time
+		online    bool
+		broken    bool
+		catchUp   bool
+		schedule  func(*ScheduleConfig)
+		wantWakes int
+		wantOwned bool   // StartedBySchedule afterwards
+		wantRun   bool   // Whether the occurrence has a history record
+		wantOnl   bool   // Whether the history records the server online
+		wantSkip  string // Part of the skip reason in the history
+		wantError string // Part of an error in the history
+	}{
+		{name: "at the wake time", started: at("01:00:00"), now: at("02:00:30"), catchUp: true,
+			wantWakes: 1, wantOwned: true, wantRun: true, wantOnl: true},
+		{name: "within the grace period", started: at("01:00:00"), now: at("02:14:00"), catchUp: true,
+			wantWakes: 1, wantOwned: true, wantRun: true, wantOnl: true},
+		{name: "missed beyond the grace period", started: at("01:00:00"), now: at("02:20:00"), catchUp: true,
+			wantRun: true, wantError: "wake missed"},
+		{name: "caught up after a restart", started: at("03:00:00"), now: at("03:00:00"), catchUp: true,
+			wantWakes: 1, wantOwned: true, wantRun: true, wantOnl: true},
+		{name: "not caught up without catch-up", started: at("03:00:00"), now: at("03:00:00"),
+			wantRun: true, wantError: "wake missed"},
+		{name: "not caught up once the window closed", started: at("05:00:00"), now: at("05:00:00"), catchUp: true},
+		{name: "before the wake time", started: at("01:00:00"), now: at("01:59:00"), catchUp: true},
+		{name: "server already online", started: at("01:00:00"), now: at("02:00:30"), online: true, catchUp: true,
+			wantRun: true, wantOnl: true},
+		{name: "occurrence already handled", started: at("01:00:00"), now: at("02:05:00"), catchUp: true,
+			schedule: func(c *ScheduleConfig) { c.Windows[0].LastRun = at("02:00:30").Format(time.RFC3339) }},
+		{name: "disabled window owning the server", started: at("01:00:00"), now: at("02:00:30"), catchUp: true,
+			schedule: func(c *ScheduleConfig) {
+				c.Windows[0].Enabled = false
+				c.StartedBySchedule, c.ActiveWindow = true, "nightly"
+			},
+			wantOwned: true},
+		{name: "wake times out", started: at("01:00:00"), now: at("02:00:30"), broken: true, catchUp: true,
+			wantWakes: 3, wantOwned: true, wantRun: true, wantError: "not online after 2m0s"},
+		{name: "skipped by an override", started: at("01:00:00"), now: at("02:00:30"), catchUp: true,
+			schedule: func(c *ScheduleConfig) {
+				c.Overrides = []ScheduleOverride{{ID: "1", Type: overrideSkip, Window: "nightly",
+					Start: planned.Format(time.RFC3339), End: at("04:00:00").Format(time.RFC3339)}}
+			},
+			wantRun: true, wantSkip: "Skip nightly"},
+		{name: "paused by an override", started: at("01:00:00"), now: at("02:00:30"), catchUp: true,
+			schedule: func(c *ScheduleConfig) {
+				c.Overrides = []ScheduleOverride{{ID: "1", Type: overridePause, End: at("23:00:00").Format(time.RFC3339)}}
+			},
+			wantRun: true, wantSkip: "paused"},
+		{name: "held in maintenance mode", started: at("01:00:00"), now: at("02:00:30"), catchUp: true,
+			schedule: func(c *ScheduleConfig) {
+				c.Maintenance = &MaintenanceMode{Since: at("01:00:00").Format(time.RFC3339), Reason: "disk swap"}
+			}},
+		{name: "woken after maintenance expired", started: at("01:00:00"), now: at("02:00:30"), catchUp: true,
+			schedule: func(c *ScheduleConfig) {
+				c.Maintenance = &MaintenanceMode{Since: at("00:00:00").Format(time.RFC3339), Until: at("01:30:00").Format(time.RFC3339)}
+			},
+			wantWakes: 1, wantOwned: true, wantRun: true, wantOnl: true},
+		{name: "one-time window", started: at("01:00:00"), now: at("10:00:30"), catchUp: true,
+			schedule: func(c *ScheduleConfig) {
+				c.Windows[0].Enabled = false
+				c.Overrides = []ScheduleOverride{{ID: "1", Type: overrideOnce, Name: "extra",
+					Start: at("10:00:00").Format(time.RFC3339), End: at("11:00:00").Format(time.RFC3339)}}
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Schedule.CatchUp = tt.catchUp
+			useConfig(t, cfg)
+
+			schedule := ScheduleConfig{Windows: []ScheduleWindow{nightly()}}
+			if tt.schedule != nil {
+				tt.schedule(&schedule)
+			}
+			st := newSchedulerTest(t, tt.started, &fakePower{online: tt.online, broken: tt.broken}, schedule)
+			st.check(t, tt.now)
+
+			// The one-time window is checked against its own occurrence
+			window, occurrence := "nightly", planned
+			if tt.name == "one-time window" {
+				window, occurrence = "extra", at("10:00:00")
+				tt.wantWakes, tt.wantOwned, tt.wantRun, tt.wantOnl = 1, true, true, true
+			}
+
+			if wakes, _ := st.power.counts(); wakes != tt.wantWakes {
+				t.Errorf("sent %d wakes, want %d", wakes, tt.wantWakes)
+			}
+			cfgAfter := st.store.Get()
+			if cfgAfter.StartedBySchedule != tt.wantOwned {
+				t.Errorf("StartedBySchedule = %v, want %v", cfgAfter.StartedBySchedule, tt.wantOwned)
+			}
+			if tt.wantOwned && cfgAfter.ActiveWindow != window {
+				t.Errorf("ActiveWindow = %q, want %q", cfgAfter.ActiveWindow, window)
+			}
+
+			run, ok := st.run(window, occurrence)
+			if ok != tt.wantRun {
+				t.Fatalf("history record present = %v, want %v: %+v", ok, tt.wantRun, run)
+			}
+			if (run.Online != "") != tt.wantOnl {
+				t.Errorf("history Online = %q, want set: %v", run.Online, tt.wantOnl)
+			}
+			if tt.wantWakes > 0 && run.WakeSent == "" {
+				t.Errorf("history WakeSent not set: %+v", run)
+			}
+			if !strings.Contains(run.Skipped, tt.wantSkip) || (tt.wantSkip == "" && run.Skipped != "") {
+				t.Errorf("history Skipped = %q, want %q", run.Skipped, tt.wantSkip)
+			}
+			errors := strings.Join(run.Errors, "\n")
+			if !strings.Contains(errors, tt.wantError) || (tt.wantError == "" && errors != "") {
+				t.Errorf("history errors = %q, want %q", errors, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestSchedulerShutdown(t *testing.T) {
+	wokenAt := at("02:00:30").Format(time.RFC3339)
+	owned := func(c *ScheduleConfig) {
+		c.StartedBySchedule = true
+		c.ActiveWindow = "nightly"
+		c.Windows[0].LastRun = wokenAt
+	}
+
+	tests := []struct {
+		name          string
+		now           time.Time
+		online        bool
+		failures      int
+		password      string
+		redfish       bool // The target is powered off through its BMC
+		schedule      func(*ScheduleConfig)
+		wantShutdowns int
+		wantOwned     bool
+		wantRequested bool
+		wantError     string
+	}{
+		{name: "at the shutdown time", now: at("04:00:10"), online: true, schedule: owned,
+			wantShutdowns: 1, wantRequested: true},
+		{name: "caught up after the shutdown time", now: at("05:30:00"), online: true, schedule: owned,
+			wantShutdowns: 1, wantRequested: true},
+		{name: "before the shutdown time", now: at("03:59:00"), online: true, schedule: owned,
+			wantOwned: true},
+		{name: "retried until it succeeds", now: at("04:00:10"), online: true, failures: 2, schedule: owned,
+			wantShutdowns: 3, wantRequested: true},
+		{name: "given up after three attempts", now: at("04:00:10"), online: true, failures: 3, schedule: owned,
+			wantShutdowns: 3, wantOwned: true, wantError: "all auto shutdown attempts failed"},
+		{name: "server started by hand", now: at("04:00:10"), online: true,
+			schedule: func(c *ScheduleConfig) { c.Windows[0].LastRun = wokenAt }},
+		{name: "started by another window", now: at("04:00:10"), online: true,
+			schedule: func(c *ScheduleConfig) { owned(c); c.ActiveWindow = "other" }, wantOwned: true},
+		{name: "server already offline", now: at("04:00:10"), schedule: owned},
+		{name: "window disabled while it owns the server", now: at("04:00:10"), online: true,
+			schedule:      func(c *ScheduleConfig) { owned(c); c.Windows[0].Enabled = false },
+			wantShutdowns: 1, wantRequested: true},
+		{name: "auto shutdown disabled", now: at("04:00:10"), online: true,
+			schedule: func(c *ScheduleConfig) { owned(c); c.Windows[0].AutoShutdown = false }, wantOwned: true},
+		{name: "no shutdown password", now: at("04:00:10"), online: true, password: "-", schedule: owned,
+			wantOwned: true},
+		{name: "no shutdown password with a BMC", now: at("04:00:10"), online: true, password: "-", redfish: true, schedule: owned,
+			wantShutdowns: 1, wantRequested: true},
+		{name: "maintenance mode", now: at("04:00:10"), online: true,
+			schedule: func(c *ScheduleConfig) {
+				owned(c)
+				c.Maintenance = &MaintenanceMode{Since: at("03:00:00").Format(time.RFC3339)}
+			},
+			wantOwned: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			if tt.password == "-" {
+				cfg.Auth.ShutdownPassword = ""
+			}
+			if tt.redfish {
+				cfg.Targets[0].Driver = driverRedfish
+			}
+			useConfig(t, cfg)
+
+			schedule := ScheduleConfig{Windows: []ScheduleWindow{nightly()}}
+			tt.schedule(&schedule)
+			st := newSchedulerTest(t, at("01:00:00"), &fakePower{online: tt.online, shutdownFailures: tt.failures}, schedule)
+			st.check(t, tt.now)
+
+			if _, shutdowns := st.power.counts(); shutdowns != tt.wantShutdowns {
+				t.Errorf("%d shutdown attempts, want %d", shutdowns, tt.wantShutdowns)
+			}
+			if owned := st.store.Get().StartedBySchedule; owned != tt.wantOwned {
+				t.Errorf("StartedBySchedule = %v, want %v", owned, tt.wantOwned)
+			}
+			run, _ := st.run("nightly", at("02:00:00"))
+			if (run.ShutdownRequested != "") != tt.wantRequested {
+				t.Errorf("history ShutdownRequested = %q, want set: %v", run.ShutdownRequested, tt.wantRequested)
+			}
+			errors := strings.Join(run.Errors, "\n")
+			if !strings.Contains(errors, tt.wantError) || (tt.wantError == "" && errors != "") {
+				t.Errorf("history errors = %q, want %q", errors, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestSchedulerShutdownRetryInterval(t *testing.T) {
+	useConfig(t, testConfig())
+	window := nightly()
+	window.LastRun = at("02:00:30").Format(time.RFC3339)
+	schedule := ScheduleConfig{Windows: []ScheduleWindow{window}, StartedBySchedule: true, ActiveWindow: "nightly"}
+	st := newSchedulerTest(t, at("01:00:00"), &fakePower{online: true, shutdownFailures: 4}, schedule)
+
+	steps := []struct {
+		now           time.Time
+		wantShutdowns int
+		wantOwned     bool
+	}{
+		{now: at("04:00:10"), wantShutdowns: 3, wantOwned: true},  // first round fails
+		{now: at("04:00:40"), wantShutdowns: 3, wantOwned: true},  // waits for the retry interval
+		{now: at("04:01:20"), wantShutdowns: 5, wantOwned: false}, // second round succeeds on its second attempt
+		{now: at("04:03:00"), wantShutdowns: 5, wantOwned: false}, // nothing left to do
+	}
+	for i, step := range steps {
+		st.check(t, step.now)
+		if _, shutdowns := st.power.counts(); shutdowns != step.wantShutdowns {
+			t.Errorf("step %d: %d shutdown attempts, want %d", i, shutdowns, step.wantShutdowns)
+		}
+		if owned := st.store.Get().StartedBySchedule; owned != step.wantOwned {
+			t.Errorf("step %d: StartedBySchedule = %v, want %v", i, owned, step.wantOwned)
+		}
+	}
+	if n := st.notified("failure"); n != 1 {
+		t.Errorf("%d failure notifications, want 1 for the first failed round", n)
+	}
+	if n := st.notified("shutdown"); n != 1 {
+		t.Errorf("%d shutdown notifications, want 1", n)
+	}
+}
+
+func TestSchedulerMaintenanceEnds(t *testing.T) {
+	useConfig(t, testConfig())
+	window := nightly()
+	window.LastRun = at("02:00:30").Format(time.RFC3339)
+	schedule := ScheduleConfig{
+		Windows:           []ScheduleWindow{window},
+		StartedBySchedule: true,
+		ActiveWindow:      "nightly",
+		Maintenance:       &MaintenanceMode{Since: at("03:00:00").Format(time.RFC3339), Until: at("05:00:00").Format(time.RFC3339)},
+	}
+	st := newSchedulerTest(t, at("01:00:00"), &fakePower{online: true}, schedule)
+
+	// The shutdown waits for the end of the maintenance, then catches up
+	st.check(t, at("04:30:00"))
+	if _, shutdowns := st.power.counts(); shutdowns != 0 {
+		t.Fatalf("shut down during maintenance")
+	}
+	st.check(t, at("05:00:05"))
+	if _, shutdowns := st.power.counts(); shutdowns != 1 {
+		t.Fatalf("%d shutdowns after maintenance ended, want 1", shutdowns)
+	}
+	if m := st.store.Get().Maintenance; m != nil {
+		t.Errorf("expired maintenance mode kept: %+v", m)
+	}
+}
+
+func TestSchedulerMaintenanceEndsInWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		until     string
+		catchUp   bool
+		now       time.Time
+		wantWakes int
+		wantError string
+	}{
+		{name: "within the grace period", until: "02:10:00", now: at("02:10:30"), wantWakes: 1},
+		{name: "caught up", until: "02:30:00", catchUp: true, now: at("02:30:30"), wantWakes: 1},
+		{name: "missed without catch-up", until: "02:30:00", now: at("02:30:30"), wantError: "wake missed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Schedule.CatchUp = tt.catchUp
+			useConfig(t, cfg)
+			schedule := ScheduleConfig{
+				Windows:     []ScheduleWindow{nightly()},
+				Maintenance: &MaintenanceMode{Since: at("01:00:00").Format(time.RFC3339), Until: at(tt.until).Format(time.RFC3339)},
+			}
+			st := newSchedulerTest(t, at("01:00:00"), &fakePower{}, schedule)
+
+			// The wake is held, not recorded, while the maintenance lasts
+			st.check(t, at("02:00:30"))
+			if wakes, _ := st.power.counts(); wakes != 0 {
+				t.Fatalf("woken during maintenance")
+			}
+			if run, ok := st.run("nightly", at("02:00:00")); ok {
+				t.Fatalf("occurrence recorded during maintenance: %+v", run)
+			}
+
+			st.check(t, tt.now)
+			if wakes, _ := st.power.counts(); wakes != tt.wantWakes {
+				t.Errorf("sent %d wakes after maintenance ended, want %d", wakes, tt.wantWakes)
+			}
+			if owned := st.store.Get().StartedBySchedule; owned != (tt.wantWakes > 0) {
+				t.Errorf("StartedBySchedule = %v, want %v", owned, tt.wantWakes > 0)
+			}
+			run, _ := st.run("nightly", at("02:00:00"))
+			errors := strings.Join(run.Errors, "\n")
+			if !strings.Contains(errors, tt.wantError) || (tt.wantError == "") != (run.Online != "") {
+				t.Errorf("history record = %+v, want error %q", run, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestSchedulerWakeRunsInBackground(t *testing.T) {
+	useConfig(t, testConfig())
+	schedule := ScheduleConfig{Windows: []ScheduleWindow{nightly()}}
+	st := newSchedulerTest(t, at("01:00:00"), &fakePower{broken: true}, schedule)
+
+	// The workflow is held between two probes until gate is released
+	gate := make(chan struct{})
+	st.clock.gate = gate
+	st.clock.Set(at("02:00:30"))
+
+	checked := make(chan struct{})
+	go func() {
+		st.checkOnce()
+		st.checkOnce()
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("checks blocked by the running wake workflow")
+	}
+	if st.waking == nil || st.waking.window != "nightly" {
+		t.Fatalf("waking = %+v, want the nightly window", st.waking)
+	}
+	if run, _ := st.run("nightly", at("02:00:00")); run.WakeSent == "" {
+		t.Errorf("wake not recorded while the workflow runs: %+v", run)
+	}
+
+	// Let the workflow time out, the next check records it
+	st.clock.mu.Lock()
+	st.clock.gate = nil
+	st.clock.mu.Unlock()
+	close(gate)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(st.wakeDone) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("wake workflow did not end")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	st.checkOnce()
+	if st.waking != nil {
+		t.Errorf("waking = %+v after the workflow ended", st.waking)
+	}
+	if n := st.notified("failure"); n != 1 {
+		t.Errorf("%d failure notifications, want 1 for the timeout", n)
+	}
+}
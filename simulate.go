@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Time between two simulated schedule checks; cron has minute resolution
+const simulationStep = time.Minute
+
+// Longest time range a simulation may cover
+const simulationMaxDays = 31
+
+// Time range simulated when none is given
+const simulationDefaultDays = 7
+
+// Actions reported by a simulation
+const (
+	simActionWake     = "wake"     // Wake-on-LAN packet sent
+	simActionRunning  = "running"  // Server already running at the wake time
+	simActionShutdown = "shutdown" // Automatic shutdown requested
+	simActionSkip     = "skip"     // Occurrence cancelled by an override or a blackout day
+	simActionError    = "error"    // Occurrence missed or failed
+)
+
+// SimulatedAction is one step the scheduler would take
+type SimulatedAction struct {
+	Time    time.Time `json:"time"`
+	Window  string    `json:"window"`
+	Planned time.Time `json:"planned"` // Wake time of the occurrence the action belongs to
+	Action  string    `json:"action"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// simClock is a Clock that only moves when the simulation advances it or the
+// scheduler sleeps
+type simClock struct {
+	now time.Time
+}
+
+func (c *simClock) Now() time.Time        { return c.now }
+func (c *simClock) Sleep(d time.Duration) { c.now = c.now.Add(d) }
+
+// simPower is a PowerDriver for a machine that boots and powers off instantly
+type simPower struct {
+	online bool
+}
+
+func (p *simPower) Online() bool { return p.online }
+
+func (p *simPower) Wake() error {
+	p.online = true
+	return nil
+}
+
+func (p *simPower) Shutdown(password string) error {
+	p.online = false
+	return nil
+}
+
+func (p *simPower) CheckGuards() ([]string, error) { return nil, nil }
+
+// The simulated machine is idle as soon as it is online
+func (p *simPower) CheckIdle() ([]string, error) { return nil, nil }
+
+func (p *simPower) Message(text string) error { return nil }
+
+func (p *simPower) Action(name, password string) error {
+	p.online = name == actionReboot
+	return nil
+}
+
+// simulateSchedule runs the scheduler against cfg from from to to with a
+// simulated clock and machine, in memory, and returns what it would do. The
+// machine is online at the start if online is set. The configuration, the
+// calendars and the grace period are the live ones.
+func simulateSchedule(cfg ScheduleConfig, from, to time.Time, online bool) ([]SimulatedAction, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("The end of the simulation must be after its start")
+	}
+	if to.Sub(from) > simulationMaxDays*24*time.Hour {
+		return nil, fmt.Errorf("A simulation covers at most %d days", simulationMaxDays)
+	}
+
+	store := NewScheduleStore("")
+	store.Replace(cfg)
+	history := NewHistoryStore("")
+	simulated := &simClock{now: from}
+
+	s := newScheduler(simulated, &simPower{online: online}, store, history)
+	s.logf = func(string, ...interface{}) {}
+	s.notify = func(string, string) {}
+	s.syncWakes = true
+
+	for t := from; !t.After(to); t = t.Add(simulationStep) {
+		// The scheduler sleeps between boot and shutdown attempts
+		if simulated.now.Before(t) {
+			simulated.now = t
+		}
+		s.checkOnce()
+	}
+
+	return simulatedActions(history.Recent("", 0)), nil
+}
+
+// simulatedActions turns the run history of a simulation, newest first, into
+// a list of actions in time order
+func simulatedActions(runs []RunRecord) []SimulatedAction {
+	actions := []SimulatedAction{}
+	for i := len(runs) - 1; i >= 0; i-- {
+		run := runs[i]
+		planned, err := time.Parse(time.RFC3339, run.Planned)
+		if err != nil {
+			continue
+		}
+		add := func(at, action, detail string) {
+			t, err := time.Parse(time.RFC3339, at)
+			if err != nil {
+				return
+			}
+			actions = append(actions, SimulatedAction{Time: t, Window: run.Window, Planned: planned, Action: action, Detail: detail})
+		}
+
+		if run.Skipped != "" {
+			add(run.Planned, simActionSkip, run.Skipped)
+		}
+		if run.WakeSent != "" {
+			add(run.WakeSent, simActionWake, "")
+		} else if run.Online != "" {
+			add(run.Online, simActionRunning, "")
+		}
+		if run.ShutdownRequested != "" {
+			add(run.ShutdownRequested, simActionShutdown, "")
+		}
+		for _, e := range run.Errors {
+			// Errors are recorded as "<time>: <message>"
+			at, message, _ := strings.Cut(e, ": ")
+			add(at, simActionError, message)
+		}
+	}
+
+	sort.SliceStable(actions, func(i, j int) bool { return actions[i].Time.Before(actions[j].Time) })
+	return actions
+}
+
+// Description returns the action as a line of text, used by ctl
+func (a SimulatedAction) Description() string {
+	const layout = "Mon 2006-01-02 15:04 MST"
+	switch a.Action {
+	case simActionWake:
+		return fmt.Sprintf("%s  wake for %s", a.Time.Format(layout), a.Window)
+	case simActionRunning:
+		return fmt.Sprintf("%s  %s finds the server running", a.Time.Format(layout), a.Window)
+	case simActionShutdown:
+		return fmt.Sprintf("%s  shutdown at the end of %s", a.Time.Format(layout), a.Window)
+	case simActionSkip:
+		return fmt.Sprintf("%s  %s skipped: %s", a.Time.Format(layout), a.Window, a.Detail)
+	}
+	return fmt.Sprintf("%s  %s %s: %s", a.Time.Format(layout), a.Window, a.Action, a.Detail)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Outcomes of the wake workflow
+const (
+	wakePending       = "pending"        // Still waiting for the server
+	wakeOnline        = "online"         // The server came online
+	wakeAlreadyOnline = "already-online" // The server was online before anything was sent
+	wakeTimedOut      = "timeout"        // Packets were sent but the server did not come online in time
+	wakeFailed        = "failed"         // No packet could be sent
+)
+
+// Where a wake workflow was started from
+const (
+	wakeSourceUI       = "ui"
+	wakeSourceAPI      = "api"
+	wakeSourceSchedule = "schedule"
+	wakeSourceCLI      = "cli"
+	wakeSourceProxy    = "proxy"
+	wakeSourceLease    = "lease"
+)
+
+// WakeResult describes a run of the wake workflow. Times are RFC3339.
+type WakeResult struct {
+	Source      string  `json:"source"` // ui, api, schedule, cli, proxy or lease
+	Outcome     string  `json:"outcome"`
+	Success     bool    `json:"success"`
+	Packets     int     `json:"packets"` // Wake-on-LAN packets sent
+	Started     string  `json:"started"`
+	Finished    string  `json:"finished,omitempty"`
+	BootSeconds float64 `json:"bootSeconds,omitempty"` // From the first packet to the server answering the probe
+	Error       string  `json:"error,omitempty"`
+}
+
+// Summary returns the result as a line of text, used by the UI and the commands
+func (r WakeResult) Summary() string {
+	switch r.Outcome {
+	case wakePending:
+		return fmt.Sprintf("Waiting for the server to come online, %d packet(s) sent", r.Packets)
+	case wakeOnline:
+		return fmt.Sprintf("Server online after %s, %d packet(s) sent", formatSeconds(r.BootSeconds), r.Packets)
+	case wakeAlreadyOnline:
+		return "Server was already online"
+	}
+	return fmt.Sprintf("Wake %s after %d packet(s): %s", r.Outcome, r.Packets, r.Error)
+}
+
+// formatSeconds formats a duration in seconds for humans
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds * float64(time.Second))).Round(time.Second).String()
+}
+
+// wakeWorkflow sends Wake-on-LAN packets and polls the probe until the server is
+// online, resending with a doubling delay, or gives up after the timeout
+type wakeWorkflow struct {
+	clock        Clock
+	power        PowerDriver
+	timeout      time.Duration // Give up after this long
+	pollInterval time.Duration // Time between two probes
+	resendAfter  time.Duration // Delay before the second packet, doubled for every further one
+	packets      int           // Maximum number of packets sent
+	logf         func(format string, v ...interface{})
+}
+
+// newWakeWorkflow creates a workflow with the wake settings of cfg
+func newWakeWorkflow(clock Clock, power PowerDriver, cfg *Config) wakeWorkflow {
+	return wakeWorkflow{
+		clock:        clock,
+		power:        power,
+		timeout:      cfg.WakeTimeout(),
+		pollInterval: cfg.WakePollInterval(),
+		resendAfter:  cfg.WakeResendAfter(),
+		packets:      cfg.Wake.Packets,
+		logf:         log.Printf,
+	}
+}
+
+// run wakes the server and reports the result. report, if not nil, is called
+// after every attempt to send a packet with the result so far.
+func (w wakeWorkflow) run(source string, report func(WakeResult)) WakeResult {
+	started := w.clock.Now()
+	result := WakeResult{Source: source, Outcome: wakePending, Started: started.Format(time.RFC3339)}
+	finish := func(outcome string, err error) WakeResult {
+		result.Outcome = outcome
+		result.Success = outcome == wakeOnline || outcome == wakeAlreadyOnline
+		result.Finished = w.clock.Now().Format(time.RFC3339)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		w.logf("Wake (%s): %s", source, result.Summary())
+		return result
+	}
+
+	if w.power.Online() {
+		return finish(wakeAlreadyOnline, nil)
+	}
+
+	deadline := started.Add(w.timeout)
+	delay := w.resendAfter
+	nextSend := started
+	var firstSent time.Time
+	var lastErr error
+	for attempt := 0; ; {
+		if now := w.clock.Now(); attempt < w.packets && !now.Before(nextSend) {
+			attempt++
+			if err := w.power.Wake(); err != nil {
+				lastErr = err
+				result.Error = err.Error()
+				w.logf("Wake (%s): attempt %d/%d failed: %v", source, attempt, w.packets, err)
+			} else {
+				result.Packets++
+				if firstSent.IsZero() {
+					firstSent = now
+				}
+				w.logf("Wake (%s): packet %d/%d sent", source, attempt, w.packets)
+			}
+			if report != nil {
+				report(result)
+			}
+			nextSend = now.Add(delay)
+			delay *= 2
+		}
+		if result.Packets == 0 && attempt == w.packets {
+			return finish(wakeFailed, lastErr)
+		}
+
+		w.clock.Sleep(w.pollInterval)
+		if w.power.Online() {
+			if !firstSent.IsZero() {
+				result.BootSeconds = w.clock.Now().Sub(firstSent).Seconds()
+			}
+			result.Error = ""
+			return finish(wakeOnline, nil)
+		}
+		if !w.clock.Now().Before(deadline) {
+			if result.Packets == 0 {
+				return finish(wakeFailed, lastErr)
+			}
+			return finish(wakeTimedOut, fmt.Errorf("server not online after %s", w.timeout))
+		}
+	}
+}
+
+// wakeTracker runs at most one wake workflow at a time and remembers the
+// result of the last one
+type wakeTracker struct {
+	mu   sync.Mutex
+	last *WakeResult
+	done chan struct{} // Closed when the running workflow ends, nil when idle
+}
+
+// The wake workflows started by the UI, the API, the scheduler, the proxy and leases
+var wakes = &wakeTracker{}
+
+// Last returns the result of the running or last workflow, or nil
+func (t *wakeTracker) Last() *WakeResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last == nil {
+		return nil
+	}
+	last := *t.last
+	return &last
+}
+
+// set stores the result of the running workflow
+func (t *wakeTracker) set(r WakeResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last = &r
+}
+
+// run runs the workflow and returns its result. If a workflow is running
+// already, it waits for that one instead and returns its result.
+func (t *wakeTracker) run(w wakeWorkflow, source string, report func(WakeResult)) WakeResult {
+	t.mu.Lock()
+	if done := t.done; done != nil {
+		t.mu.Unlock()
+		<-done
+		return *t.Last()
+	}
+	done := t.claimLocked(w, source)
+	t.mu.Unlock()
+	return t.runClaimed(w, source, report, done)
+}
+
+// claimLocked marks a workflow as running; the caller holds the lock and has
+// checked that none is
+func (t *wakeTracker) claimLocked(w wakeWorkflow, source string) chan struct{} {
+	done := make(chan struct{})
+	t.done = done
+	t.last = &WakeResult{Source: source, Outcome: wakePending, Started: w.clock.Now().Format(time.RFC3339)}
+	return done
+}
+
+// runClaimed runs a workflow claimed with claimLocked and releases it
+func (t *wakeTracker) runClaimed(w wakeWorkflow, source string, report func(WakeResult), done chan struct{}) WakeResult {
+	result := w.run(source, func(r WakeResult) {
+		t.set(r)
+		if report != nil {
+			report(r)
+		}
+	})
+	t.set(result)
+
+	t.mu.Lock()
+	t.done = nil
+	t.mu.Unlock()
+	close(done)
+	return result
+}
+
+// start runs the workflow in the background and returns once the first packet
+// was sent, or the workflow ended. If a workflow is running already, its
+// current result is returned.
+func (t *wakeTracker) start(w wakeWorkflow, source string) WakeResult {
+	result, _ := t.startWith(w, source, nil, nil)
+	return result
+}
+
+// startWith is start with callbacks: report is called after every attempt to
+// send a packet like for run, done with the result once the workflow ends. It
+// reports whether the workflow was started; for one running already the
+// callbacks are not called.
+func (t *wakeTracker) startWith(w wakeWorkflow, source string, report, done func(WakeResult)) (WakeResult, bool) {
+	// Claim the slot under the same lock as the check, so no other workflow
+	// can start in between
+	t.mu.Lock()
+	if t.done != nil {
+		last := *t.last
+		t.mu.Unlock()
+		return last, false
+	}
+	claimed := t.claimLocked(w, source)
+	t.mu.Unlock()
+
+	first := make(chan WakeResult, 1)
+	go func() {
+		var once sync.Once
+		result := t.runClaimed(w, source, func(r WakeResult) {
+			if report != nil {
+				report(r)
+			}
+			once.Do(func() { first <- r })
+		}, claimed)
+		once.Do(func() { first <- result })
+		if done != nil {
+			done(result)
+		}
+	}()
+	return <-first, true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWakeTrackerStartWithClaimsOnce(t *testing.T) {
+	cfg := testConfig()
+	useConfig(t, cfg)
+
+	// The workflows never see the server online and wait on gate between probes
+	gate := make(chan struct{})
+	clock := &fakeClock{now: at("02:00:00"), gate: gate}
+	tracker := &wakeTracker{}
+
+	const callers = 32
+	begin := make(chan struct{}) // Lets the callers race for the slot together
+	var mu sync.Mutex
+	var started []string
+	doneCalls := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		source := string(rune('a' + i))
+		go func() {
+			defer wg.Done()
+			<-begin
+			workflow := newWakeWorkflow(clock, &fakePower{broken: true}, cfg)
+			workflow.logf = func(string, ...interface{}) {}
+			result, ok := tracker.startWith(workflow, source, nil, func(r WakeResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				doneCalls[r.Source]++
+			})
+			if ok {
+				mu.Lock()
+				started = append(started, source)
+				mu.Unlock()
+				if result.Source != source {
+					t.Errorf("started workflow %s returned the result of %s", source, result.Source)
+				}
+			}
+		}()
+	}
+
+	close(begin)
+
+	// Every caller returns while the one workflow started is still running
+	returned := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("startWith blocked on a workflow started by another caller")
+	}
+	if len(started) != 1 {
+		t.Fatalf("%d callers started a workflow, want exactly one", len(started))
+	}
+
+	close(gate)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		calls := len(doneCalls)
+		mu.Unlock()
+		if calls > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("workflow did not end")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(doneCalls) != 1 || doneCalls[started[0]] != 1 {
+		t.Errorf("done called with %v, want once for %s", doneCalls, started[0])
+	}
+}